@@ -0,0 +1,279 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/greenpau/go-authcrunch/pkg/authn"
+	"go.uber.org/zap"
+)
+
+const (
+	adminEndpointBase = "/security/"
+)
+
+func init() {
+	caddy.RegisterModule(AdminAPI{})
+}
+
+// AdminAPI is a module that serves read-only endpoints with the state
+// of the security app, i.e. the loaded portals, gatekeepers, identity
+// stores and providers.
+type AdminAPI struct {
+	// runningApp returns the security app of the running config.
+	runningApp func() *App
+	logger     *zap.Logger
+}
+
+// adminComponentInfo is the admin API representation of a security
+// app component.
+type adminComponentInfo struct {
+	Name              string      `json:"name"`
+	Kind              string      `json:"kind,omitempty"`
+	Driver            string      `json:"driver,omitempty"`
+	Realm             string      `json:"realm,omitempty"`
+	Realms            []string    `json:"realms,omitempty"`
+	IdentityStores    []string    `json:"identity_stores,omitempty"`
+	IdentityProviders []string    `json:"identity_providers,omitempty"`
+	SSOProviders      []string    `json:"sso_providers,omitempty"`
+	Healthy           bool        `json:"healthy"`
+	Config            interface{} `json:"config,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (AdminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.security",
+		New: func() caddy.Module { return new(AdminAPI) },
+	}
+}
+
+// Provision sets up the admin API module.
+func (a *AdminAPI) Provision(ctx caddy.Context) error {
+	a.logger = ctx.Logger(a)
+	a.runningApp = getRunningApp
+	return nil
+}
+
+// Routes returns the admin routes for the security app.
+func (a *AdminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: adminEndpointBase,
+			Handler: caddy.AdminHandlerFunc(a.handleAPIEndpoints),
+		},
+	}
+}
+
+// handleAPIEndpoints routes API requests within adminEndpointBase and
+// records them in the audit log of the running security app.
+func (a *AdminAPI) handleAPIEndpoints(w http.ResponseWriter, r *http.Request) error {
+	app := a.runningApp()
+	err := a.serveAPIEndpoints(w, r, app)
+	if app != nil {
+		app.audit.auditAdminAPI(r, err)
+	}
+	return err
+}
+
+func (a *AdminAPI) serveAPIEndpoints(w http.ResponseWriter, r *http.Request, app *App) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+
+	if app == nil || app.server == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusServiceUnavailable,
+			Err:        fmt.Errorf("security app is not running"),
+		}
+	}
+
+	uri := strings.Trim(strings.TrimPrefix(r.URL.Path, adminEndpointBase), "/")
+	parts := strings.Split(uri, "/")
+
+	srv := app.server
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	var entries []*adminComponentInfo
+	switch parts[0] {
+	case "portals":
+		entries = srv.getPortalInfo()
+	case "gatekeepers":
+		entries = srv.getGatekeeperInfo()
+	case "identity_stores":
+		entries = srv.getIdentityStoreInfo()
+	case "identity_providers":
+		entries = srv.getIdentityProviderInfo()
+	case "sso_providers":
+		entries = srv.getSingleSignOnProviderInfo()
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("resource not found: %v", r.URL.Path),
+		}
+	}
+
+	switch len(parts) {
+	case 1:
+		if entries == nil {
+			entries = []*adminComponentInfo{}
+		}
+		return writeAdminResponse(w, entries)
+	case 2:
+		for _, entry := range entries {
+			if entry.Name == parts[1] {
+				return writeAdminResponse(w, entry)
+			}
+		}
+	}
+
+	return caddy.APIError{
+		HTTPStatus: http.StatusNotFound,
+		Err:        fmt.Errorf("resource not found: %v", r.URL.Path),
+	}
+}
+
+func writeAdminResponse(w http.ResponseWriter, data interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("failed to encode response: %v", err),
+		}
+	}
+	return nil
+}
+
+func (srv *server) getPortalInfo() []*adminComponentInfo {
+	var entries []*adminComponentInfo
+	for _, cfg := range srv.config.AuthenticationPortals {
+		if _, exists := srv.portals[cfg.Name]; !exists {
+			continue
+		}
+		entries = append(entries, &adminComponentInfo{
+			Name:              cfg.Name,
+			IdentityStores:    cfg.IdentityStores,
+			IdentityProviders: cfg.IdentityProviders,
+			SSOProviders:      cfg.SingleSignOnProviders,
+			Realms:            srv.realms[cfg.Name],
+			Healthy:           srv.isPortalHealthy(cfg),
+			Config:            redactConfig(cfg),
+		})
+	}
+	return entries
+}
+
+func (srv *server) getGatekeeperInfo() []*adminComponentInfo {
+	var entries []*adminComponentInfo
+	for _, cfg := range srv.config.AuthorizationPolicies {
+		if _, exists := srv.gatekeepers[cfg.Name]; !exists {
+			continue
+		}
+		// The gatekeeper serves requests once its policy is provisioned.
+		_, provisioned := srv.policies[cfg.Name]
+		entries = append(entries, &adminComponentInfo{
+			Name:    cfg.Name,
+			Healthy: provisioned,
+			Config:  redactConfig(cfg),
+		})
+	}
+	return entries
+}
+
+func (srv *server) getIdentityStoreInfo() []*adminComponentInfo {
+	var entries []*adminComponentInfo
+	for _, cfg := range srv.config.IdentityStores {
+		store, exists := srv.identityStores[cfg.Name]
+		entries = append(entries, &adminComponentInfo{
+			Name:    cfg.Name,
+			Kind:    cfg.Kind,
+			Realm:   getConfigParam(cfg.Params, "realm"),
+			Healthy: exists && store.Configured(),
+			Config:  redactConfig(cfg),
+		})
+	}
+	return entries
+}
+
+func (srv *server) getIdentityProviderInfo() []*adminComponentInfo {
+	var entries []*adminComponentInfo
+	for _, cfg := range srv.config.IdentityProviders {
+		provider, exists := srv.identityProviders[cfg.Name]
+		entries = append(entries, &adminComponentInfo{
+			Name:    cfg.Name,
+			Kind:    cfg.Kind,
+			Driver:  getConfigParam(cfg.Params, "driver"),
+			Realm:   getConfigParam(cfg.Params, "realm"),
+			Healthy: exists && provider.Configured(),
+			Config:  redactConfig(cfg),
+		})
+	}
+	return entries
+}
+
+func (srv *server) getSingleSignOnProviderInfo() []*adminComponentInfo {
+	var entries []*adminComponentInfo
+	for _, cfg := range srv.config.SingleSignOnProviders {
+		provider, exists := srv.ssoProviders[cfg.Name]
+		entries = append(entries, &adminComponentInfo{
+			Name:    cfg.Name,
+			Driver:  cfg.Driver,
+			Healthy: exists && provider.Configured(),
+			Config:  redactConfig(cfg),
+		})
+	}
+	return entries
+}
+
+// isPortalHealthy returns true when the identity stores, the identity
+// providers, and the sso providers enabled in a portal are configured.
+func (srv *server) isPortalHealthy(cfg *authn.PortalConfig) bool {
+	for _, name := range cfg.IdentityStores {
+		if store, exists := srv.identityStores[name]; !exists || !store.Configured() {
+			return false
+		}
+	}
+	for _, name := range cfg.IdentityProviders {
+		if provider, exists := srv.identityProviders[name]; !exists || !provider.Configured() {
+			return false
+		}
+	}
+	for _, name := range cfg.SingleSignOnProviders {
+		if provider, exists := srv.ssoProviders[name]; !exists || !provider.Configured() {
+			return false
+		}
+	}
+	return true
+}
+
+func getConfigParam(params map[string]interface{}, k string) string {
+	v, _ := params[k].(string)
+	return v
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner = (*AdminAPI)(nil)
+	_ caddy.AdminRouter = (*AdminAPI)(nil)
+)
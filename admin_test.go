@@ -0,0 +1,326 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/google/go-cmp/cmp"
+	logutil "github.com/greenpau/go-authcrunch/pkg/util/log"
+)
+
+func TestAdminAPI(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "users.json")
+	cfg := newTestServerConfig(t, fmt.Sprintf(testServerCaddyfile, "local", dbPath, "authp/admin"))
+	srv, _, err := newServer(cfg, nil, nil, false, logutil.NewLogger())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := srv.provisionPolicies(nil, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	app := &App{server: srv}
+
+	// The degraded server lost its identity store, e.g. after a failed
+	// reload.
+	degraded, _, err := newServer(cfg, nil, nil, false, logutil.NewLogger())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	delete(degraded.identityStores, "localdb")
+	degradedApp := &App{server: degraded}
+
+	testcases := []struct {
+		name       string
+		method     string
+		path       string
+		running    bool
+		degraded   bool
+		want       []string
+		unhealthy  []string
+		statusCode int
+	}{
+		{
+			name:    "list portals",
+			method:  http.MethodGet,
+			path:    "/security/portals",
+			running: true,
+			want:    []string{"myportal"},
+		},
+		{
+			name:    "get portal by name",
+			method:  http.MethodGet,
+			path:    "/security/portals/myportal",
+			running: true,
+			want:    []string{"myportal"},
+		},
+		{
+			name:    "list gatekeepers",
+			method:  http.MethodGet,
+			path:    "/security/gatekeepers",
+			running: true,
+			want:    []string{"mypolicy"},
+		},
+		{
+			name:    "list identity stores",
+			method:  http.MethodGet,
+			path:    "/security/identity_stores",
+			running: true,
+			want:    []string{"localdb"},
+		},
+		{
+			name:    "list identity providers",
+			method:  http.MethodGet,
+			path:    "/security/identity_providers",
+			running: true,
+			want:    []string{},
+		},
+		{
+			name:      "list portals with unconfigured identity store",
+			method:    http.MethodGet,
+			path:      "/security/portals",
+			running:   true,
+			degraded:  true,
+			want:      []string{"myportal"},
+			unhealthy: []string{"myportal"},
+		},
+		{
+			name:      "list unconfigured identity stores",
+			method:    http.MethodGet,
+			path:      "/security/identity_stores",
+			running:   true,
+			degraded:  true,
+			want:      []string{"localdb"},
+			unhealthy: []string{"localdb"},
+		},
+		{
+			name:      "list gatekeepers without provisioned policies",
+			method:    http.MethodGet,
+			path:      "/security/gatekeepers",
+			running:   true,
+			degraded:  true,
+			want:      []string{"mypolicy"},
+			unhealthy: []string{"mypolicy"},
+		},
+		{
+			name:       "get unknown portal",
+			method:     http.MethodGet,
+			path:       "/security/portals/foo",
+			running:    true,
+			statusCode: http.StatusNotFound,
+		},
+		{
+			name:       "get unknown resource",
+			method:     http.MethodGet,
+			path:       "/security/foo",
+			running:    true,
+			statusCode: http.StatusNotFound,
+		},
+		{
+			name:       "post is not allowed",
+			method:     http.MethodPost,
+			path:       "/security/portals",
+			running:    true,
+			statusCode: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "app is not running",
+			method:     http.MethodGet,
+			path:       "/security/portals",
+			statusCode: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &AdminAPI{runningApp: func() *App { return nil }}
+			if tc.running {
+				a.runningApp = func() *App { return app }
+			}
+			if tc.degraded {
+				a.runningApp = func() *App { return degradedApp }
+			}
+
+			r := httptest.NewRequest(tc.method, tc.path, nil)
+			w := httptest.NewRecorder()
+			err := a.handleAPIEndpoints(w, r)
+			if tc.statusCode > 0 {
+				apiErr, ok := err.(caddy.APIError)
+				if !ok {
+					t.Fatalf("expected api error, got: %v", err)
+				}
+				if apiErr.HTTPStatus != tc.statusCode {
+					t.Fatalf("unexpected status code: got %d, want %d", apiErr.HTTPStatus, tc.statusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			body := w.Body.String()
+			if strings.Contains(body, "0e2fdcf8-6868-41a7-884b-7308795fc286") {
+				t.Fatalf("found unredacted secret in response: %s", body)
+			}
+
+			var entries []*adminComponentInfo
+			if strings.HasPrefix(strings.TrimSpace(body), "[") {
+				if err := json.Unmarshal([]byte(body), &entries); err != nil {
+					t.Fatalf("failed to parse response: %v", err)
+				}
+			} else {
+				entry := &adminComponentInfo{}
+				if err := json.Unmarshal([]byte(body), entry); err != nil {
+					t.Fatalf("failed to parse response: %v", err)
+				}
+				entries = append(entries, entry)
+			}
+			got := []string{}
+			var unhealthy []string
+			for _, entry := range entries {
+				if !entry.Healthy {
+					unhealthy = append(unhealthy, entry.Name)
+				}
+				got = append(got, entry.Name)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("unexpected response (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.unhealthy, unhealthy); diff != "" {
+				t.Errorf("unexpected unhealthy components (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRedactConfig(t *testing.T) {
+	input := map[string]interface{}{
+		"raw_crypto_key_store_config": []string{
+			"crypto key sign-verify foobar",
+			"crypto key k1 verify from file /path/to/key.pem",
+			"crypto default token lifetime 3600",
+		},
+		"params": map[string]interface{}{
+			"client_id":     "myid",
+			"client_secret": "foobar",
+			"bind_password": "secrets:ldap:password",
+			"api_key":       "{env.API_KEY}",
+			"private_key":   `{"type": "service_account", "private_key": "foobar"}`,
+			"secret_key":    "{foo bar}",
+			"users": []interface{}{
+				map[string]interface{}{
+					"username": "jsmith",
+					"password": "foobar",
+				},
+			},
+		},
+		"raw_credential_configs": [][]string{{"name smtp", "username foo", "password foobar"}},
+	}
+	want := map[string]interface{}{
+		"raw_crypto_key_store_config": []interface{}{
+			"crypto key sign-verify " + redactedValue + "(sha256:c3ab8ff13720)",
+			"crypto key k1 verify from file /path/to/key.pem",
+			"crypto default token lifetime 3600",
+		},
+		"params": map[string]interface{}{
+			"client_id":     "myid",
+			"client_secret": redactedValue + "(sha256:c3ab8ff13720)",
+			"bind_password": "secrets:ldap:password",
+			"api_key":       "{env.API_KEY}",
+			"private_key":   redactedValue + "(sha256:7a2c7871cadd)",
+			"secret_key":    redactedValue + "(sha256:a8d83d7b8704)",
+			"users": []interface{}{
+				map[string]interface{}{
+					"username": "jsmith",
+					"password": redactedValue + "(sha256:c3ab8ff13720)",
+				},
+			},
+		},
+		"raw_credential_configs": []interface{}{[]interface{}{"name smtp", "username foo", "password " + redactedValue + "(sha256:c3ab8ff13720)"}},
+	}
+	if diff := cmp.Diff(want, redactConfig(input)); diff != "" {
+		t.Errorf("unexpected redacted config (-want +got):\n%s", diff)
+	}
+}
+
+func TestRedactedAdapter(t *testing.T) {
+	adapter := caddyconfig.GetAdapter(redactedAdapterName)
+	if adapter == nil {
+		t.Fatalf("%q adapter is not registered", redactedAdapterName)
+	}
+	b, _, err := adapter.Adapt([]byte(`{
+	  security {
+	    oauth identity provider generic {
+	      realm generic
+	      driver generic
+	      client_id foo
+	      client_secret foobar
+	      scopes openid email profile
+	      base_auth_url https://localhost/oauth
+	      metadata_url https://localhost/oauth/.well-known/openid-configuration
+	    }
+	    authentication portal myportal {
+	      crypto key sign-verify foobar
+	      enable identity provider generic
+	    }
+	  }
+	}`), nil)
+	if err != nil {
+		t.Fatalf("failed adapting config: %v", err)
+	}
+	if strings.Contains(string(b), "foobar") {
+		t.Fatalf("adapted config holds plaintext secret: %s", b)
+	}
+	if got := strings.Count(string(b), redactedValue+"(sha256:c3ab8ff13720)"); got != 3 {
+		t.Fatalf("adapted config has %d redacted values, want 3: %s", got, b)
+	}
+
+	var config struct {
+		Apps struct {
+			Security *App `json:"security"`
+		} `json:"apps"`
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		t.Fatalf("failed unmarshaling config: %v", err)
+	}
+	err = ResolveRuntimeAppConfig(context.TODO(), caddy.NewReplacer(), nil, config.Apps.Security.Config, logutil.NewLogger())
+	if err == nil || !strings.Contains(err.Error(), "holds redacted value") {
+		t.Fatalf("expected redacted value error, got: %v", err)
+	}
+
+	raw, err := parseCaddyfile(caddyfile.NewTestDispenser(`
+	security {
+	  authentication portal myportal {
+	    crypto key sign-verify foobar
+	  }
+	}`), nil)
+	if err != nil {
+		t.Fatalf("failed parsing config: %v", err)
+	}
+	if value := string(raw.(httpcaddyfile.App).Value); !strings.Contains(value, "foobar") {
+		t.Fatalf("caddyfile adapter redacted config: %s", value)
+	}
+}
@@ -17,6 +17,7 @@ package security
 import (
 	"context"
 	"encoding/json"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/greenpau/go-authcrunch"
@@ -30,9 +31,10 @@ var (
 	appName = "security"
 
 	// Interface guards
-	_ caddy.Provisioner = (*App)(nil)
-	_ caddy.Module      = (*App)(nil)
-	_ caddy.App         = (*App)(nil)
+	_ caddy.Provisioner  = (*App)(nil)
+	_ caddy.Module       = (*App)(nil)
+	_ caddy.App          = (*App)(nil)
+	_ caddy.CleanerUpper = (*App)(nil)
 )
 
 func init() {
@@ -50,10 +52,27 @@ type App struct {
 	Name   string             `json:"-"`
 	Config *authcrunch.Config `json:"config,omitempty"`
 
+	// AuthorizationPolicyExtensions holds the settings of authorization
+	// policies enforced by the authorize middleware.
+	AuthorizationPolicyExtensions []*AuthorizationPolicyExtension `json:"authorization_policy_extensions,omitempty"`
+
+	// AuditLog configures the sink of the security audit log.
+	AuditLog *AuditLogConfig `json:"audit_log,omitempty"`
+
 	SecretsManagerConfigs []json.RawMessage `json:"secrets_managers,omitempty" caddy:"namespace=security.secrets inline_key=driver"`
 	secretsManagers       []SecretsManager
 
-	server *authcrunch.Server
+	// SecretsResolution holds the timeouts, the retries, and the cache
+	// settings for fetching secrets from the secrets managers.
+	SecretsResolution []*SecretsResolutionConfig `json:"secrets_resolution,omitempty"`
+
+	// rawConfig is the config before the secrets are resolved. It is kept
+	// to resolve the config again when the secrets are rotated.
+	rawConfig []byte
+
+	ctx    caddy.Context
+	server *server
+	audit  *auditLogger
 	logger *zap.Logger
 }
 
@@ -68,6 +87,7 @@ func (App) CaddyModule() caddy.ModuleInfo {
 // Provision sets up the repo manager.
 func (app *App) Provision(ctx caddy.Context) error {
 	app.Name = appName
+	app.ctx = ctx
 	app.logger = ctx.Logger(app)
 
 	app.logger.Info(
@@ -75,6 +95,26 @@ func (app *App) Provision(ctx caddy.Context) error {
 		zap.String("app", app.Name),
 	)
 
+	if err := initSecurityMetrics(ctx.GetMetricsRegistry()); err != nil {
+		app.logger.Error(
+			"app failed registering metrics",
+			zap.String("app_name", app.Name),
+			zap.Error(err),
+		)
+		return err
+	}
+
+	audit, err := newAuditLogger(ctx, app.AuditLog, app.logger)
+	if err != nil {
+		app.logger.Error(
+			"app failed provisioning audit log",
+			zap.String("app_name", app.Name),
+			zap.Error(err),
+		)
+		return err
+	}
+	app.audit = audit
+
 	secretsManagerConfigs, err := ctx.LoadModule(app, "SecretsManagerConfigs")
 	if err != nil {
 		app.logger.Error(
@@ -90,13 +130,39 @@ func (app *App) Provision(ctx caddy.Context) error {
 		app.logger.Info(
 			"loaded secrets manager plugin",
 			zap.String("app_name", app.Name),
-			zap.Any("config", secretsManagerPlugin.GetConfig(ctx)),
+			redactedField("config", secretsManagerPlugin.GetConfig(ctx)),
 		)
 		app.secretsManagers = append(app.secretsManagers, secretsManagerPlugin)
 	}
 
 	repl := caddy.NewReplacer()
-	if err := ResolveRuntimeAppConfig(ctx, repl, app.secretsManagers, app.Config, app.logger); err != nil {
+	for _, cfg := range app.SecretsResolution {
+		cfg.CachePath = repl.ReplaceKnown(cfg.CachePath, "")
+		cfg.CacheKey = repl.ReplaceKnown(cfg.CacheKey, "")
+		if err := cfg.Validate(); err != nil {
+			app.logger.Error(
+				"app failed validating secrets resolution config",
+				zap.String("app_name", app.Name),
+				zap.Error(err),
+			)
+			return err
+		}
+	}
+
+	if app.hasSecretsRotation(ctx) {
+		app.rawConfig, err = json.Marshal(app.Config)
+		if err != nil {
+			app.logger.Error(
+				"app failed encoding config for secrets rotation",
+				zap.String("app_name", app.Name),
+				zap.Error(err),
+			)
+			return err
+		}
+	}
+
+	secretsResolvers := newSecretsResolvers(ctx, app.secretsManagers, app.SecretsResolution, app.logger)
+	if err := ResolveRuntimeAppConfig(ctx, repl, secretsResolvers, app.Config, app.logger); err != nil {
 		return err
 	}
 
@@ -108,8 +174,28 @@ func (app *App) Provision(ctx caddy.Context) error {
 		)
 		return err
 	}
+	saveSecretsCache(secretsResolvers, app.logger)
 
-	server, err := authcrunch.NewServer(app.Config, app.logger)
+	for _, ext := range app.AuthorizationPolicyExtensions {
+		if err := ext.Validate(); err != nil {
+			app.logger.Error(
+				"app failed validating config",
+				zap.String("app_name", app.Name),
+				zap.Error(err),
+			)
+			return err
+		}
+	}
+
+	// The verify keys of the secrets rotated by the running app remain
+	// valid across the reload.
+	var prev *server
+	var retained map[string][]*retainedKey
+	if running := getRunningApp(); running != nil && running.server != nil {
+		prev = running.server
+		retained = getRetainedKeys(app.Config, prev, time.Now())
+	}
+	server, changes, err := newServer(app.Config, prev, retained, false, app.logger)
 	if err != nil {
 		app.logger.Error(
 			"failed provisioning app server instance",
@@ -119,6 +205,25 @@ func (app *App) Provision(ctx caddy.Context) error {
 		return err
 	}
 
+	if err := server.provisionPolicies(app.AuthorizationPolicyExtensions, prev); err != nil {
+		app.logger.Error(
+			"app failed provisioning authorization policy extension",
+			zap.String("app_name", app.Name),
+			zap.Error(err),
+		)
+		return err
+	}
+
+	for _, change := range changes {
+		app.logger.Info(
+			"provisioned app component",
+			zap.String("app", app.Name),
+			zap.String("component_kind", change.Kind),
+			zap.String("component_name", change.Name),
+			zap.String("action", change.Action),
+		)
+	}
+
 	app.server = server
 
 	app.logger.Info(
@@ -129,7 +234,10 @@ func (app *App) Provision(ctx caddy.Context) error {
 }
 
 // Start starts the App.
-func (app App) Start() error {
+func (app *App) Start() error {
+	if app.rawConfig != nil {
+		go app.startSecretsRotation(app.ctx)
+	}
 	app.logger.Debug(
 		"started app instance",
 		zap.String("app", app.Name),
@@ -138,7 +246,7 @@ func (app App) Start() error {
 }
 
 // Stop stops the App.
-func (app App) Stop() error {
+func (app *App) Stop() error {
 	app.logger.Debug(
 		"stopped app instance",
 		zap.String("app", app.Name),
@@ -146,6 +254,23 @@ func (app App) Stop() error {
 	return nil
 }
 
+// Cleanup closes the audit log sink of the App.
+func (app *App) Cleanup() error {
+	return app.audit.close()
+}
+
+// getRunningApp returns the security app of the running config. During
+// a config reload, it is the app being replaced, whose server is the base
+// for the server of the new app.
+func getRunningApp() *App {
+	appModule, err := caddy.ActiveContext().AppIfConfigured(appName)
+	if err != nil {
+		return nil
+	}
+	app, _ := appModule.(*App)
+	return app
+}
+
 func (app *App) getPortal(s string) (*authn.Portal, error) {
 	return app.server.GetPortalByName(s)
 }
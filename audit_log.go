@@ -0,0 +1,306 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/greenpau/caddy-security/pkg/util"
+	"github.com/greenpau/go-authcrunch/pkg/requests"
+	addrutil "github.com/greenpau/go-authcrunch/pkg/util/addr"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	auditLoggerName = "audit"
+
+	auditEventLogin        = "login"
+	auditEventLogout       = "logout"
+	auditEventTokenIssued  = "token_issued"
+	auditEventRegistration = "registration"
+	auditEventAuthzDenial  = "authorization_denial"
+	auditEventAdminAPI     = "admin_api"
+
+	auditOutcomeSuccess = "success"
+	auditOutcomeFailure = "failure"
+	auditOutcomePending = "pending"
+)
+
+// AuditLogConfig configures the sink of the security audit log. Without
+// the config, the audit records are emitted by the "security.audit" logger,
+// which could be routed with the "include" option of Caddy logs.
+type AuditLogConfig struct {
+	// The module that writes out audit records, e.g. file. Defaults to stderr.
+	WriterRaw json.RawMessage `json:"writer,omitempty" caddy:"namespace=caddy.logging.writers inline_key=output"`
+	// The module that encodes audit records. Defaults to JSON.
+	EncoderRaw json.RawMessage `json:"encoder,omitempty" caddy:"namespace=caddy.logging.encoders inline_key=format"`
+	// Level is the minimum level to emit. Defaults to INFO.
+	Level string `json:"level,omitempty"`
+}
+
+// auditLogger emits one structured record per security event, e.g. login,
+// logout, token issuance, authorization denial, registration, and admin
+// API action.
+type auditLogger struct {
+	logger    *zap.Logger
+	writerKey string
+}
+
+// auditWriters holds the writers of the audit log sinks by writer key, as
+// Caddy holds the writers of its logs. The sink writer of the config being
+// replaced is reused by the new config, and it is closed when the last
+// config using it is cleaned up.
+var auditWriters = caddy.NewUsagePool()
+
+type auditWriterDestructor struct {
+	io.WriteCloser
+}
+
+// Destruct closes the writer.
+func (d auditWriterDestructor) Destruct() error {
+	return d.Close()
+}
+
+// auditRecord is the security event. The fields of the record are
+// always present in the log, even when empty, to keep the schema stable.
+type auditRecord struct {
+	Event      string
+	RequestID  string
+	SrcIP      string
+	Method     string
+	URL        string
+	User       string
+	Realm      string
+	Portal     string
+	Gatekeeper string
+	Outcome    string
+	Reason     string
+}
+
+// newAuditLogger returns the audit logger. When the config is nil, the
+// logger is derived from the provided logger of the security app.
+func newAuditLogger(ctx caddy.Context, cfg *AuditLogConfig, logger *zap.Logger) (*auditLogger, error) {
+	if cfg == nil {
+		return &auditLogger{logger: logger.Named(auditLoggerName)}, nil
+	}
+
+	var writerOpener caddy.WriterOpener = caddy.StderrWriter{}
+	if cfg.WriterRaw != nil {
+		mod, err := ctx.LoadModule(cfg, "WriterRaw")
+		if err != nil {
+			return nil, fmt.Errorf("loading audit log writer module: %v", err)
+		}
+		writerOpener = mod.(caddy.WriterOpener)
+	}
+
+	var encoder zapcore.Encoder
+	if cfg.EncoderRaw != nil {
+		mod, err := ctx.LoadModule(cfg, "EncoderRaw")
+		if err != nil {
+			return nil, fmt.Errorf("loading audit log encoder module: %v", err)
+		}
+		encoder = mod.(zapcore.Encoder)
+	}
+	if encoder == nil {
+		encoder = zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	}
+
+	level := zapcore.InfoLevel
+	if cfg.Level != "" {
+		var err error
+		level, err = zapcore.ParseLevel(strings.ToLower(cfg.Level))
+		if err != nil {
+			return nil, fmt.Errorf("audit log level is malformed: %v", err)
+		}
+	}
+
+	writerKey := writerOpener.WriterKey()
+	writer, _, err := auditWriters.LoadOrNew(writerKey, func() (caddy.Destructor, error) {
+		w, err := writerOpener.OpenWriter()
+		return auditWriterDestructor{w}, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log writer using %s: %v", writerOpener.String(), err)
+	}
+
+	core := zapcore.NewCore(encoder, zapcore.AddSync(writer.(io.WriteCloser)), level)
+	return &auditLogger{
+		logger:    zap.New(core).Named(appName + "." + auditLoggerName),
+		writerKey: writerKey,
+	}, nil
+}
+
+// close releases the writer of the audit log sink, if any. The writer is
+// closed when no other config uses it.
+func (l *auditLogger) close() error {
+	if l == nil || l.writerKey == "" {
+		return nil
+	}
+	_, err := auditWriters.Delete(l.writerKey)
+	return err
+}
+
+// log emits the audit record. The denials are logged with WARN level.
+func (l *auditLogger) log(rec *auditRecord) {
+	if l == nil {
+		return
+	}
+	fields := []zap.Field{
+		zap.String("event", rec.Event),
+		zap.String("request_id", rec.RequestID),
+		zap.String("src_ip", rec.SrcIP),
+		zap.String("method", rec.Method),
+		zap.String("url", rec.URL),
+		zap.String("user", rec.User),
+		zap.String("realm", rec.Realm),
+		zap.String("portal", rec.Portal),
+		zap.String("gatekeeper", rec.Gatekeeper),
+		zap.String("outcome", rec.Outcome),
+		zap.String("reason", rec.Reason),
+	}
+	switch rec.Outcome {
+	case auditOutcomeFailure, outcomeDenied, outcomeAudited:
+		l.logger.Warn("security audit", fields...)
+	default:
+		l.logger.Info("security audit", fields...)
+	}
+}
+
+// newAuditRecord returns the audit record with the request fields.
+func newAuditRecord(event string, r *http.Request) *auditRecord {
+	return &auditRecord{
+		Event:     event,
+		RequestID: util.GetRequestID(r),
+		SrcIP:     addrutil.GetSourceAddress(r),
+		Method:    r.Method,
+		URL:       r.URL.Path,
+	}
+}
+
+// auditAuthn logs the security events of a request to an authentication
+// portal. The token issuance follows a successful login.
+func (l *auditLogger) auditAuthn(r *http.Request, rr *requests.Request, portalName string, statusCode int, err error) {
+	if l == nil {
+		return
+	}
+	event := getAuthnAuditEvent(r, rr, statusCode, err)
+	if event == "" {
+		return
+	}
+
+	rec := newAuditRecord(event, r)
+	rec.User = rr.User.Username
+	if rec.User == "" {
+		rec.User = rr.User.Email
+	}
+	rec.Realm = rr.Upstream.Realm
+	rec.Portal = portalName
+
+	switch {
+	case err != nil:
+		rec.Outcome = auditOutcomeFailure
+		rec.Reason = err.Error()
+	case statusCode >= 400:
+		rec.Outcome = auditOutcomeFailure
+		rec.Reason = http.StatusText(statusCode)
+	case event == auditEventLogin && !rr.Response.Authenticated:
+		// The login continues, e.g. with multi-factor authentication.
+		rec.Outcome = auditOutcomePending
+	default:
+		rec.Outcome = auditOutcomeSuccess
+	}
+	l.log(rec)
+
+	if event == auditEventLogin && rr.Response.Authenticated {
+		token := *rec
+		token.Event = auditEventTokenIssued
+		l.log(&token)
+	}
+}
+
+// getAuthnAuditEvent returns the security event of a request to an
+// authentication portal. It returns empty string for the requests
+// without security events, e.g. login page views and static assets.
+func getAuthnAuditEvent(r *http.Request, rr *requests.Request, statusCode int, err error) string {
+	p := r.URL.Path
+	switch {
+	case strings.HasSuffix(p, "/logout"):
+		return auditEventLogout
+	case strings.HasSuffix(p, "/register"), strings.Contains(p, "/register/"):
+		if r.Method == http.MethodPost {
+			return auditEventRegistration
+		}
+	case strings.HasSuffix(p, "/login"),
+		strings.Contains(p, "/basic/login/"),
+		strings.Contains(p, "/oauth2/"),
+		strings.Contains(p, "/saml/"),
+		strings.Contains(p, "/sandbox/"):
+		if rr.Response.Authenticated || r.Method == http.MethodPost || statusCode >= 400 || err != nil {
+			return auditEventLogin
+		}
+	}
+	return ""
+}
+
+// auditAuthzDenial logs the request denied by an authorization policy.
+// The requests let through by the policy in audit mode have "audited"
+// outcome.
+func (l *auditLogger) auditAuthzDenial(r *http.Request, ar *requests.AuthorizationRequest, gatekeeperName, outcome string, err error) {
+	if l == nil {
+		return
+	}
+	rec := newAuditRecord(auditEventAuthzDenial, r)
+	rec.User = getAuthorizationUser(ar)
+	rec.Realm = getAuthorizationRealm(ar)
+	rec.Gatekeeper = gatekeeperName
+	rec.Outcome = outcome
+	if err != nil {
+		rec.Reason = err.Error()
+	}
+	l.log(rec)
+}
+
+// auditAdminAPI logs the request to the admin API of the security app.
+func (l *auditLogger) auditAdminAPI(r *http.Request, err error) {
+	if l == nil {
+		return
+	}
+	rec := newAuditRecord(auditEventAdminAPI, r)
+	rec.Outcome = auditOutcomeSuccess
+	if err != nil {
+		rec.Outcome = auditOutcomeFailure
+		rec.Reason = err.Error()
+	}
+	l.log(rec)
+}
+
+// getAuthorizationUser returns the user of an authorization request.
+func getAuthorizationUser(ar *requests.AuthorizationRequest) string {
+	if ar.Response.User == nil {
+		return ""
+	}
+	for _, k := range []string{"email", "sub", "name"} {
+		if v, ok := claimValueToString(ar.Response.User[k]); ok && v != "" {
+			return v
+		}
+	}
+	return ""
+}
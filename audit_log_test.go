@@ -0,0 +1,226 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/google/go-cmp/cmp"
+	"github.com/greenpau/go-authcrunch/pkg/requests"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func newTestAuditLogger() (*auditLogger, *observer.ObservedLogs) {
+	core, logs := observer.New(zap.InfoLevel)
+	return &auditLogger{logger: zap.New(core)}, logs
+}
+
+func getTestAuditRecords(logs *observer.ObservedLogs) []map[string]interface{} {
+	var records []map[string]interface{}
+	for _, entry := range logs.All() {
+		record := entry.ContextMap()
+		record["level"] = entry.Level.String()
+		delete(record, "request_id")
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestAuditAuthn(t *testing.T) {
+	testcases := []struct {
+		name          string
+		method        string
+		path          string
+		username      string
+		authenticated bool
+		statusCode    int
+		err           error
+		want          []map[string]interface{}
+	}{
+		{
+			name:       "test login page view",
+			method:     http.MethodGet,
+			path:       "/auth/login",
+			statusCode: http.StatusOK,
+		},
+		{
+			name:          "test successful login",
+			method:        http.MethodPost,
+			path:          "/auth/login",
+			username:      "jsmith",
+			authenticated: true,
+			statusCode:    http.StatusSeeOther,
+			want: []map[string]interface{}{
+				newTestAuditRecord("info", auditEventLogin, http.MethodPost, "/auth/login", "jsmith", auditOutcomeSuccess, ""),
+				newTestAuditRecord("info", auditEventTokenIssued, http.MethodPost, "/auth/login", "jsmith", auditOutcomeSuccess, ""),
+			},
+		},
+		{
+			name:       "test failed login",
+			method:     http.MethodPost,
+			path:       "/auth/login",
+			username:   "jsmith",
+			statusCode: http.StatusUnauthorized,
+			want: []map[string]interface{}{
+				newTestAuditRecord("warn", auditEventLogin, http.MethodPost, "/auth/login", "jsmith", auditOutcomeFailure, "Unauthorized"),
+			},
+		},
+		{
+			name:       "test login pending second factor",
+			method:     http.MethodPost,
+			path:       "/auth/login",
+			username:   "jsmith",
+			statusCode: http.StatusSeeOther,
+			want: []map[string]interface{}{
+				newTestAuditRecord("info", auditEventLogin, http.MethodPost, "/auth/login", "jsmith", auditOutcomePending, ""),
+			},
+		},
+		{
+			name:       "test oauth login error",
+			method:     http.MethodGet,
+			path:       "/auth/oauth2/google/authorization-code-callback",
+			statusCode: http.StatusOK,
+			err:        fmt.Errorf("state mismatch"),
+			want: []map[string]interface{}{
+				newTestAuditRecord("warn", auditEventLogin, http.MethodGet, "/auth/oauth2/google/authorization-code-callback", "", auditOutcomeFailure, "state mismatch"),
+			},
+		},
+		{
+			name:       "test logout",
+			method:     http.MethodGet,
+			path:       "/auth/logout",
+			statusCode: http.StatusSeeOther,
+			want: []map[string]interface{}{
+				newTestAuditRecord("info", auditEventLogout, http.MethodGet, "/auth/logout", "", auditOutcomeSuccess, ""),
+			},
+		},
+		{
+			name:       "test registration",
+			method:     http.MethodPost,
+			path:       "/auth/register/local",
+			username:   "jsmith",
+			statusCode: http.StatusOK,
+			want: []map[string]interface{}{
+				newTestAuditRecord("info", auditEventRegistration, http.MethodPost, "/auth/register/local", "jsmith", auditOutcomeSuccess, ""),
+			},
+		},
+		{
+			name:       "test static assets",
+			method:     http.MethodGet,
+			path:       "/auth/assets/css/styles.css",
+			statusCode: http.StatusOK,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			l, logs := newTestAuditLogger()
+			r := httptest.NewRequest(tc.method, tc.path, nil)
+			r.RemoteAddr = "10.0.0.1:12345"
+			rr := requests.NewRequest()
+			rr.User.Username = tc.username
+			rr.Upstream.Realm = "local"
+			rr.Response.Authenticated = tc.authenticated
+			l.auditAuthn(r, rr, "myportal", tc.statusCode, tc.err)
+			if diff := cmp.Diff(tc.want, getTestAuditRecords(logs)); diff != "" {
+				t.Errorf("auditAuthn() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAuditAuthzDenial(t *testing.T) {
+	l, logs := newTestAuditLogger()
+	r := httptest.NewRequest(http.MethodGet, "/admin", nil)
+	r.RemoteAddr = "10.0.0.1:12345"
+	ar := requests.NewAuthorizationRequest()
+	ar.Response.User = map[string]interface{}{
+		"email": "jsmith@localhost",
+		"realm": "local",
+	}
+	l.auditAuthzDenial(r, ar, "mypolicy", outcomeDenied, fmt.Errorf("user role is not allowed"))
+
+	want := []map[string]interface{}{
+		{
+			"level":      "warn",
+			"event":      auditEventAuthzDenial,
+			"src_ip":     "10.0.0.1",
+			"method":     http.MethodGet,
+			"url":        "/admin",
+			"user":       "jsmith@localhost",
+			"realm":      "local",
+			"portal":     "",
+			"gatekeeper": "mypolicy",
+			"outcome":    outcomeDenied,
+			"reason":     "user role is not allowed",
+		},
+	}
+	if diff := cmp.Diff(want, getTestAuditRecords(logs)); diff != "" {
+		t.Errorf("auditAuthzDenial() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func newTestAuditRecord(level, event, method, url, user, outcome, reason string) map[string]interface{} {
+	return map[string]interface{}{
+		"level":      level,
+		"event":      event,
+		"src_ip":     "10.0.0.1",
+		"method":     method,
+		"url":        url,
+		"user":       user,
+		"realm":      "local",
+		"portal":     "myportal",
+		"gatekeeper": "",
+		"outcome":    outcome,
+		"reason":     reason,
+	}
+}
+
+func TestNewAuditLoggerWriterPool(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	cfg := &AuditLogConfig{WriterRaw: json.RawMessage(`{"output": "stderr"}`)}
+
+	var loggers []*auditLogger
+	for i := 0; i < 2; i++ {
+		l, err := newAuditLogger(ctx, cfg, zap.NewNop())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		loggers = append(loggers, l)
+	}
+	key := loggers[0].writerKey
+	if refs, _ := auditWriters.References(key); refs != 2 {
+		t.Fatalf("unexpected writer references: got %d, want 2", refs)
+	}
+	if err := loggers[0].close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if refs, _ := auditWriters.References(key); refs != 1 {
+		t.Fatalf("unexpected writer references: got %d, want 1", refs)
+	}
+	if err := loggers[1].close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, exists := auditWriters.References(key); exists {
+		t.Fatalf("writer is open after the last logger closed")
+	}
+}
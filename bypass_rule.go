@@ -0,0 +1,253 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/greenpau/go-authcrunch/pkg/authz/bypass"
+)
+
+const (
+	bypassConditionURI    = "uri"
+	bypassConditionMethod = "method"
+	bypassConditionHeader = "header"
+	bypassConditionSource = "source"
+	bypassConditionHost   = "host"
+)
+
+var bypassMethodRegexPattern = regexp.MustCompile(`^[A-Z]+$`)
+
+// BypassRule lets the requests matching all of its conditions through the
+// authorization policy.
+type BypassRule struct {
+	Conditions []*BypassCondition `json:"conditions,omitempty" xml:"conditions,omitempty" yaml:"conditions,omitempty"`
+}
+
+// BypassCondition is a condition of a bypass rule. The condition matches
+// when the request matches any of its values, i.e.
+//
+//	uri <match_type> <path>
+//	method <method> [<method>...]
+//	header <name> <match_type> <value>
+//	source <cidr> [<cidr>...]
+//	host <host> [<host>...]
+//
+// The hosts may start with a wildcard label, e.g. "*.example.com".
+type BypassCondition struct {
+	Type      string   `json:"type,omitempty" xml:"type,omitempty" yaml:"type,omitempty"`
+	Name      string   `json:"name,omitempty" xml:"name,omitempty" yaml:"name,omitempty"`
+	MatchType string   `json:"match_type,omitempty" xml:"match_type,omitempty" yaml:"match_type,omitempty"`
+	Values    []string `json:"values,omitempty" xml:"values,omitempty" yaml:"values,omitempty"`
+	uri       []*bypass.Config
+	regex     *regexp.Regexp
+	networks  []netip.Prefix
+}
+
+// Validate validates BypassRule.
+func (rule *BypassRule) Validate() error {
+	if len(rule.Conditions) == 0 {
+		return fmt.Errorf("bypass rule has no conditions")
+	}
+	for _, cond := range rule.Conditions {
+		if err := cond.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate validates BypassCondition.
+func (cond *BypassCondition) Validate() error {
+	if len(cond.Values) == 0 {
+		return fmt.Errorf("bypass %s condition has no value", cond.Type)
+	}
+	switch cond.Type {
+	case bypassConditionURI:
+		if len(cond.Values) != 1 {
+			return fmt.Errorf("bypass uri condition must have a single value")
+		}
+		bc := &bypass.Config{MatchType: cond.MatchType, URI: cond.Values[0]}
+		if err := bc.Validate(); err != nil {
+			return err
+		}
+		cond.uri = []*bypass.Config{bc}
+	case bypassConditionMethod:
+		for i, s := range cond.Values {
+			s = strings.ToUpper(s)
+			if !bypassMethodRegexPattern.MatchString(s) {
+				return fmt.Errorf("invalid %q bypass method", s)
+			}
+			cond.Values[i] = s
+		}
+	case bypassConditionHeader:
+		if cond.Name == "" {
+			return fmt.Errorf("undefined bypass header name")
+		}
+		if len(cond.Values) != 1 {
+			return fmt.Errorf("bypass header condition must have a single value")
+		}
+		switch cond.MatchType {
+		case "exact", "partial", "prefix", "suffix":
+		case "regex":
+			r, err := regexp.Compile(cond.Values[0])
+			if err != nil {
+				return err
+			}
+			cond.regex = r
+		case "":
+			return fmt.Errorf("undefined bypass match type")
+		default:
+			return fmt.Errorf("invalid %q bypass match type", cond.MatchType)
+		}
+	case bypassConditionSource:
+		cond.networks = nil
+		for _, s := range cond.Values {
+			network, err := parseBypassNetwork(s)
+			if err != nil {
+				return err
+			}
+			cond.networks = append(cond.networks, network)
+		}
+	case bypassConditionHost:
+		for i, s := range cond.Values {
+			s = strings.ToLower(s)
+			if s == "" || strings.Contains(strings.TrimPrefix(s, "*."), "*") {
+				return fmt.Errorf("invalid %q bypass host", s)
+			}
+			cond.Values[i] = s
+		}
+	case "":
+		return fmt.Errorf("undefined bypass condition type")
+	default:
+		return fmt.Errorf("invalid %q bypass condition type", cond.Type)
+	}
+	return nil
+}
+
+// parseBypassNetwork parses CIDR notation or a single IP address.
+func parseBypassNetwork(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		network, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid %q bypass source: %v", s, err)
+		}
+		return network.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid %q bypass source: %v", s, err)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Match returns true when the request matches all conditions of the rule.
+func (rule *BypassRule) Match(r *http.Request) bool {
+	for _, cond := range rule.Conditions {
+		if !cond.Match(r) {
+			return false
+		}
+	}
+	return len(rule.Conditions) > 0
+}
+
+// Match returns true when the request matches the condition.
+func (cond *BypassCondition) Match(r *http.Request) bool {
+	switch cond.Type {
+	case bypassConditionURI:
+		return bypass.Match(r, cond.uri)
+	case bypassConditionMethod:
+		for _, s := range cond.Values {
+			if r.Method == s {
+				return true
+			}
+		}
+	case bypassConditionHeader:
+		for _, v := range r.Header.Values(cond.Name) {
+			if cond.matchString(v) {
+				return true
+			}
+		}
+	case bypassConditionSource:
+		addr, ok := getBypassSourceAddress(r)
+		if !ok {
+			return false
+		}
+		for _, network := range cond.networks {
+			if network.Contains(addr) {
+				return true
+			}
+		}
+	case bypassConditionHost:
+		host := strings.ToLower(r.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		for _, s := range cond.Values {
+			if s == host {
+				return true
+			}
+			suffix, found := strings.CutPrefix(s, "*")
+			if !found {
+				continue
+			}
+			if label, found := strings.CutSuffix(host, suffix); found && label != "" && !strings.Contains(label, ".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (cond *BypassCondition) matchString(s string) bool {
+	v := cond.Values[0]
+	switch cond.MatchType {
+	case "exact":
+		return s == v
+	case "partial":
+		return strings.Contains(s, v)
+	case "prefix":
+		return strings.HasPrefix(s, v)
+	case "suffix":
+		return strings.HasSuffix(s, v)
+	case "regex":
+		return cond.regex.MatchString(s)
+	}
+	return false
+}
+
+// getBypassSourceAddress returns the client address of the request. The
+// address set by Caddy honors the trusted proxies of the server, so that
+// the spoofed X-Forwarded-For headers do not bypass the policy.
+func getBypassSourceAddress(r *http.Request) (netip.Addr, bool) {
+	s, _ := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string)
+	if s == "" {
+		s = r.RemoteAddr
+		if host, _, err := net.SplitHostPort(s); err == nil {
+			s = host
+		}
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
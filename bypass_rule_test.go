@@ -0,0 +1,168 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestBypassRuleMatch(t *testing.T) {
+	healthCheck := []*BypassCondition{
+		{Type: "uri", MatchType: "exact", Values: []string{"/health"}},
+		{Type: "method", Values: []string{"get", "head"}},
+		{Type: "source", Values: []string{"10.0.0.0/8", "192.168.1.1"}},
+	}
+
+	testcases := []struct {
+		name       string
+		conditions []*BypassCondition
+		method     string
+		url        string
+		headers    map[string]string
+		remoteAddr string
+		clientIP   string
+		want       bool
+	}{
+		{
+			name:       "test preflight request",
+			conditions: []*BypassCondition{{Type: "method", Values: []string{"OPTIONS"}}},
+			method:     "OPTIONS",
+			url:        "https://app.example.com/api/users",
+			want:       true,
+		},
+		{
+			name:       "test non-preflight request",
+			conditions: []*BypassCondition{{Type: "method", Values: []string{"OPTIONS"}}},
+			method:     "GET",
+			url:        "https://app.example.com/api/users",
+		},
+		{
+			name:       "test health check from internal network",
+			conditions: healthCheck,
+			method:     "GET",
+			url:        "https://app.example.com/health",
+			remoteAddr: "10.1.2.3:52000",
+			want:       true,
+		},
+		{
+			name:       "test health check from single address",
+			conditions: healthCheck,
+			method:     "HEAD",
+			url:        "https://app.example.com/health",
+			remoteAddr: "192.168.1.1:52000",
+			want:       true,
+		},
+		{
+			name:       "test health check from external network",
+			conditions: healthCheck,
+			method:     "GET",
+			url:        "https://app.example.com/health",
+			remoteAddr: "203.0.113.10:52000",
+		},
+		{
+			name:       "test health check with wrong method",
+			conditions: healthCheck,
+			method:     "POST",
+			url:        "https://app.example.com/health",
+			remoteAddr: "10.1.2.3:52000",
+		},
+		{
+			name:       "test health check with client address of trusted proxy",
+			conditions: healthCheck,
+			method:     "GET",
+			url:        "https://app.example.com/health",
+			remoteAddr: "10.1.2.3:52000",
+			clientIP:   "203.0.113.10",
+		},
+		{
+			name:       "test health check with spoofed forwarded header",
+			conditions: healthCheck,
+			method:     "GET",
+			url:        "https://app.example.com/health",
+			headers:    map[string]string{"X-Forwarded-For": "10.1.2.3"},
+			remoteAddr: "203.0.113.10:52000",
+		},
+		{
+			name: "test webhook with token header",
+			conditions: []*BypassCondition{
+				{Type: "uri", MatchType: "prefix", Values: []string{"/webhooks/"}},
+				{Type: "header", Name: "X-Webhook-Token", MatchType: "regex", Values: []string{"^[a-f0-9]{8}$"}},
+			},
+			method:  "POST",
+			url:     "https://app.example.com/webhooks/github",
+			headers: map[string]string{"X-Webhook-Token": "0123abcd"},
+			want:    true,
+		},
+		{
+			name: "test webhook without token header",
+			conditions: []*BypassCondition{
+				{Type: "uri", MatchType: "prefix", Values: []string{"/webhooks/"}},
+				{Type: "header", Name: "X-Webhook-Token", MatchType: "regex", Values: []string{"^[a-f0-9]{8}$"}},
+			},
+			method: "POST",
+			url:    "https://app.example.com/webhooks/github",
+		},
+		{
+			name:       "test wildcard host",
+			conditions: []*BypassCondition{{Type: "host", Values: []string{"*.internal.example.com"}}},
+			method:     "GET",
+			url:        "https://Status.Internal.Example.com:8443/",
+			want:       true,
+		},
+		{
+			name:       "test wildcard host with nested subdomain",
+			conditions: []*BypassCondition{{Type: "host", Values: []string{"*.internal.example.com"}}},
+			method:     "GET",
+			url:        "https://a.b.internal.example.com/",
+		},
+		{
+			name:       "test wildcard host without subdomain",
+			conditions: []*BypassCondition{{Type: "host", Values: []string{"*.internal.example.com"}}},
+			method:     "GET",
+			url:        "https://internal.example.com/",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			rule := &BypassRule{}
+			for _, cond := range tc.conditions {
+				c := *cond
+				c.Values = append([]string{}, cond.Values...)
+				rule.Conditions = append(rule.Conditions, &c)
+			}
+			if err := rule.Validate(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			r := httptest.NewRequest(tc.method, tc.url, nil)
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+			if tc.remoteAddr != "" {
+				r.RemoteAddr = tc.remoteAddr
+			}
+			if tc.clientIP != "" {
+				vars := map[string]any{caddyhttp.ClientIPVarKey: tc.clientIP}
+				r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, vars))
+			}
+			if got := rule.Match(r); got != tc.want {
+				t.Errorf("Match() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -36,6 +36,7 @@ func init() {
 // Syntax:
 //
 //	security {
+//		audit log ...
 //		secrets ...
 //		credentials ...
 //		identity store <name>
@@ -76,7 +77,7 @@ func parseCaddyfile(d *caddyfile.Dispenser, _ interface{}) (interface{}, error)
 				return nil, err
 			}
 		case "authorization":
-			if err := parseCaddyfileAuthorization(d, app.Config); err != nil {
+			if err := parseCaddyfileAuthorization(d, app); err != nil {
 				return nil, err
 			}
 		case "sso":
@@ -87,6 +88,10 @@ func parseCaddyfile(d *caddyfile.Dispenser, _ interface{}) (interface{}, error)
 			if err := parseCaddyfileSecrets(d, app); err != nil {
 				return nil, err
 			}
+		case "audit":
+			if err := parseCaddyfileAuditLog(d, app); err != nil {
+				return nil, err
+			}
 		default:
 			return nil, d.ArgErr()
 		}
@@ -72,6 +72,10 @@ func TestCaddyfileAdaptAuthenticationToJSON(t *testing.T) {
 			name:                "authorize plugin config with api",
 			inputFileNamePrefix: "testcase_authorize_with_api",
 		},
+		{
+			name:                "authorize and authenticate plugin config with route matchers",
+			inputFileNamePrefix: "testcase_authorize_with_route_matcher",
+		},
 		{
 			name:                "authenticate plugin config",
 			inputFileNamePrefix: "testcase_authenticate_ok",
@@ -118,6 +122,26 @@ func TestCaddyfileAdaptAuthenticationToJSON(t *testing.T) {
 			name:                "authenticate plugin config with registration",
 			inputFileNamePrefix: "testcase_authenticate_with_registration",
 		},
+		{
+			name:                "authenticate plugin config with host-based portal selectors",
+			inputFileNamePrefix: "testcase_authenticate_with_portal_selectors",
+		},
+		{
+			name:                "security app config with file secrets manager plugin",
+			inputFileNamePrefix: "testcase_security_with_file_secrets",
+		},
+		{
+			name:                "security app config with encrypted secrets manager plugin",
+			inputFileNamePrefix: "testcase_security_with_encrypted_secrets",
+		},
+		{
+			name:                "security app config with secrets resolution settings",
+			inputFileNamePrefix: "testcase_security_with_secrets_resolution",
+		},
+		{
+			name:                "security app config with audit log sink",
+			inputFileNamePrefix: "testcase_security_with_audit_log",
+		},
 		{
 			name:                "security app config with authentication portal with static secrets manager plugin",
 			inputFileNamePrefix: "testcase_security_with_secrets",
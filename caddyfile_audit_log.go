@@ -0,0 +1,105 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap/zapcore"
+)
+
+// parseCaddyfileAuditLog parses audit log configuration.
+//
+// Syntax:
+//
+//	audit log {
+//	  output <writer_module> ...
+//	  format <encoder_module> ...
+//	  level <level>
+//	}
+func parseCaddyfileAuditLog(d *caddyfile.Dispenser, app *App) error {
+	args := d.RemainingArgs()
+	if len(args) != 1 || args[0] != "log" {
+		return d.ArgErr()
+	}
+	if app.AuditLog != nil {
+		return d.Errf("duplicate audit log config")
+	}
+	cfg := &AuditLogConfig{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		k := d.Val()
+		switch k {
+		case "output":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			moduleName := d.Val()
+			var wo caddy.WriterOpener
+			switch moduleName {
+			case "stdout":
+				wo = caddy.StdoutWriter{}
+			case "stderr":
+				wo = caddy.StderrWriter{}
+			case "discard":
+				wo = caddy.DiscardWriter{}
+			default:
+				modID := "caddy.logging.writers." + moduleName
+				unm, err := caddyfile.UnmarshalModule(d, modID)
+				if err != nil {
+					return err
+				}
+				var ok bool
+				wo, ok = unm.(caddy.WriterOpener)
+				if !ok {
+					return d.Errf("module %s (%T) is not a WriterOpener", modID, unm)
+				}
+			}
+			cfg.WriterRaw = caddyconfig.JSONModuleObject(wo, "output", moduleName, nil)
+		case "format":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			moduleName := d.Val()
+			modID := "caddy.logging.encoders." + moduleName
+			unm, err := caddyfile.UnmarshalModule(d, modID)
+			if err != nil {
+				return err
+			}
+			enc, ok := unm.(zapcore.Encoder)
+			if !ok {
+				return d.Errf("module %s (%T) is not a zapcore.Encoder", modID, unm)
+			}
+			cfg.EncoderRaw = caddyconfig.JSONModuleObject(enc, "format", moduleName, nil)
+		case "level":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if _, err := zapcore.ParseLevel(strings.ToLower(d.Val())); err != nil {
+				return d.Errf("audit log level is malformed: %v", err)
+			}
+			cfg.Level = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unsupported audit log directive: %s", k)
+		}
+	}
+	app.AuditLog = cfg
+	return nil
+}
@@ -16,7 +16,6 @@ package security
 
 import (
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
-	"github.com/greenpau/go-authcrunch"
 	"github.com/greenpau/go-authcrunch/pkg/authz"
 	"github.com/greenpau/go-authcrunch/pkg/errors"
 )
@@ -41,8 +40,11 @@ const (
 //	   set
 //	   with
 //	   inject
+//	   strip
+//	   exchange
+//	   map
 //		}
-func parseCaddyfileAuthorization(d *caddyfile.Dispenser, cfg *authcrunch.Config) error {
+func parseCaddyfileAuthorization(d *caddyfile.Dispenser, app *App) error {
 	var rootDirective string
 	args := d.RemainingArgs()
 	if len(args) != 2 {
@@ -51,6 +53,7 @@ func parseCaddyfileAuthorization(d *caddyfile.Dispenser, cfg *authcrunch.Config)
 	switch args[0] {
 	case "policy":
 		p := &authz.PolicyConfig{Name: args[1]}
+		ext := &AuthorizationPolicyExtension{Name: args[1]}
 		for nesting := d.Nesting(); d.NextBlock(nesting); {
 			k := d.Val()
 			rootDirective = mkcp(authzPrefix, args[0], k)
@@ -72,25 +75,43 @@ func parseCaddyfileAuthorization(d *caddyfile.Dispenser, cfg *authcrunch.Config)
 				}
 			case "bypass":
 				v := d.RemainingArgs()
-				if err := parseCaddyfileAuthorizationBypass(d, p, rootDirective, v); err != nil {
+				if err := parseCaddyfileAuthorizationBypass(d, p, ext, rootDirective, v); err != nil {
 					return err
 				}
 			case "enable", "disable", "validate", "set", "with":
-				if err := parseCaddyfileAuthorizationMisc(d, p, rootDirective, k, d.RemainingArgs()); err != nil {
+				if err := parseCaddyfileAuthorizationMisc(d, p, ext, rootDirective, k, d.RemainingArgs()); err != nil {
 					return err
 				}
 			case "inject":
 				v := d.RemainingArgs()
-				if err := parseCaddyfileAuthorizationHeaderInjection(d, p, rootDirective, v); err != nil {
+				if err := parseCaddyfileAuthorizationHeaderInjection(d, p, ext, rootDirective, v); err != nil {
+					return err
+				}
+			case "strip":
+				v := d.RemainingArgs()
+				if err := parseCaddyfileAuthorizationHeaderStripping(d, ext, rootDirective, v); err != nil {
+					return err
+				}
+			case "exchange":
+				v := d.RemainingArgs()
+				if err := parseCaddyfileAuthorizationTokenExchange(d, ext, rootDirective, v); err != nil {
+					return err
+				}
+			case "map":
+				v := d.RemainingArgs()
+				if err := parseCaddyfileAuthorizationClaimMapping(d, ext, rootDirective, v); err != nil {
 					return err
 				}
 			default:
 				return errors.ErrMalformedDirective.WithArgs(rootDirective, d.RemainingArgs())
 			}
 		}
-		if err := cfg.AddAuthorizationPolicy(p); err != nil {
+		if err := app.Config.AddAuthorizationPolicy(p); err != nil {
 			return err
 		}
+		if !ext.IsEmpty() {
+			app.AuthorizationPolicyExtensions = append(app.AuthorizationPolicyExtensions, ext)
+		}
 	default:
 		return errors.ErrMalformedDirective.WithArgs(authzPrefix, args)
 	}
@@ -21,23 +21,86 @@ import (
 	cfgutil "github.com/greenpau/go-authcrunch/pkg/util/cfg"
 )
 
-func parseCaddyfileAuthorizationBypass(h *caddyfile.Dispenser, p *authz.PolicyConfig, rootDirective string, args []string) error {
+// parseCaddyfileAuthorizationBypass parses bypass directive.
+//
+// Syntax:
+//
+//	bypass uri <match_type> <uri>
+//	bypass method <method> [<method>...]
+//	bypass header <name> <match_type> <value>
+//	bypass source <cidr> [<cidr>...]
+//	bypass host <host> [<host>...]
+//	bypass {
+//	  <condition>
+//	  ...
+//	}
+//
+// The request matching all conditions of a block bypasses the policy.
+func parseCaddyfileAuthorizationBypass(h *caddyfile.Dispenser, p *authz.PolicyConfig, ext *AuthorizationPolicyExtension, rootDirective string, args []string) error {
 	if len(args) == 0 {
-		return h.Errf("%s directive has no value", rootDirective)
+		rule := &BypassRule{}
+		for nesting := h.Nesting(); h.NextBlock(nesting); {
+			v := append([]string{h.Val()}, h.RemainingArgs()...)
+			cond, err := parseCaddyfileAuthorizationBypassCondition(h, rootDirective, v)
+			if err != nil {
+				return err
+			}
+			rule.Conditions = append(rule.Conditions, cond)
+		}
+		if len(rule.Conditions) == 0 {
+			return h.Errf("%s directive has no value", rootDirective)
+		}
+		ext.BypassRules = append(ext.BypassRules, rule)
+		return nil
 	}
-	if len(args) != 3 {
-		return h.Errf("%s %s is invalid", rootDirective, cfgutil.EncodeArgs(args))
+	if args[0] == bypassConditionURI {
+		if len(args) != 3 {
+			return h.Errf("%s %s is invalid", rootDirective, cfgutil.EncodeArgs(args))
+		}
+		bc := &bypass.Config{
+			MatchType: args[1],
+			URI:       args[2],
+		}
+		if err := bc.Validate(); err != nil {
+			return h.Errf("%s %s erred: %v", rootDirective, cfgutil.EncodeArgs(args), err)
+		}
+		p.BypassConfigs = append(p.BypassConfigs, bc)
+		return nil
 	}
-	if args[0] != "uri" {
-		return h.Errf("%s %s is invalid", rootDirective, cfgutil.EncodeArgs(args))
+	cond, err := parseCaddyfileAuthorizationBypassCondition(h, rootDirective, args)
+	if err != nil {
+		return err
 	}
-	bc := &bypass.Config{
-		MatchType: args[1],
-		URI:       args[2],
+	ext.BypassRules = append(ext.BypassRules, &BypassRule{Conditions: []*BypassCondition{cond}})
+	return nil
+}
+
+func parseCaddyfileAuthorizationBypassCondition(h *caddyfile.Dispenser, rootDirective string, args []string) (*BypassCondition, error) {
+	cond := &BypassCondition{Type: args[0]}
+	switch args[0] {
+	case bypassConditionURI:
+		if len(args) != 3 {
+			return nil, h.Errf("%s %s is invalid", rootDirective, cfgutil.EncodeArgs(args))
+		}
+		cond.MatchType = args[1]
+		cond.Values = args[2:]
+	case bypassConditionHeader:
+		if len(args) != 4 {
+			return nil, h.Errf("%s %s is invalid", rootDirective, cfgutil.EncodeArgs(args))
+		}
+		cond.Name = args[1]
+		cond.MatchType = args[2]
+		cond.Values = args[3:]
+	case bypassConditionMethod, bypassConditionSource, bypassConditionHost:
+		if len(args) < 2 {
+			return nil, h.Errf("%s %s is invalid", rootDirective, cfgutil.EncodeArgs(args))
+		}
+		cond.Values = args[1:]
+	default:
+		return nil, h.Errf("%s %s is invalid", rootDirective, cfgutil.EncodeArgs(args))
 	}
-	if err := bc.Validate(); err != nil {
-		return h.Errf("%s %s erred: %v", rootDirective, cfgutil.EncodeArgs(args), err)
+	if err := cond.Validate(); err != nil {
+		return nil, h.Errf("%s %s erred: %v", rootDirective, cfgutil.EncodeArgs(args), err)
 	}
-	p.BypassConfigs = append(p.BypassConfigs, bc)
-	return nil
+	return cond, nil
 }
@@ -0,0 +1,81 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	cfgutil "github.com/greenpau/go-authcrunch/pkg/util/cfg"
+)
+
+// parseCaddyfileAuthorizationTokenExchange parses exchange directive.
+//
+// Syntax:
+//
+//	exchange token {
+//	  audience <audience>
+//	  scope <scope> [<scope>...]
+//	  key <kid>
+//	  lifetime <seconds>
+//	}
+//
+//	exchange token {
+//	  audience <audience>
+//	  scope <scope> [<scope>...]
+//	  endpoint <url>
+//	  client id <client_id>
+//	  client secret <client_secret>
+//	}
+func parseCaddyfileAuthorizationTokenExchange(h *caddyfile.Dispenser, ext *AuthorizationPolicyExtension, rootDirective string, args []string) error {
+	if cfgutil.EncodeArgs(args) != "token" {
+		return h.Errf("%s directive %q is invalid", rootDirective, cfgutil.EncodeArgs(args))
+	}
+	if ext.TokenExchange != nil {
+		return h.Errf("%s directive %q is duplicate", rootDirective, cfgutil.EncodeArgs(args))
+	}
+	e := &TokenExchange{}
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		k := h.Val()
+		v := h.RemainingArgs()
+		switch {
+		case k == "audience" && len(v) == 1:
+			e.Audience = v[0]
+		case k == "scope" && len(v) > 0:
+			e.Scopes = append(e.Scopes, v...)
+		case k == "key" && len(v) == 1:
+			e.KeyID = v[0]
+		case k == "lifetime" && len(v) == 1:
+			lifetime, err := strconv.Atoi(v[0])
+			if err != nil {
+				return h.Errf("%s %s erred: %v", rootDirective, k, err)
+			}
+			e.Lifetime = lifetime
+		case k == "endpoint" && len(v) == 1:
+			e.TokenEndpoint = v[0]
+		case k == "client" && len(v) == 2 && v[0] == "id":
+			e.ClientID = v[1]
+		case k == "client" && len(v) == 2 && v[0] == "secret":
+			e.ClientSecret = v[1]
+		default:
+			return h.Errf("%s directive %q has invalid syntax", rootDirective, k)
+		}
+	}
+	if err := e.Validate(); err != nil {
+		return h.Errf("%s %s erred: %v", rootDirective, cfgutil.EncodeArgs(args), err)
+	}
+	ext.TokenExchange = e
+	return nil
+}
@@ -15,23 +15,73 @@
 package security
 
 import (
+	"strconv"
+	"strings"
+
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/greenpau/go-authcrunch/pkg/authz"
 	"github.com/greenpau/go-authcrunch/pkg/authz/injector"
 	cfgutil "github.com/greenpau/go-authcrunch/pkg/util/cfg"
 )
 
-func parseCaddyfileAuthorizationHeaderInjection(h *caddyfile.Dispenser, p *authz.PolicyConfig, rootDirective string, args []string) error {
+// parseCaddyfileAuthorizationHeaderInjection parses inject directive.
+//
+// Syntax:
+//
+//	inject headers with claims
+//	inject header <name> from <field>
+//	inject header <name> template <template>
+//	inject signed assertion <name> key <kid> audience <audience> [lifetime <seconds>]
+func parseCaddyfileAuthorizationHeaderInjection(h *caddyfile.Dispenser, p *authz.PolicyConfig, ext *AuthorizationPolicyExtension, rootDirective string, args []string) error {
 	if len(args) == 0 {
 		return h.Errf("%s directive has no value", rootDirective)
 	}
 	switch {
 	case cfgutil.EncodeArgs(args) == "headers with claims":
 		p.PassClaimsWithHeaders = true
+	case len(args) > 1 && args[0] == "signed" && args[1] == "assertion":
+		if ext.SignedAssertion != nil {
+			return h.Errf("%s directive %q is duplicate", rootDirective, cfgutil.EncodeArgs(args))
+		}
+		if len(args)%2 != 1 || len(args) < 7 {
+			return h.Errf("%s directive %q is invalid", rootDirective, cfgutil.EncodeArgs(args))
+		}
+		a := &SignedAssertion{Header: args[2]}
+		for i := 3; i < len(args); i += 2 {
+			switch args[i] {
+			case "key":
+				a.KeyID = args[i+1]
+			case "audience":
+				a.Audience = args[i+1]
+			case "lifetime":
+				lifetime, err := strconv.Atoi(args[i+1])
+				if err != nil {
+					return h.Errf("%s %s erred: %v", rootDirective, cfgutil.EncodeArgs(args), err)
+				}
+				a.Lifetime = lifetime
+			default:
+				return h.Errf("%s directive %q has invalid syntax", rootDirective, cfgutil.EncodeArgs(args))
+			}
+		}
+		if err := a.Validate(); err != nil {
+			return h.Errf("%s %s erred: %v", rootDirective, cfgutil.EncodeArgs(args), err)
+		}
+		ext.SignedAssertion = a
 	case args[0] == "header":
 		if len(args) != 4 {
 			return h.Errf("%s directive %q is invalid", rootDirective, cfgutil.EncodeArgs(args))
 		}
+		if args[2] == "template" {
+			t := &HeaderTemplate{
+				Header:   args[1],
+				Template: args[3],
+			}
+			if err := t.Validate(); err != nil {
+				return h.Errf("%s %s erred: %v", rootDirective, cfgutil.EncodeArgs(args), err)
+			}
+			ext.HeaderTemplates = append(ext.HeaderTemplates, t)
+			return nil
+		}
 		if args[2] != "from" {
 			return h.Errf("%s directive %q has invalid syntax", rootDirective, cfgutil.EncodeArgs(args))
 		}
@@ -48,3 +98,25 @@ func parseCaddyfileAuthorizationHeaderInjection(h *caddyfile.Dispenser, p *authz
 	}
 	return nil
 }
+
+// parseCaddyfileAuthorizationHeaderStripping parses strip directive. The
+// headers the policy may inject are stripped regardless.
+//
+// Syntax:
+//
+//	strip header <name> [<name>...]
+func parseCaddyfileAuthorizationHeaderStripping(h *caddyfile.Dispenser, ext *AuthorizationPolicyExtension, rootDirective string, args []string) error {
+	if len(args) == 0 {
+		return h.Errf("%s directive has no value", rootDirective)
+	}
+	if args[0] != "header" || len(args) < 2 {
+		return h.Errf("%s directive %q has invalid syntax", rootDirective, cfgutil.EncodeArgs(args))
+	}
+	for _, k := range args[1:] {
+		if strings.TrimSpace(k) == "" {
+			return h.Errf("%s directive %q has empty header name", rootDirective, cfgutil.EncodeArgs(args))
+		}
+		ext.StripHeaders = append(ext.StripHeaders, k)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	cfgutil "github.com/greenpau/go-authcrunch/pkg/util/cfg"
+)
+
+// parseCaddyfileAuthorizationClaimMapping parses claim mapping directive.
+//
+// Syntax:
+//
+//	map claim <path> to user metadata <key>
+func parseCaddyfileAuthorizationClaimMapping(h *caddyfile.Dispenser, ext *AuthorizationPolicyExtension, rootDirective string, args []string) error {
+	if len(args) == 0 {
+		return h.Errf("%s directive has no value", rootDirective)
+	}
+	if len(args) != 6 || args[0] != "claim" || cfgutil.EncodeArgs(args[2:5]) != "to user metadata" {
+		return h.Errf("%s directive %q has invalid syntax", rootDirective, cfgutil.EncodeArgs(args))
+	}
+	mapping := &ClaimMapping{
+		Path: args[1],
+		Key:  args[5],
+	}
+	if err := mapping.Validate(); err != nil {
+		return h.Errf("%s %s erred: %v", rootDirective, cfgutil.EncodeArgs(args), err)
+	}
+	ext.ClaimMappings = append(ext.ClaimMappings, mapping)
+	return nil
+}
@@ -23,7 +23,7 @@ import (
 	cfgutil "github.com/greenpau/go-authcrunch/pkg/util/cfg"
 )
 
-func parseCaddyfileAuthorizationMisc(h *caddyfile.Dispenser, p *authz.PolicyConfig, rootDirective, k string, args []string) error {
+func parseCaddyfileAuthorizationMisc(h *caddyfile.Dispenser, p *authz.PolicyConfig, ext *AuthorizationPolicyExtension, rootDirective, k string, args []string) error {
 	v := strings.Join(args, " ")
 	v = strings.TrimSpace(v)
 	switch k {
@@ -108,6 +108,13 @@ func parseCaddyfileAuthorizationMisc(h *caddyfile.Dispenser, p *authz.PolicyConf
 			p.AuthRedirectStatusCode = n
 		case strings.HasPrefix(v, "user identity "):
 			p.UserIdentityField = strings.TrimPrefix(v, "user identity ")
+		case strings.HasPrefix(v, "mode "):
+			switch mode := strings.TrimPrefix(v, "mode "); mode {
+			case policyModeEnforce, policyModeAudit:
+				ext.Mode = mode
+			default:
+				return h.Errf("%s %s directive contains unsupported mode", rootDirective, v)
+			}
 		case v == "":
 			return h.Errf("%s directive has no value", rootDirective)
 		default:
@@ -487,6 +487,59 @@ func TestParseCaddyfileAuthorization(t *testing.T) {
 			shouldErr: true,
 			err:       fmt.Errorf("security.authorization.policy.inject %s erred: undefined field name, at %s:%d", "header X-Picture from \" \"", tf, 4),
 		},
+		{
+			name: "test authorization policy header template with unsupported filter",
+			d: caddyfile.NewTestDispenser(`
+            security {
+              authorization policy mypolicy {
+                inject header "X-User" template "{claims.email|gzip}"
+              }
+            }`),
+			shouldErr: true,
+			err: fmt.Errorf(
+				"security.authorization.policy.inject %s erred: %v, at %s:%d",
+				"header X-User template {claims.email|gzip}", `header "X-User" template is malformed: unsupported "gzip" filter`, tf, 4,
+			),
+		},
+		{
+			name: "test authorization policy strip without header name",
+			d: caddyfile.NewTestDispenser(`
+            security {
+              authorization policy mypolicy {
+                strip header
+              }
+            }`),
+			shouldErr: true,
+			err:       fmt.Errorf("security.authorization.policy.strip directive %q has invalid syntax, at %s:%d", "header", tf, 4),
+		},
+		{
+			name: "test authorization policy signed assertion without audience",
+			d: caddyfile.NewTestDispenser(`
+            security {
+              authorization policy mypolicy {
+                inject signed assertion X-Identity-Assertion key assertion lifetime 30
+              }
+            }`),
+			shouldErr: true,
+			err: fmt.Errorf(
+				"security.authorization.policy.inject %s erred: %v, at %s:%d",
+				"signed assertion X-Identity-Assertion key assertion lifetime 30", "signed assertion audience is empty", tf, 4,
+			),
+		},
+		{
+			name: "test authorization policy signed assertion with unsupported option",
+			d: caddyfile.NewTestDispenser(`
+            security {
+              authorization policy mypolicy {
+                inject signed assertion X-Identity-Assertion key assertion issuer foo
+              }
+            }`),
+			shouldErr: true,
+			err: fmt.Errorf(
+				"security.authorization.policy.inject directive %q has invalid syntax, at %s:%d",
+				"signed assertion X-Identity-Assertion key assertion issuer foo", tf, 4,
+			),
+		},
 		// Enable features.
 		{
 			name: "test authorization policy enable without args",
@@ -718,6 +771,51 @@ func TestParseCaddyfileAuthorization(t *testing.T) {
 				"uri bar baz", "invalid \"bar\" bypass match type", tf, 4,
 			),
 		},
+		{
+			name: "test authorization policy bypass with unsupported header args",
+			d: caddyfile.NewTestDispenser(`
+            security {
+              authorization policy mypolicy {
+                bypass header X-Webhook-Token exact
+              }
+            }`),
+			shouldErr: true,
+			err: fmt.Errorf(
+				"security.authorization.policy.bypass %s is invalid, at %s:%d",
+				"header X-Webhook-Token exact", tf, 4,
+			),
+		},
+		{
+			name: "test authorization policy bypass with invalid source",
+			d: caddyfile.NewTestDispenser(`
+            security {
+              authorization policy mypolicy {
+                bypass {
+                  method GET
+                  source 10.0.0.0/33
+                }
+              }
+            }`),
+			shouldErr: true,
+			err: fmt.Errorf(
+				"security.authorization.policy.bypass %s erred: %v, at %s:%d",
+				"source 10.0.0.0/33", `invalid "10.0.0.0/33" bypass source: netip.ParsePrefix("10.0.0.0/33"): prefix length out of range`, tf, 6,
+			),
+		},
+		{
+			name: "test authorization policy bypass with invalid method",
+			d: caddyfile.NewTestDispenser(`
+            security {
+              authorization policy mypolicy {
+                bypass method GET/1
+              }
+            }`),
+			shouldErr: true,
+			err: fmt.Errorf(
+				"security.authorization.policy.bypass %s erred: %v, at %s:%d",
+				"method GET/1", `invalid "GET/1" bypass method`, tf, 4,
+			),
+		},
 		// ACL errors.
 		{
 			name: "test authorization policy acl without args",
@@ -848,6 +946,341 @@ func TestParseCaddyfileAuthorization(t *testing.T) {
 				"roles foo method get to /foo bar", tf, 4,
 			),
 		},
+		{
+			name: "test valid authorization policy config with claim mappings",
+			d: caddyfile.NewTestDispenser(`
+            security {
+              authorization policy mypolicy {
+                crypto key verify 0e2fdcf8-6868-41a7-884b-7308795fc286
+                allow roles authp/admin authp/user
+                map claim tenant.id to user metadata tenant_id
+                map claim groups to user metadata groups
+                set mode audit
+              }
+            }`),
+			want: `{
+              "config": {
+                "authorization_policies": [
+                  {
+                    "name": "mypolicy",
+                    "auth_url_path": "/auth",
+                    "api_key_header_name": "X-Api-Key",
+                    "auth_realm_header_name": "X-Auth-Realm",
+                    "auth_redirect_query_param": "redirect_url",
+                    "auth_redirect_status_code": 302,
+                    "access_list_rules": [
+                      {
+                        "conditions": [
+                          "match roles authp/admin authp/user"
+                        ],
+                        "action": "allow log debug"
+                      }
+                    ],
+                    "raw_crypto_key_store_config": [
+                      "crypto key verify 0e2fdcf8-6868-41a7-884b-7308795fc286"
+                    ],
+                    "crypto_key_store_config": {
+                      "auto_generate_algo": "ES512",
+                      "auto_generate_tag": "default",
+                      "raw_key_configs": [
+                        "crypto key verify 0e2fdcf8-6868-41a7-884b-7308795fc286"
+                      ]
+                    }
+                  }
+                ]
+              },
+              "authorization_policy_extensions": [
+                {
+                  "name": "mypolicy",
+                  "mode": "audit",
+                  "claim_mappings": [
+                    {"path": "tenant.id", "key": "tenant_id"},
+                    {"path": "groups", "key": "groups"}
+                  ]
+                }
+              ]
+            }`,
+		},
+		{
+			name: "test valid authorization policy config with bypass rules",
+			d: caddyfile.NewTestDispenser(`
+            security {
+              authorization policy mypolicy {
+                crypto key verify 0e2fdcf8-6868-41a7-884b-7308795fc286
+                allow roles authp/admin
+                bypass uri exact /health
+                bypass method options
+                bypass header X-Webhook-Token regex ^[a-f0-9]{32}$
+                bypass {
+                  uri prefix /metrics
+                  source 10.0.0.0/8 192.168.1.1
+                  host *.internal.example.com
+                }
+              }
+            }`),
+			want: `{
+              "config": {
+                "authorization_policies": [
+                  {
+                    "name": "mypolicy",
+                    "auth_url_path": "/auth",
+                    "api_key_header_name": "X-Api-Key",
+                    "auth_realm_header_name": "X-Auth-Realm",
+                    "auth_redirect_query_param": "redirect_url",
+                    "auth_redirect_status_code": 302,
+                    "access_list_rules": [
+                      {
+                        "conditions": [
+                          "match roles authp/admin"
+                        ],
+                        "action": "allow log debug"
+                      }
+                    ],
+                    "bypass_configs": [
+                      {
+                        "match_type": "exact",
+                        "uri": "/health"
+                      }
+                    ],
+                    "raw_crypto_key_store_config": [
+                      "crypto key verify 0e2fdcf8-6868-41a7-884b-7308795fc286"
+                    ],
+                    "crypto_key_store_config": {
+                      "auto_generate_algo": "ES512",
+                      "auto_generate_tag": "default",
+                      "raw_key_configs": [
+                        "crypto key verify 0e2fdcf8-6868-41a7-884b-7308795fc286"
+                      ]
+                    }
+                  }
+                ]
+              },
+              "authorization_policy_extensions": [
+                {
+                  "name": "mypolicy",
+                  "bypass_rules": [
+                    {
+                      "conditions": [
+                        {"type": "method", "values": ["OPTIONS"]}
+                      ]
+                    },
+                    {
+                      "conditions": [
+                        {"type": "header", "name": "X-Webhook-Token", "match_type": "regex", "values": ["^[a-f0-9]{32}$"]}
+                      ]
+                    },
+                    {
+                      "conditions": [
+                        {"type": "uri", "match_type": "prefix", "values": ["/metrics"]},
+                        {"type": "source", "values": ["10.0.0.0/8", "192.168.1.1"]},
+                        {"type": "host", "values": ["*.internal.example.com"]}
+                      ]
+                    }
+                  ]
+                }
+              ]
+            }`,
+		},
+		{
+			name: "test valid authorization policy config with header templates, stripping, and signed assertion",
+			d: caddyfile.NewTestDispenser(`
+            security {
+              authorization policy mypolicy {
+                crypto key verify 0e2fdcf8-6868-41a7-884b-7308795fc286
+                allow roles authp/admin
+                inject header "X-User" template "{claims.email}|{claims.realm}"
+                inject header "X-User-Claims" template "{claims.email,roles|json|base64url}"
+                strip header X-Forwarded-User X-Remote-User
+                inject signed assertion X-Identity-Assertion key assertion audience orders.internal lifetime 30
+              }
+            }`),
+			want: `{
+              "config": {
+                "authorization_policies": [
+                  {
+                    "name": "mypolicy",
+                    "auth_url_path": "/auth",
+                    "api_key_header_name": "X-Api-Key",
+                    "auth_realm_header_name": "X-Auth-Realm",
+                    "auth_redirect_query_param": "redirect_url",
+                    "auth_redirect_status_code": 302,
+                    "access_list_rules": [
+                      {
+                        "conditions": [
+                          "match roles authp/admin"
+                        ],
+                        "action": "allow log debug"
+                      }
+                    ],
+                    "raw_crypto_key_store_config": [
+                      "crypto key verify 0e2fdcf8-6868-41a7-884b-7308795fc286"
+                    ],
+                    "crypto_key_store_config": {
+                      "auto_generate_algo": "ES512",
+                      "auto_generate_tag": "default",
+                      "raw_key_configs": [
+                        "crypto key verify 0e2fdcf8-6868-41a7-884b-7308795fc286"
+                      ]
+                    }
+                  }
+                ]
+              },
+              "authorization_policy_extensions": [
+                {
+                  "name": "mypolicy",
+                  "header_templates": [
+                    {"header": "X-User", "template": "{claims.email}|{claims.realm}"},
+                    {"header": "X-User-Claims", "template": "{claims.email,roles|json|base64url}"}
+                  ],
+                  "strip_headers": ["X-Forwarded-User", "X-Remote-User"],
+                  "signed_assertion": {
+                    "header": "X-Identity-Assertion",
+                    "key_id": "assertion",
+                    "audience": "orders.internal",
+                    "lifetime": 30
+                  }
+                }
+              ]
+            }`,
+		},
+		{
+			name: "test valid authorization policy config with token exchange",
+			d: caddyfile.NewTestDispenser(`
+            security {
+              authorization policy mypolicy {
+                crypto key verify 0e2fdcf8-6868-41a7-884b-7308795fc286
+                allow roles authp/admin
+                exchange token {
+                  audience orders.internal
+                  scope orders:read orders:write
+                  endpoint https://idp.example.com/oauth2/token
+                  client id caddy
+                  client secret {env.TOKEN_EXCHANGE_SECRET}
+                }
+              }
+            }`),
+			want: `{
+              "config": {
+                "authorization_policies": [
+                  {
+                    "name": "mypolicy",
+                    "auth_url_path": "/auth",
+                    "api_key_header_name": "X-Api-Key",
+                    "auth_realm_header_name": "X-Auth-Realm",
+                    "auth_redirect_query_param": "redirect_url",
+                    "auth_redirect_status_code": 302,
+                    "access_list_rules": [
+                      {
+                        "conditions": [
+                          "match roles authp/admin"
+                        ],
+                        "action": "allow log debug"
+                      }
+                    ],
+                    "raw_crypto_key_store_config": [
+                      "crypto key verify 0e2fdcf8-6868-41a7-884b-7308795fc286"
+                    ],
+                    "crypto_key_store_config": {
+                      "auto_generate_algo": "ES512",
+                      "auto_generate_tag": "default",
+                      "raw_key_configs": [
+                        "crypto key verify 0e2fdcf8-6868-41a7-884b-7308795fc286"
+                      ]
+                    }
+                  }
+                ]
+              },
+              "authorization_policy_extensions": [
+                {
+                  "name": "mypolicy",
+                  "token_exchange": {
+                    "audience": "orders.internal",
+                    "scopes": ["orders:read", "orders:write"],
+                    "token_endpoint": "https://idp.example.com/oauth2/token",
+                    "client_id": "caddy",
+                    "client_secret": "{env.TOKEN_EXCHANGE_SECRET}"
+                  }
+                }
+              ]
+            }`,
+		},
+		{
+			name: "test authorization policy with token exchange having key and endpoint",
+			d: caddyfile.NewTestDispenser(`
+            security {
+              authorization policy mypolicy {
+                exchange token {
+                  audience orders.internal
+                  key exchange
+                  endpoint https://idp.example.com/oauth2/token
+                }
+              }
+            }`),
+			shouldErr: true,
+			err: fmt.Errorf(
+				"security.authorization.policy.exchange token erred: %v, at %s:%d",
+				"token exchange must have either key or token endpoint, not both", tf, 8,
+			),
+		},
+		{
+			name: "test authorization policy with malformed token exchange",
+			d: caddyfile.NewTestDispenser(`
+            security {
+              authorization policy mypolicy {
+                exchange token {
+                  audience orders.internal
+                  client foo bar
+                }
+              }
+            }`),
+			shouldErr: true,
+			err: fmt.Errorf(
+				"security.authorization.policy.exchange directive %q has invalid syntax, at %s:%d",
+				"client", tf, 6,
+			),
+		},
+		{
+			name: "test authorization policy with malformed claim mapping",
+			d: caddyfile.NewTestDispenser(`
+            security {
+              authorization policy mypolicy {
+                map claim tenant.id to metadata tenant_id
+              }
+            }`),
+			shouldErr: true,
+			err: fmt.Errorf(
+				"security.authorization.policy.map directive %q has invalid syntax, at %s:%d",
+				"claim tenant.id to metadata tenant_id", tf, 4,
+			),
+		},
+		{
+			name: "test authorization policy with malformed claim path",
+			d: caddyfile.NewTestDispenser(`
+            security {
+              authorization policy mypolicy {
+                map claim tenant..id to user metadata tenant_id
+              }
+            }`),
+			shouldErr: true,
+			err: fmt.Errorf(
+				"security.authorization.policy.map claim tenant..id to user metadata tenant_id erred: %v, at %s:%d",
+				`claim path "tenant..id" is malformed`, tf, 4,
+			),
+		},
+		{
+			name: "test authorization policy with unsupported mode",
+			d: caddyfile.NewTestDispenser(`
+            security {
+              authorization policy mypolicy {
+                set mode dryrun
+              }
+            }`),
+			shouldErr: true,
+			err: fmt.Errorf(
+				"security.authorization.policy.set mode dryrun directive contains unsupported mode, at %s:%d",
+				tf, 4,
+			),
+		},
 		// Post config processing errors.
 		{
 			name: "test authorization invalid keyword",
@@ -0,0 +1,439 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+const (
+	lintError   = "error"
+	lintWarning = "warning"
+
+	lintPortal           = "authentication portal"
+	lintPolicy           = "authorization policy"
+	lintIdentityStore    = "identity store"
+	lintIdentityProvider = "identity provider"
+	lintSingleSignOn     = "sso provider"
+	lintCredentials      = "credentials"
+	lintMessaging        = "messaging provider"
+)
+
+// lintFinding is a problem found in a Caddyfile.
+type lintFinding struct {
+	File     string
+	Line     int
+	Severity string
+	Message  string
+}
+
+// String returns the finding in "file:line: severity: message" form.
+func (f *lintFinding) String() string {
+	return fmt.Sprintf("%s:%d: %s: %s", f.File, f.Line, f.Severity, f.Message)
+}
+
+// lintNode is a directive with its block.
+type lintNode struct {
+	tokens   []caddyfile.Token
+	children []*lintNode
+}
+
+func (n *lintNode) args() []string {
+	args := []string{}
+	for _, t := range n.tokens {
+		args = append(args, t.Text)
+	}
+	return args
+}
+
+// newLintNodes arranges the tokens of a segment in a tree. The directive
+// ends at the end of the line, and its block is between the braces.
+func newLintNodes(tokens []caddyfile.Token) []*lintNode {
+	root := &lintNode{}
+	stack := []*lintNode{root}
+	var cur *lintNode
+	var curFile string
+	var curLine int
+	for _, t := range tokens {
+		parent := stack[len(stack)-1]
+		switch {
+		case t.Text == "{" && !t.Quoted():
+			if cur == nil {
+				cur = &lintNode{}
+				parent.children = append(parent.children, cur)
+			}
+			stack = append(stack, cur)
+			cur = nil
+		case t.Text == "}" && !t.Quoted():
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+			cur = nil
+		default:
+			if cur == nil || t.File != curFile || t.Line != curLine {
+				cur = &lintNode{}
+				parent.children = append(parent.children, cur)
+			}
+			cur.tokens = append(cur.tokens, t)
+			curFile, curLine = t.File, t.Line+t.NumLineBreaks()
+		}
+	}
+	return root.children
+}
+
+// lintReference is a reference to a named entry, e.g. identity store.
+type lintReference struct {
+	kind  string
+	name  string
+	owner string
+	node  *lintNode
+}
+
+// caddyfileLinter checks the cross-references in the Caddyfile.
+type caddyfileLinter struct {
+	findings    []*lintFinding
+	definitions map[string]map[string]*lintNode
+	references  []*lintReference
+	// dynamic holds the kinds referenced via placeholders. The entries of
+	// these kinds are not reported as unused.
+	dynamic map[string]bool
+	// signKeys holds the key material of the portals. verifyKeys holds the
+	// key material of the policies.
+	signKeys   map[string]bool
+	verifyKeys map[string]map[string]bool
+}
+
+// lintCaddyfile adapts the Caddyfile and reports the dangling references
+// and suspicious settings. The error is returned when the Caddyfile does
+// not adapt.
+func lintCaddyfile(filename string, body []byte) ([]*lintFinding, error) {
+	l := &caddyfileLinter{
+		definitions: make(map[string]map[string]*lintNode),
+		dynamic:     make(map[string]bool),
+		signKeys:    make(map[string]bool),
+		verifyKeys:  make(map[string]map[string]bool),
+	}
+
+	adapter := caddyconfig.GetAdapter("caddyfile")
+	if adapter == nil {
+		return nil, fmt.Errorf("caddyfile adapter is not registered")
+	}
+	_, warnings, err := adapter.Adapt(body, map[string]interface{}{"filename": filename})
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range warnings {
+		l.findings = append(l.findings, &lintFinding{File: w.File, Line: w.Line, Severity: lintWarning, Message: w.Message})
+	}
+
+	serverBlocks, err := caddyfile.Parse(filename, body)
+	if err != nil {
+		return nil, err
+	}
+	for _, sb := range serverBlocks {
+		for _, segment := range sb.Segments {
+			nodes := newLintNodes(segment)
+			if len(sb.Keys) == 0 {
+				for _, n := range nodes {
+					if args := n.args(); len(args) > 0 && args[0] == "security" {
+						l.lintSecurity(n)
+					}
+				}
+				continue
+			}
+			l.lintHandlers(nodes)
+		}
+	}
+
+	l.lintReferences()
+	l.lintUnused()
+
+	sort.SliceStable(l.findings, func(i, j int) bool {
+		if l.findings[i].File != l.findings[j].File {
+			return l.findings[i].File < l.findings[j].File
+		}
+		return l.findings[i].Line < l.findings[j].Line
+	})
+	return l.findings, nil
+}
+
+func (l *caddyfileLinter) report(n *lintNode, severity, format string, args ...interface{}) {
+	f := &lintFinding{Severity: severity, Message: fmt.Sprintf(format, args...)}
+	if len(n.tokens) > 0 {
+		f.File, f.Line = n.tokens[0].File, n.tokens[0].Line
+	}
+	l.findings = append(l.findings, f)
+}
+
+func (l *caddyfileLinter) define(kind, name string, n *lintNode) {
+	if _, exists := l.definitions[kind]; !exists {
+		l.definitions[kind] = make(map[string]*lintNode)
+	}
+	if prev, exists := l.definitions[kind][name]; exists {
+		l.report(n, lintError, "duplicate %s %q, first defined at %s:%d", kind, name, prev.tokens[0].File, prev.tokens[0].Line)
+		return
+	}
+	l.definitions[kind][name] = n
+}
+
+func (l *caddyfileLinter) refer(kind, name, owner string, n *lintNode) {
+	if strings.Contains(name, "{") {
+		l.dynamic[kind] = true
+		return
+	}
+	l.references = append(l.references, &lintReference{kind: kind, name: name, owner: owner, node: n})
+}
+
+// lintSecurity collects the entries of the security app and their
+// references.
+func (l *caddyfileLinter) lintSecurity(security *lintNode) {
+	for _, n := range security.children {
+		args := n.args()
+		switch {
+		case len(args) == 0:
+		case args[0] == "credentials" && len(args) == 2:
+			l.define(lintCredentials, args[1], n)
+		case args[0] == "messaging" && len(args) == 4 && args[2] == "provider":
+			owner := fmt.Sprintf("%s %s provider %q", args[0], args[1], args[3])
+			l.define(lintMessaging, args[3], n)
+			for _, c := range n.children {
+				if cargs := c.args(); len(cargs) == 2 && cargs[0] == "credentials" {
+					l.refer(lintCredentials, cargs[1], owner, c)
+				}
+			}
+		case len(args) >= 4 && args[1] == "identity" && args[2] == "store":
+			l.define(lintIdentityStore, args[3], n)
+		case len(args) >= 4 && args[1] == "identity" && args[2] == "provider":
+			l.define(lintIdentityProvider, args[3], n)
+		case args[0] == "sso" && len(args) == 3 && args[1] == "provider":
+			l.define(lintSingleSignOn, args[2], n)
+		case args[0] == "user" && len(args) == 3 && args[1] == "registration":
+			owner := fmt.Sprintf("user registration %q", args[2])
+			for _, c := range n.children {
+				cargs := c.args()
+				switch {
+				case len(cargs) == 3 && cargs[0] == "email" && cargs[1] == "provider":
+					l.refer(lintMessaging, cargs[2], owner, c)
+				case len(cargs) == 3 && cargs[0] == "identity" && cargs[1] == "store":
+					l.refer(lintIdentityStore, cargs[2], owner, c)
+				}
+			}
+		case args[0] == "authentication" && len(args) == 3 && args[1] == "portal":
+			l.define(lintPortal, args[2], n)
+			l.lintPortal(args[2], n)
+		case args[0] == "authorization" && len(args) == 3 && args[1] == "policy":
+			l.define(lintPolicy, args[2], n)
+			l.verifyKeys[args[2]] = getLintKeyMaterial(n, "sign")
+		}
+	}
+}
+
+func (l *caddyfileLinter) lintPortal(name string, portal *lintNode) {
+	owner := fmt.Sprintf("%s %q", lintPortal, name)
+	var sources int
+	for _, c := range portal.children {
+		args := c.args()
+		if len(args) < 4 || args[0] != "enable" {
+			continue
+		}
+		var kind string
+		switch {
+		case args[1] == "identity" && args[2] == "store":
+			kind = lintIdentityStore
+			sources++
+		case args[1] == "identity" && args[2] == "provider":
+			kind = lintIdentityProvider
+			sources++
+		case args[1] == "sso" && args[2] == "provider":
+			kind = lintSingleSignOn
+		default:
+			continue
+		}
+		for _, s := range args[3:] {
+			l.refer(kind, s, owner, c)
+		}
+	}
+	if sources == 0 {
+		l.report(portal, lintWarning, "%s enables no identity stores or identity providers", owner)
+	}
+	for k := range getLintKeyMaterial(portal, "verify") {
+		l.signKeys[k] = true
+	}
+}
+
+// lintHandlers collects the references of the authenticate and authorize
+// directives in the site blocks.
+func (l *caddyfileLinter) lintHandlers(nodes []*lintNode) {
+	for _, n := range nodes {
+		args := n.args()
+		switch {
+		case len(args) == 0:
+		case args[0] == "authenticate" && args[len(args)-1] == "with":
+			for _, c := range n.children {
+				cargs := c.args()
+				switch {
+				case len(cargs) == 4 && cargs[0] == "host" && cargs[2] == "portal":
+					l.refer(lintPortal, cargs[3], "authenticate directive", c)
+				case len(cargs) == 3 && cargs[0] == "default" && cargs[1] == "portal":
+					l.refer(lintPortal, cargs[2], "authenticate directive", c)
+				}
+			}
+		case args[0] == "authenticate" && len(args) > 2 && args[len(args)-2] == "with":
+			l.refer(lintPortal, args[len(args)-1], "authenticate directive", n)
+		case args[0] == "authorize" && len(args) > 2 && args[len(args)-2] == "with":
+			l.refer(lintPolicy, args[len(args)-1], "authorize directive", n)
+		default:
+			l.lintHandlers(n.children)
+		}
+	}
+}
+
+func (l *caddyfileLinter) lintReferences() {
+	for _, ref := range l.references {
+		if _, exists := l.definitions[ref.kind][ref.name]; !exists {
+			l.report(ref.node, lintError, "%s references undefined %s %q", ref.owner, ref.kind, ref.name)
+		}
+	}
+
+	if len(l.definitions[lintPortal]) == 0 {
+		return
+	}
+	for name, keys := range l.verifyKeys {
+		var matched bool
+		for k := range keys {
+			if l.signKeys[k] {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			l.report(l.definitions[lintPolicy][name], lintWarning, "%s %q has no crypto key matching the keys of any authentication portal", lintPolicy, name)
+		}
+	}
+}
+
+func (l *caddyfileLinter) lintUnused() {
+	used := make(map[string]map[string]bool)
+	for _, ref := range l.references {
+		if _, exists := used[ref.kind]; !exists {
+			used[ref.kind] = make(map[string]bool)
+		}
+		used[ref.kind][ref.name] = true
+	}
+	for _, kind := range []string{lintPortal, lintPolicy, lintIdentityStore, lintIdentityProvider, lintSingleSignOn, lintCredentials} {
+		if l.dynamic[kind] {
+			continue
+		}
+		for name, n := range l.definitions[kind] {
+			if !used[kind][name] {
+				l.report(n, lintWarning, "%s %q is not used", kind, name)
+			}
+		}
+	}
+}
+
+// getLintKeyMaterial returns the key material of the "crypto key"
+// directives, skipping the keys with the excluded usage. The keys
+// read from the PEM files are compared by the public key, so that the
+// private key of a portal matches the public key of a policy. Without
+// the keys, the key is auto-generated and shared by the portals and
+// the policies.
+func getLintKeyMaterial(n *lintNode, excludedUsage string) map[string]bool {
+	keys := make(map[string]bool)
+	var configured bool
+	for _, c := range n.children {
+		args := c.args()
+		if len(args) < 4 || args[0] != "crypto" || args[1] != "key" {
+			continue
+		}
+		for i, arg := range args[2:] {
+			i += 2
+			switch arg {
+			case "sign", "verify", "sign-verify", "auto", "system":
+			default:
+				continue
+			}
+			configured = true
+			if arg == excludedUsage || i+1 >= len(args) {
+				break
+			}
+			material := args[i+1]
+			if material == "from" && i+3 < len(args) {
+				material = strings.Join(args[i+1:i+4], " ")
+				if args[i+2] == "file" {
+					if fingerprint, err := getPublicKeyFingerprint(args[i+3]); err == nil {
+						material = fingerprint
+					}
+				}
+			}
+			keys[material] = true
+			break
+		}
+	}
+	if !configured {
+		keys["auto"] = true
+	}
+	return keys
+}
+
+// getPublicKeyFingerprint returns the SHA256 of the public key in the PEM
+// file. The file holds either private or public key.
+func getPublicKeyFingerprint(fp string) (string, error) {
+	b, err := os.ReadFile(fp)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return "", fmt.Errorf("%q has no PEM data", fp)
+	}
+	var pub interface{}
+	if k, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		pub = k
+	} else if k, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		pub = k
+	} else {
+		var priv interface{}
+		if priv, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+			if priv, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+				if priv, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+					return "", fmt.Errorf("%q has unsupported key", fp)
+				}
+			}
+		}
+		signer, ok := priv.(crypto.Signer)
+		if !ok {
+			return "", fmt.Errorf("%q has unsupported key", fp)
+		}
+		pub = signer.Public()
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,280 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLintCaddyfile(t *testing.T) {
+	dir := t.TempDir()
+	writeTestKeyPair(t, dir)
+
+	testcases := []struct {
+		name      string
+		config    string
+		want      []string
+		shouldErr bool
+		err       string
+	}{
+		{
+			name: "test valid config",
+			config: `{
+	security {
+		local identity store localdb {
+			realm local
+			path /etc/caddy/users.json
+		}
+
+		authentication portal myportal {
+			crypto key sign-verify {env.JWT_SHARED_KEY}
+			enable identity store localdb
+		}
+
+		authorization policy mypolicy {
+			crypto key verify {env.JWT_SHARED_KEY}
+			allow roles authp/admin
+		}
+	}
+}
+
+auth.example.com {
+	route {
+		authenticate with myportal
+	}
+}
+
+app.example.com {
+	route {
+		authorize with mypolicy
+		respond "ok"
+	}
+}
+`,
+			want: []string{},
+		},
+		{
+			name: "test dangling references",
+			config: `{
+	security {
+		credentials smtp.contoso.com {
+			username foo
+			password bar
+		}
+
+		messaging email provider localhost-smtp-server {
+			address 127.0.0.1:1025
+			protocol smtp
+			credentials root@localhost
+			sender root@localhost "My Auth Portal"
+		}
+
+		local identity store localdb {
+			realm local
+			path /etc/caddy/users.json
+		}
+
+		authentication portal myportal {
+			enable identity store localdb foo
+		}
+
+		authorization policy mypolicy {
+			allow roles authp/admin
+		}
+	}
+}
+
+auth.example.com {
+	route {
+		authenticate with otherportal
+	}
+}
+
+app.example.com {
+	route {
+		authorize with mypolicy
+		respond "ok"
+	}
+}
+`,
+			want: []string{
+				`Caddyfile:3: warning: credentials "smtp.contoso.com" is not used`,
+				`Caddyfile:11: error: messaging email provider "localhost-smtp-server" references undefined credentials "root@localhost"`,
+				`Caddyfile:20: warning: authentication portal "myportal" is not used`,
+				`Caddyfile:21: error: authentication portal "myportal" references undefined identity store "foo"`,
+				`Caddyfile:32: error: authenticate directive references undefined authentication portal "otherportal"`,
+			},
+		},
+		{
+			name: "test mismatched crypto keys",
+			config: `{
+	security {
+		local identity store localdb {
+			realm local
+			path /etc/caddy/users.json
+		}
+
+		authentication portal myportal {
+			crypto key sign-verify foo
+			enable identity store localdb
+		}
+
+		authorization policy mypolicy {
+			crypto key verify bar
+			allow roles authp/admin
+		}
+	}
+}
+
+app.example.com {
+	route {
+		authenticate with {
+			host auth.example.com portal myportal
+			default portal otherportal
+		}
+		authorize with mypolicy
+		respond "ok"
+	}
+}
+`,
+			want: []string{
+				`Caddyfile:13: warning: authorization policy "mypolicy" has no crypto key matching the keys of any authentication portal`,
+				`Caddyfile:24: error: authenticate directive references undefined authentication portal "otherportal"`,
+			},
+		},
+		{
+			name: "test crypto keys from pem files",
+			config: `{
+	security {
+		local identity store localdb {
+			realm local
+			path /etc/caddy/users.json
+		}
+
+		authentication portal myportal {
+			crypto key sign-verify from file {dir}/private.pem
+			enable identity store localdb
+		}
+
+		authorization policy mypolicy {
+			crypto key verify from file {dir}/public.pem
+			allow roles authp/admin
+		}
+	}
+}
+
+app.example.com {
+	route {
+		authenticate with {http.request.host.labels.2}
+		authorize with mypolicy
+		respond "ok"
+	}
+}
+`,
+			want: []string{},
+		},
+		{
+			name: "test duplicate identity store",
+			config: `{
+	security {
+		local identity store localdb {
+			realm local
+			path /etc/caddy/users.json
+		}
+
+		local identity store localdb {
+			realm local
+			path /etc/caddy/users.json
+		}
+	}
+}
+`,
+			want: []string{
+				`Caddyfile:3: warning: identity store "localdb" is not used`,
+				`Caddyfile:8: error: duplicate identity store "localdb", first defined at Caddyfile:3`,
+			},
+		},
+		{
+			name: "test malformed config",
+			config: `{
+	security {
+		authentication portal
+	}
+}
+`,
+			shouldErr: true,
+			err:       "parsing caddyfile tokens for 'security': wrong argument count or unexpected line ending after 'portal', at Caddyfile:3",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := strings.ReplaceAll(tc.config, "{dir}", dir)
+			findings, err := lintCaddyfile("Caddyfile", []byte(config))
+			if err != nil {
+				if !tc.shouldErr {
+					t.Fatalf("expected success, got: %v", err)
+				}
+				if diff := cmp.Diff(tc.err, err.Error()); diff != "" {
+					t.Fatalf("unexpected error mismatch (-want +got):\n%s", diff)
+				}
+				return
+			}
+			if tc.shouldErr {
+				t.Fatalf("unexpected success, want: %v", tc.err)
+			}
+			got := []string{}
+			for _, f := range findings {
+				got = append(got, f.String())
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("lintCaddyfile() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func writeTestKeyPair(t *testing.T, dir string) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDer, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for fp, block := range map[string]*pem.Block{
+		"private.pem": {Type: "EC PRIVATE KEY", Bytes: privDer},
+		"public.pem":  {Type: "PUBLIC KEY", Bytes: pubDer},
+	} {
+		if err := os.WriteFile(filepath.Join(dir, fp), pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -16,23 +16,56 @@ package security
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/greenpau/caddy-security/pkg/util"
 	"github.com/greenpau/go-authcrunch"
 	cfgutil "github.com/greenpau/go-authcrunch/pkg/util/cfg"
+	"github.com/tidwall/gjson"
 	"go.uber.org/zap"
 )
 
-func replaceSecretValue(ctx context.Context, secretManagers []SecretsManager, secretPath string) (string, bool, error) {
-	if !hasSecretKey(secretPath) {
-		return "", false, fmt.Errorf("path has no secrets")
+// secretReference is the reference to a secret value, i.e.
+// "secrets:<id>:<key>" or "secrets:<id>:<key>#<json.path>". The JSON path
+// selects a field of a structured secret, e.g. "client_secret" or
+// "users.0.email".
+type secretReference struct {
+	ID       string
+	Key      string
+	Selector string
+}
+
+func parseSecretReference(s string) (*secretReference, bool) {
+	if strings.HasPrefix(s, "\"") && strings.HasSuffix(s, "\"") {
+		s = strings.Trim(s, "\"")
+	}
+	s, found := strings.CutPrefix(s, "secrets:")
+	if !found {
+		return nil, false
+	}
+	id, s, found := strings.Cut(s, ":")
+	if !found || id == "" {
+		return nil, false
+	}
+	key, selector, found := strings.Cut(s, "#")
+	if key == "" || strings.Contains(key, ":") || (found && selector == "") {
+		return nil, false
+	}
+	return &secretReference{ID: id, Key: key, Selector: selector}, true
+}
+
+// getSecretValue returns the value referenced by the secret path. The value
+// may be structured, e.g. a list or a map.
+func getSecretValue(ctx context.Context, secretManagers []SecretsManager, secretPath string) (interface{}, error) {
+	ref, ok := parseSecretReference(secretPath)
+	if !ok {
+		return nil, fmt.Errorf("path has no secrets")
 	}
-	parts := strings.Split(secretPath, ":")
-	secretsManagerID := parts[1]
-	secretKey := parts[2]
 	for _, secretManager := range secretManagers {
 		cfg := secretManager.GetConfig(ctx)
 		if cfg == nil {
@@ -45,31 +78,93 @@ func replaceSecretValue(ctx context.Context, secretManagers []SecretsManager, se
 		if identifier == "" {
 			continue
 		}
-		if identifier != secretsManagerID {
+		if identifier != ref.ID {
 			continue
 		}
-		secretValueRaw, err := secretManager.GetSecretByKey(ctx, secretKey)
+		secretValue, err := secretManager.GetSecretByKey(ctx, ref.Key)
 		if err != nil {
-			return secretPath, false, err
+			return nil, err
 		}
-		secretValue, ok := secretValueRaw.(string)
-		if !ok {
-			return secretPath, false, fmt.Errorf("secret value is not a string")
+		if ref.Selector == "" {
+			return secretValue, nil
 		}
-		return secretValue, true, nil
+		return selectSecretValue(secretValue, ref.Selector)
 	}
-	return secretPath, false, fmt.Errorf("secret key value was not replaced")
+	return nil, fmt.Errorf("secret key value was not replaced")
 }
 
-func hasSecretKey(s string) bool {
+// selectSecretValue returns the field of a structured secret at the JSON
+// path. The secret is either a decoded JSON document, e.g. a map, or
+// a string holding a JSON document.
+func selectSecretValue(data interface{}, selector string) (interface{}, error) {
+	var doc string
+	switch v := data.(type) {
+	case string:
+		if !gjson.Valid(v) {
+			return nil, fmt.Errorf("secret value is not a JSON document")
+		}
+		doc = v
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("secret value is malformed: %v", err)
+		}
+		doc = string(b)
+	}
+	result := gjson.Get(doc, selector)
+	if !result.Exists() {
+		return nil, fmt.Errorf("secret value has no %q field", selector)
+	}
+	if result.Type == gjson.Number {
+		return json.Number(result.Raw), nil
+	}
+	return result.Value(), nil
+}
 
-	if strings.HasPrefix(s, "\"") && strings.HasSuffix(s, "\"") {
-		s = strings.Trim(s, "\"")
+func replaceSecretValue(ctx context.Context, secretManagers []SecretsManager, secretPath string) (string, bool, error) {
+	if !hasSecretKey(secretPath) {
+		return "", false, fmt.Errorf("path has no secrets")
+	}
+	secretValueRaw, err := getSecretValue(ctx, secretManagers, secretPath)
+	if err != nil {
+		return secretPath, false, err
+	}
+	secretValue, err := secretValueToString(secretValueRaw)
+	if err != nil {
+		return secretPath, false, err
+	}
+	return secretValue, true, nil
+}
+
+// secretValueToString converts a scalar secret value to the string.
+func secretValueToString(data interface{}) (string, error) {
+	switch v := data.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case json.Number:
+		return v.String(), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case map[string]interface{}, []interface{}:
+		return "", fmt.Errorf("secret value is not a string, select a field with secrets:<id>:<key>#<json.path>")
 	}
-	parts := strings.Split(s, ":")
-	return len(parts) == 3 && parts[0] == "secrets"
+	return "", fmt.Errorf("secret value is not a string")
 }
 
+func hasSecretKey(s string) bool {
+	_, ok := parseSecretReference(s)
+	return ok
+}
+
+// substitute resolves the placeholders and the secret references in the
+// keys and the values of the map. The nested maps and lists are resolved
+// at any depth.
 func substitute(ctx context.Context, repl *caddy.Replacer, secretManagers []SecretsManager, data map[string]interface{}, path string, log *zap.Logger) error {
 	for key := range data {
 		replacedKeyStr, err := substituteString(ctx, repl, secretManagers, path, key, log)
@@ -88,113 +183,77 @@ func substitute(ctx context.Context, repl *caddy.Replacer, secretManagers []Secr
 		if path != "" {
 			currentPath = fmt.Sprintf("%s.%s", path, key)
 		}
+		replacedValue, err := substituteItem(ctx, repl, secretManagers, currentPath, value, log)
+		if err != nil {
+			return err
+		}
+		data[key] = replacedValue
+	}
+	return nil
+}
 
-		switch v := value.(type) {
-		case bool, float32, float64:
-			continue
-		case string:
-			if replacedStr, err := substituteString(ctx, repl, secretManagers, currentPath, v, log); err != nil {
-				return err
-			} else {
-				data[key] = replacedStr
-			}
-		case []string:
-			if replacedStrs, err := substituteStrings(ctx, repl, secretManagers, currentPath, v, log); err != nil {
-				return err
-			} else {
-				data[key] = replacedStrs
-			}
-		case map[string]interface{}:
-			if err := substitute(ctx, repl, secretManagers, v, currentPath, log); err != nil {
-				return err
-			}
-		case []interface{}:
-			if len(v) == 0 {
-				continue
-			}
-			// Inspect the first element to determine if this is a list of strings or maps
-			switch first := v[0].(type) {
-			case bool:
-				continue
-			case string:
-				// Validate that every element in the interface slice is a string
-				entries := []string{}
-				for i, item := range v {
-					vStr, ok := item.(string)
-					if !ok {
-						log.Error("mixed types in string list",
-							zap.String("path", currentPath),
-							zap.Int("index", i),
-							zap.String("found_type", fmt.Sprintf("%T", item)),
-						)
-						return fmt.Errorf("found mixed types in list: %s", currentPath)
-					}
-					entry, err := substituteString(ctx, repl, secretManagers, path, vStr, log)
-					if err != nil {
-						return err
-					}
-					entries = append(entries, entry)
-				}
-				data[key] = entries
-			case map[string]interface{}:
-				for i, item := range v {
-					if m, ok := item.(map[string]interface{}); ok {
-						if err := substitute(ctx, repl, secretManagers, m, fmt.Sprintf("%s[%d]", currentPath, i), log); err != nil {
-							return err
-						}
-					}
-				}
-			case []interface{}:
-				// Detected list of lists, process each sub-list
-				for i, item := range v {
-					subList, ok := item.([]interface{})
-					if !ok {
-						log.Error("mixed types in nested list",
-							zap.String("path", currentPath),
-							zap.Int("index", i),
-							zap.String("found_type", fmt.Sprintf("%T", item)),
-						)
-						return fmt.Errorf("found mixed types in nested list: %s[%d]", currentPath, i)
-					}
+// substituteItem resolves the placeholders and the secret references in
+// a value of a map or a list.
+func substituteItem(ctx context.Context, repl *caddy.Replacer, secretManagers []SecretsManager, path string, value interface{}, log *zap.Logger) (interface{}, error) {
+	switch v := value.(type) {
+	case nil, bool, float32, float64, int, int32, int64, uint, uint32, uint64, json.Number:
+		return v, nil
+	case string:
+		return substituteValue(ctx, repl, secretManagers, path, v, log)
+	case []string:
+		return substituteStrings(ctx, repl, secretManagers, path, v, log)
+	case map[string]interface{}:
+		if err := substitute(ctx, repl, secretManagers, v, path, log); err != nil {
+			return nil, err
+		}
+		return v, nil
+	case []interface{}:
+		return substituteList(ctx, repl, secretManagers, path, v, log)
+	}
+	log.Error("unexpected field type",
+		zap.String("path", path),
+		zap.String("type", fmt.Sprintf("%T", value)),
+	)
+	return nil, fmt.Errorf("unexpected field type: %s: %T", path, value)
+}
 
-					// Process the sub-list elements
-					for j, subItem := range subList {
-						subPath := fmt.Sprintf("%s[%d][%d]", currentPath, i, j)
-						switch si := subItem.(type) {
-						case string:
-							if replaced, err := substituteString(ctx, repl, secretManagers, subPath, si, log); err != nil {
-								return err
-							} else {
-								subList[j] = replaced
-							}
-						case map[string]interface{}:
-							if err := substitute(ctx, repl, secretManagers, si, subPath, log); err != nil {
-								return err
-							}
-						case []interface{}:
-							log.Warn("deeply nested list detected, processing limited to 2 levels", zap.String("path", subPath))
-						}
-					}
-				}
-			default:
-				log.Error("unsupported slice element type",
-					zap.String("path", currentPath),
-					zap.String("type", fmt.Sprintf("%T", first)),
-				)
-				return fmt.Errorf("unsupported slice element type: %s", currentPath)
+// substituteList resolves the placeholders and the secret references in the
+// entries of the list. The list of strings becomes []string.
+func substituteList(ctx context.Context, repl *caddy.Replacer, secretManagers []SecretsManager, path string, values []interface{}, log *zap.Logger) (interface{}, error) {
+	if len(values) > 0 && isStringList(values) {
+		entries := []string{}
+		for i, item := range values {
+			entry, err := substituteString(ctx, repl, secretManagers, fmt.Sprintf("%s[%d]", path, i), item.(string), log)
+			if err != nil {
+				return nil, err
 			}
-		default:
-			log.Error("unexpected field type",
-				zap.String("path", currentPath),
-				zap.String("type", fmt.Sprintf("%T", v)),
-			)
-			return fmt.Errorf("unexpected field type: %s", currentPath)
+			entries = append(entries, entry)
 		}
+		return entries, nil
 	}
-	return nil
+	for i, item := range values {
+		replacedItem, err := substituteItem(ctx, repl, secretManagers, fmt.Sprintf("%s[%d]", path, i), item, log)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = replacedItem
+	}
+	return values, nil
+}
+
+func isStringList(values []interface{}) bool {
+	for _, item := range values {
+		if _, ok := item.(string); !ok {
+			return false
+		}
+	}
+	return true
 }
 
 func substituteString(ctx context.Context, repl *caddy.Replacer, secretManagers []SecretsManager, path, value string, log *zap.Logger) (string, error) {
+	if err := checkRedactedValue(path, value); err != nil {
+		return "", err
+	}
 	if replacedValue, _, err := util.FindReplace(repl, value); err == nil {
 		if hasSecretKey(replacedValue) {
 			replacedSecret, secretReplaced, err := replaceSecretValue(ctx, secretManagers, replacedValue)
@@ -223,6 +282,39 @@ func substituteString(ctx context.Context, repl *caddy.Replacer, secretManagers
 	return value, nil
 }
 
+// substituteValue substitutes the value of a config parameter. When the
+// value is a reference to a structured secret, i.e. a list or a map, the
+// secret replaces the parameter value as a whole.
+func substituteValue(ctx context.Context, repl *caddy.Replacer, secretManagers []SecretsManager, path, value string, log *zap.Logger) (interface{}, error) {
+	if err := checkRedactedValue(path, value); err != nil {
+		return nil, err
+	}
+	replacedValue, _, err := util.FindReplace(repl, value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if !hasSecretKey(replacedValue) {
+		return replacedValue, nil
+	}
+	secretValue, err := getSecretValue(ctx, secretManagers, replacedValue)
+	if err != nil {
+		log.Error("failed to replaced text",
+			zap.String("path", path),
+			zap.String("from", replacedValue),
+		)
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	switch secretValue.(type) {
+	case map[string]interface{}, []interface{}:
+		return secretValue, nil
+	}
+	s, err := secretValueToString(secretValue)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return s, nil
+}
+
 func substituteStrings(ctx context.Context, repl *caddy.Replacer, secretManagers []SecretsManager, path string, values []string, log *zap.Logger) ([]string, error) {
 	entries := []string{}
 	for _, value := range values {
@@ -235,278 +327,236 @@ func substituteStrings(ctx context.Context, repl *caddy.Replacer, secretManagers
 	return entries, nil
 }
 
-// ResolveRuntimeAppConfig uses caddy.Replacer to replace strings in App config.
-func ResolveRuntimeAppConfig(ctx context.Context, repl *caddy.Replacer, secretManagers []SecretsManager, config *authcrunch.Config, log *zap.Logger) error {
-	if config.Credentials != nil {
-		rawCredentialConfigs := [][]string{}
-		for _, rawCredentialConfig := range config.Credentials.RawCredentialConfigs {
-			if values, err := substituteStrings(ctx, repl, secretManagers, "RawCredentialConfigs", rawCredentialConfig, log); err == nil {
-				rawCredentialConfigs = append(rawCredentialConfigs, values)
-			} else {
-				return err
-			}
-		}
-		config.Credentials.RawCredentialConfigs = rawCredentialConfigs
-		if err := config.Credentials.Validate(); err != nil {
-			return err
-		}
-	}
+// argsConfigFields are the config fields holding the directives, e.g.
+// "crypto key verify secrets:keys:policy_key". The arguments of the
+// directives are resolved one by one.
+var argsConfigFields = map[string]bool{
+	"RawCryptoKeyStoreConfig": true,
+	"RawKeyConfigs":           true,
+	"AuthProxyRawConfig":      true,
+	"Actions":                 true,
+	"Matchers":                true,
+}
 
-	if config.Messaging != nil {
-		rawMessagingConfigs := [][]string{}
-		for _, rawMessagingConfig := range config.Messaging.RawConfigs {
-			if values, err := substituteStrings(ctx, repl, secretManagers, "RawMessagingConfigs", rawMessagingConfig, log); err == nil {
-				rawMessagingConfigs = append(rawMessagingConfigs, values)
-			} else {
-				return err
-			}
-		}
-		config.Messaging.RawConfigs = rawMessagingConfigs
-		if err := config.Messaging.Validate(); err != nil {
-			return err
-		}
-	}
+// regexConfigFields are the config fields holding the regular expressions,
+// e.g. "match path regex ^/api/v\{2\}" of the access list rules or the
+// bypass URIs. Their escaped braces are kept, and so are the placeholders
+// unknown to the replacer, e.g. "{2}" quantifiers.
+var regexConfigFields = map[string]bool{
+	"Conditions": true,
+	"URI":        true,
+	"Matchers":   true,
+}
 
-	if config.UserRegistration != nil {
-		rawUserRegistrationConfigs := [][]string{}
-		for _, rawMessagingConfig := range config.UserRegistration.RawConfigs {
-			if values, err := substituteStrings(ctx, repl, secretManagers, "RawUserRegistrationConfigs", rawMessagingConfig, log); err == nil {
-				rawUserRegistrationConfigs = append(rawUserRegistrationConfigs, values)
-			} else {
-				return err
-			}
-		}
-		config.UserRegistration.RawConfigs = rawUserRegistrationConfigs
-		if err := config.UserRegistration.Validate(); err != nil {
-			return err
-		}
-	}
+// regexBraceEscaper hides the escaped braces of the regular expressions
+// from the replacer, which unescapes them.
+var (
+	regexBraceEscaper   = strings.NewReplacer(`\{`, "\x00lbrace\x00", `\}`, "\x00rbrace\x00")
+	regexBraceUnescaper = strings.NewReplacer("\x00lbrace\x00", `\{`, "\x00rbrace\x00", `\}`)
+)
 
-	for _, cfg := range config.IdentityStores {
-		if err := substitute(ctx, repl, secretManagers, cfg.Params, "", log); err != nil {
-			return err
-		}
-		if err := cfg.Validate(); err != nil {
-			return err
-		}
+// configResolver resolves the placeholders and the secret references in
+// every exported string field of a config.
+type configResolver struct {
+	repl           *caddy.Replacer
+	secretManagers []SecretsManager
+	log            *zap.Logger
+	visited        map[visitedConfigValue]bool
+}
+
+type visitedConfigValue struct {
+	ptr uintptr
+	typ reflect.Type
+}
+
+// resolveConfigString resolves a string config field. The placeholders
+// unknown at provisioning, e.g. "{http.request.uri}", and the literal
+// braces, e.g. of the templates, are kept.
+func (r *configResolver) resolveConfigString(ctx context.Context, path, value string, regex bool) (string, error) {
+	if err := checkRedactedValue(path, value); err != nil {
+		return "", err
 	}
-	for _, cfg := range config.IdentityProviders {
-		if err := substitute(ctx, repl, secretManagers, cfg.Params, "", log); err != nil {
-			return err
-		}
-		if err := cfg.Validate(); err != nil {
-			return err
+	if hasSecretKey(value) {
+		replacedSecret, _, err := replaceSecretValue(ctx, r.secretManagers, value)
+		if err != nil {
+			r.log.Error("failed to replaced text",
+				zap.String("path", path),
+				zap.String("from", value),
+			)
+			return "", fmt.Errorf("%s: %v", path, err)
 		}
+		return replacedSecret, nil
 	}
+	replacedValue := r.replacePlaceholders(value, regex)
+	if replacedValue != value && hasSecretKey(replacedValue) {
+		return r.resolveConfigString(ctx, path, replacedValue, regex)
+	}
+	return replacedValue, nil
+}
 
-	for _, cfg := range config.SingleSignOnProviders {
-		if value, err := substituteString(ctx, repl, secretManagers, "EntityID", cfg.EntityID, log); err == nil {
-			cfg.EntityID = value
-		} else {
-			return err
-		}
-		if value, err := substituteString(ctx, repl, secretManagers, "CertPath", cfg.CertPath, log); err == nil {
-			cfg.CertPath = value
-		} else {
-			return err
-		}
-		if value, err := substituteString(ctx, repl, secretManagers, "PrivateKeyPath", cfg.PrivateKeyPath, log); err == nil {
-			cfg.PrivateKeyPath = value
-		} else {
-			return err
-		}
-		if values, err := substituteStrings(ctx, repl, secretManagers, "Locations", cfg.Locations, log); err == nil {
-			cfg.Locations = values
-		} else {
-			return err
-		}
-		if err := cfg.Validate(); err != nil {
-			return err
-		}
+// replacePlaceholders replaces the known placeholders in the value.
+func (r *configResolver) replacePlaceholders(value string, regex bool) string {
+	if !regex {
+		return r.repl.ReplaceKnown(value, "")
 	}
+	replacedValue := r.repl.ReplaceKnown(regexBraceEscaper.Replace(value), "")
+	return regexBraceUnescaper.Replace(replacedValue)
+}
 
-	for _, cfg := range config.AuthenticationPortals {
-		entries := []string{}
+// resolveConfigArgs resolves the arguments of a directive.
+func (r *configResolver) resolveConfigArgs(ctx context.Context, path, value string, regex bool) (string, error) {
+	args, err := cfgutil.DecodeArgs(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode %s: %v", path, err)
+	}
+	for i, arg := range args {
+		if args[i], err = r.resolveConfigString(ctx, path, arg, regex); err != nil {
+			return "", err
+		}
+	}
+	return cfgutil.EncodeArgs(args), nil
+}
 
-		// Crypto configs
-		for _, entry := range cfg.GetRawCryptoKeyStoreConfig() {
-			args, err := cfgutil.DecodeArgs(entry)
-			if err != nil {
-				return fmt.Errorf("failed to decode RawCryptoKeyStoreConfigs: %v", err)
+// resolveConfigValue walks the config value and resolves its strings. The
+// field is the name of the struct field holding the value.
+func (r *configResolver) resolveConfigValue(ctx context.Context, path, field string, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return nil
+		}
+		key := visitedConfigValue{ptr: v.Pointer(), typ: v.Type()}
+		if r.visited[key] {
+			return nil
+		}
+		r.visited[key] = true
+		return r.resolveConfigValue(ctx, path, field, v.Elem())
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() || !v.Field(i).CanSet() {
+				continue
 			}
-			if values, err := substituteStrings(ctx, repl, secretManagers, "RawCryptoKeyStoreConfigs", args, log); err == nil {
-				entries = append(entries, cfgutil.EncodeArgs(values))
-			} else {
+			fieldPath := field.Name
+			if path != "" {
+				fieldPath = path + "." + field.Name
+			}
+			if err := r.resolveConfigValue(ctx, fieldPath, field.Name, v.Field(i)); err != nil {
 				return err
 			}
 		}
-		cfg.OverwriteRawCryptoKeyStoreConfig(entries)
-
-		// User Transforms
-		for _, trCfg := range cfg.UserTransformerConfigs {
-			actions := []string{}
-			for _, action := range trCfg.Actions {
-				args, err := cfgutil.DecodeArgs(action)
-				if err != nil {
-					return fmt.Errorf("failed to decode UserTransformerConfigs.Action: %v", err)
-				}
-				if values, err := substituteStrings(ctx, repl, secretManagers, "UserTransformerConfig.Action", args, log); err == nil {
-					actions = append(actions, cfgutil.EncodeArgs(values))
-				} else {
-					return err
-				}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := r.resolveConfigValue(ctx, fmt.Sprintf("%s[%d]", path, i), field, v.Index(i)); err != nil {
+				return err
 			}
-			trCfg.Actions = actions
-
-			matchers := []string{}
-			for _, action := range trCfg.Matchers {
-				args, err := cfgutil.DecodeArgs(action)
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		if data, ok := v.Interface().(map[string]interface{}); ok {
+			return substitute(ctx, r.repl, r.secretManagers, data, path, r.log)
+		}
+		for _, key := range v.MapKeys() {
+			newKey := key
+			if key.Kind() == reflect.String {
+				s, err := r.resolveConfigString(ctx, path+"[].Key", key.String(), false)
 				if err != nil {
-					return fmt.Errorf("failed to decode UserTransformerConfigs.Matcher: %v", err)
-				}
-				if values, err := substituteStrings(ctx, repl, secretManagers, "UserTransformerConfig.Matcher", args, log); err == nil {
-					matchers = append(matchers, cfgutil.EncodeArgs(values))
-				} else {
 					return err
 				}
+				newKey = reflect.ValueOf(s).Convert(key.Type())
+			}
+			// The map values are not addressable, the copy is resolved
+			// and stored back.
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(v.MapIndex(key))
+			if err := r.resolveConfigValue(ctx, fmt.Sprintf("%s[%v]", path, newKey), field, value); err != nil {
+				return err
+			}
+			if newKey.Interface() != key.Interface() {
+				v.SetMapIndex(key, reflect.Value{})
 			}
-			trCfg.Matchers = matchers
+			v.SetMapIndex(newKey, value)
 		}
-
-		// UI
-		if value, err := substituteString(ctx, repl, secretManagers, "UI.LogoURL", cfg.UI.LogoURL, log); err == nil {
-			cfg.UI.LogoURL = value
-		} else {
-			return err
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil
 		}
-		if value, err := substituteString(ctx, repl, secretManagers, "UI.LogoDescription", cfg.UI.LogoDescription, log); err == nil {
-			cfg.UI.LogoDescription = value
-		} else {
+		value := reflect.New(v.Elem().Type()).Elem()
+		value.Set(v.Elem())
+		if err := r.resolveConfigValue(ctx, path, field, value); err != nil {
 			return err
 		}
-		if value, err := substituteString(ctx, repl, secretManagers, "UI.MetaTitle", cfg.UI.MetaTitle, log); err == nil {
-			cfg.UI.MetaTitle = value
+		v.Set(value)
+	case reflect.String:
+		var s string
+		var err error
+		if argsConfigFields[field] {
+			s, err = r.resolveConfigArgs(ctx, path, v.String(), regexConfigFields[field])
 		} else {
-			return err
+			s, err = r.resolveConfigString(ctx, path, v.String(), regexConfigFields[field])
 		}
-		if value, err := substituteString(ctx, repl, secretManagers, "UI.MetaAuthor", cfg.UI.MetaAuthor, log); err == nil {
-			cfg.UI.MetaAuthor = value
-		} else {
+		if err != nil {
 			return err
 		}
-		if value, err := substituteString(ctx, repl, secretManagers, "UI.MetaDescription", cfg.UI.MetaDescription, log); err == nil {
-			cfg.UI.MetaDescription = value
-		} else {
+		v.SetString(s)
+	}
+	return nil
+}
+
+// ResolveRuntimeAppConfig resolves the placeholders and the secret
+// references in the strings of the App config.
+func ResolveRuntimeAppConfig(ctx context.Context, repl *caddy.Replacer, secretManagers []SecretsManager, config *authcrunch.Config, log *zap.Logger) error {
+	r := &configResolver{
+		repl:           repl,
+		secretManagers: secretManagers,
+		log:            log,
+		visited:        make(map[visitedConfigValue]bool),
+	}
+	if err := r.resolveConfigValue(ctx, "", "", reflect.ValueOf(config)); err != nil {
+		return err
+	}
+
+	if config.Credentials != nil {
+		if err := config.Credentials.Validate(); err != nil {
 			return err
 		}
-		if value, err := substituteString(ctx, repl, secretManagers, "UI.AutoRedirectURL", cfg.UI.AutoRedirectURL, log); err == nil {
-			cfg.UI.AutoRedirectURL = value
-		} else {
+	}
+	if config.Messaging != nil {
+		if err := config.Messaging.Validate(); err != nil {
 			return err
 		}
-		if value, err := substituteString(ctx, repl, secretManagers, "UI.CustomCSSPath", cfg.UI.CustomCSSPath, log); err == nil {
-			cfg.UI.CustomCSSPath = value
-		} else {
+	}
+	if config.UserRegistration != nil {
+		if err := config.UserRegistration.Validate(); err != nil {
 			return err
 		}
-		if value, err := substituteString(ctx, repl, secretManagers, "UI.CustomJsPath", cfg.UI.CustomJsPath, log); err == nil {
-			cfg.UI.CustomJsPath = value
-		} else {
+	}
+	for _, cfg := range config.IdentityStores {
+		if err := cfg.Validate(); err != nil {
 			return err
 		}
-
-		for k, v := range cfg.UI.Templates {
-			if value, err := substituteString(ctx, repl, secretManagers, "UI.Templates."+k, v, log); err == nil {
-				cfg.UI.Templates[k] = value
-			} else {
-				return err
-			}
-		}
-
-		for i, lnk := range cfg.UI.PrivateLinks {
-			if value, err := substituteString(ctx, repl, secretManagers, fmt.Sprintf("UI.PrivateLink[%d].Title", i), lnk.Title, log); err == nil {
-				lnk.Title = value
-			} else {
-				return err
-			}
-			if value, err := substituteString(ctx, repl, secretManagers, fmt.Sprintf("UI.PrivateLink[%d].Link", i), lnk.Link, log); err == nil {
-				lnk.Link = value
-			} else {
-				return err
-			}
-		}
-
-		for i, asset := range cfg.UI.StaticAssets {
-			if value, err := substituteString(ctx, repl, secretManagers, fmt.Sprintf("UI.StaticAsset[%d].Path", i), asset.Path, log); err == nil {
-				asset.Path = value
-			} else {
-				return err
-			}
-			if value, err := substituteString(ctx, repl, secretManagers, fmt.Sprintf("UI.StaticAsset[%d].ContentType", i), asset.ContentType, log); err == nil {
-				asset.ContentType = value
-			} else {
-				return err
-			}
-			if value, err := substituteString(ctx, repl, secretManagers, fmt.Sprintf("UI.StaticAsset[%d].FsPath", i), asset.FsPath, log); err == nil {
-				asset.FsPath = value
-			} else {
-				return err
-			}
-		}
-
-		if value, err := substituteString(ctx, repl, secretManagers, "CookieConfig.Path", cfg.CookieConfig.Path, log); err == nil {
-			cfg.CookieConfig.Path = value
-		} else {
+	}
+	for _, cfg := range config.IdentityProviders {
+		if err := cfg.Validate(); err != nil {
 			return err
 		}
-
-		for domainKey, domain := range cfg.CookieConfig.Domains {
-			if value, err := substituteString(ctx, repl, secretManagers, "CookieConfig.Domains[].Key", domainKey, log); err == nil {
-				if value != domainKey {
-					cfg.CookieConfig.Domains[value] = domain
-					delete(cfg.CookieConfig.Domains, domainKey)
-				}
-			} else {
-				return err
-			}
-		}
-
-		for domainKey, domain := range cfg.CookieConfig.Domains {
-			if value, err := substituteString(ctx, repl, secretManagers, "CookieConfig.Domains["+domainKey+"].Domain", domain.Domain, log); err == nil {
-				domain.Domain = value
-			} else {
-				return err
-			}
-			if value, err := substituteString(ctx, repl, secretManagers, "CookieConfig.Domains["+domainKey+"].Path", domain.Path, log); err == nil {
-				domain.Path = value
-			} else {
-				return err
-			}
+	}
+	for _, cfg := range config.SingleSignOnProviders {
+		if err := cfg.Validate(); err != nil {
+			return err
 		}
-
+	}
+	for _, cfg := range config.AuthenticationPortals {
 		if err := cfg.Validate(); err != nil {
 			return err
 		}
 	}
-
 	for _, cfg := range config.AuthorizationPolicies {
-		entries := []string{}
-		for _, entry := range cfg.GetRawCryptoKeyStoreConfig() {
-			args, err := cfgutil.DecodeArgs(entry)
-			if err != nil {
-				return fmt.Errorf("failed to decode RawCryptoKeyStoreConfigs: %v", err)
-			}
-			if values, err := substituteStrings(ctx, repl, secretManagers, "RawCryptoKeyStoreConfigs", args, log); err == nil {
-				entries = append(entries, cfgutil.EncodeArgs(values))
-			} else {
-				return err
-			}
-		}
-		cfg.OverwriteRawCryptoKeyStoreConfig(entries)
 		if err := cfg.Validate(); err != nil {
 			return err
 		}
 	}
-
 	return nil
 }
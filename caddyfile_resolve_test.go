@@ -24,6 +24,8 @@ import (
 	"testing"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/greenpau/go-authcrunch"
 	logutil "github.com/greenpau/go-authcrunch/pkg/util/log"
 
@@ -236,3 +238,360 @@ func TestResolveRuntimeAppConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestGetSecretValue(t *testing.T) {
+	secretsManager := &FileSecretsManager{ID: "mysecrets"}
+	secretsManager.setSecrets(map[string]interface{}{
+		"shared_secret": "foo",
+		"oauth":         `{"client_id": "bar", "client_secret": "baz", "scopes": ["openid", "email"]}`,
+		"users": []interface{}{
+			map[string]interface{}{"username": "jsmith", "email": "jsmith@localhost", "uid": 1000},
+		},
+		"plain": "not json",
+	})
+	testcases := []struct {
+		name      string
+		path      string
+		want      interface{}
+		wantStr   string
+		shouldErr bool
+		err       error
+	}{
+		{
+			name:    "test plain secret",
+			path:    "secrets:mysecrets:shared_secret",
+			want:    "foo",
+			wantStr: "foo",
+		},
+		{
+			name:    "test quoted secret",
+			path:    `"secrets:mysecrets:shared_secret"`,
+			want:    "foo",
+			wantStr: "foo",
+		},
+		{
+			name:    "test field of json string secret",
+			path:    "secrets:mysecrets:oauth#client_secret",
+			want:    "baz",
+			wantStr: "baz",
+		},
+		{
+			name:    "test list field of json string secret",
+			path:    "secrets:mysecrets:oauth#scopes",
+			want:    []interface{}{"openid", "email"},
+			wantStr: "",
+		},
+		{
+			name:    "test nested field of structured secret",
+			path:    "secrets:mysecrets:users#0.email",
+			want:    "jsmith@localhost",
+			wantStr: "jsmith@localhost",
+		},
+		{
+			name:    "test number field of structured secret",
+			path:    "secrets:mysecrets:users#0.uid",
+			want:    json.Number("1000"),
+			wantStr: "1000",
+		},
+		{
+			name:      "test missing field",
+			path:      "secrets:mysecrets:oauth#password",
+			shouldErr: true,
+			err:       fmt.Errorf(`secret value has no "password" field`),
+		},
+		{
+			name:      "test field of non-json secret",
+			path:      "secrets:mysecrets:plain#foo",
+			shouldErr: true,
+			err:       fmt.Errorf("secret value is not a JSON document"),
+		},
+		{
+			name:      "test unknown secrets manager",
+			path:      "secrets:othersecrets:shared_secret",
+			shouldErr: true,
+			err:       fmt.Errorf("secret key value was not replaced"),
+		},
+		{
+			name:      "test malformed reference",
+			path:      "secrets:mysecrets:oauth#",
+			shouldErr: true,
+			err:       fmt.Errorf("path has no secrets"),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := getSecretValue(context.TODO(), []SecretsManager{secretsManager}, tc.path)
+			if err != nil {
+				if !tc.shouldErr {
+					t.Fatalf("expected success, got: %v", err)
+				}
+				if diff := cmp.Diff(tc.err.Error(), err.Error()); diff != "" {
+					t.Fatalf("unexpected error mismatch (-want +got):\n%s", diff)
+				}
+				return
+			}
+			if tc.shouldErr {
+				t.Fatalf("unexpected success, want: %v", tc.err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("getSecretValue() mismatch (-want +got):\n%s", diff)
+			}
+
+			gotStr, _, err := replaceSecretValue(context.TODO(), []SecretsManager{secretsManager}, tc.path)
+			if tc.wantStr == "" {
+				if err == nil {
+					t.Errorf("replaceSecretValue() expected error for structured secret, got %q", gotStr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if gotStr != tc.wantStr {
+				t.Errorf("replaceSecretValue() got %q, want %q", gotStr, tc.wantStr)
+			}
+		})
+	}
+}
+
+func TestSubstituteStructuredSecrets(t *testing.T) {
+	secretsManager := &FileSecretsManager{ID: "mysecrets"}
+	secretsManager.setSecrets(map[string]interface{}{
+		"oidc": map[string]interface{}{
+			"client_id":     "foo",
+			"client_secret": "bar",
+			"scopes":        []interface{}{"openid", "email"},
+		},
+		"users": []interface{}{
+			map[string]interface{}{"username": "jsmith", "roles": []interface{}{"authp/user"}},
+		},
+	})
+	params := map[string]interface{}{
+		"realm":         "google",
+		"client_id":     "secrets:mysecrets:oidc#client_id",
+		"client_secret": "secrets:mysecrets:oidc#client_secret",
+		"scopes":        "secrets:mysecrets:oidc#scopes",
+		"users":         "secrets:mysecrets:users",
+	}
+	want := map[string]interface{}{
+		"realm":         "google",
+		"client_id":     "foo",
+		"client_secret": "bar",
+		"scopes":        []interface{}{"openid", "email"},
+		"users": []interface{}{
+			map[string]interface{}{"username": "jsmith", "roles": []interface{}{"authp/user"}},
+		},
+	}
+	err := substitute(context.TODO(), caddy.NewReplacer(), []SecretsManager{secretsManager}, params, "", logutil.NewLogger())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(want, params); diff != "" {
+		t.Errorf("substitute() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestResolveRuntimeAppConfigAllFields(t *testing.T) {
+	t.Setenv("TEST_RESOLVE_FORBIDDEN_URL", "/forbidden")
+	t.Setenv("TEST_RESOLVE_BYPASS_URI", "/health")
+	t.Setenv("TEST_RESOLVE_HEADER_SECRET", "secrets:mysecrets:header")
+	t.Setenv("TEST_RESOLVE_API_PATH", "users")
+
+	secretsManager := &FileSecretsManager{ID: "mysecrets"}
+	secretsManager.setSecrets(map[string]interface{}{
+		"auth_url": "/auth",
+		"header":   "X-Tenant",
+		"key":      "0e2fdcf8-6868-41a7-884b-7308795fc286",
+	})
+
+	raw, err := parseCaddyfile(caddyfile.NewTestDispenser(`
+	security {
+	  authorization policy mypolicy {
+	    crypto key verify secrets:mysecrets:key
+	    set auth url secrets:mysecrets:auth_url
+	    set forbidden url {env.TEST_RESOLVE_FORBIDDEN_URL}
+	    bypass uri prefix {env.TEST_RESOLVE_BYPASS_URI}
+	    bypass uri regex ^/status/[0-9]{2}$
+	    inject header {env.TEST_RESOLVE_HEADER_SECRET} from tenant
+	    acl rule {
+	      regex match path ^/api/v\{2\}/{env.TEST_RESOLVE_API_PATH}$
+	      allow log debug
+	    }
+	  }
+	}`), nil)
+	if err != nil {
+		t.Fatalf("failed parsing config: %v", err)
+	}
+	app := &App{}
+	if err := json.Unmarshal(raw.(httpcaddyfile.App).Value, app); err != nil {
+		t.Fatalf("failed unmarshaling config: %v", err)
+	}
+	config := app.Config
+
+	if err := ResolveRuntimeAppConfig(context.TODO(), caddy.NewReplacer(), []SecretsManager{secretsManager}, config, logutil.NewLogger()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	b, err := json.Marshal(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, s := range []string{"secrets:", "{env."} {
+		if strings.Contains(string(b), s) {
+			t.Errorf("found unresolved %q reference in resolved config: %s", s, b)
+		}
+	}
+
+	policy := config.AuthorizationPolicies[0]
+	got := map[string]interface{}{
+		"auth_url":      policy.AuthURLPath,
+		"forbidden_url": policy.ForbiddenURL,
+		"bypass_uri":    policy.BypassConfigs[0].URI,
+		"bypass_regex":  policy.BypassConfigs[1].URI,
+		"header":        policy.HeaderInjectionConfigs[0].Header,
+		"acl":           policy.AccessListRules[0].Conditions,
+		"crypto":        policy.RawCryptoKeyStoreConfig,
+	}
+	want := map[string]interface{}{
+		"auth_url":      "/auth",
+		"forbidden_url": "/forbidden",
+		"bypass_uri":    "/health",
+		"bypass_regex":  "^/status/[0-9]{2}$",
+		"header":        "X-Tenant",
+		"acl":           []string{`regex match path ^/api/v\{2\}/users$`},
+		"crypto":        []string{"crypto key verify 0e2fdcf8-6868-41a7-884b-7308795fc286"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ResolveRuntimeAppConfig() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestResolveRuntimeAppConfigUnknownPlaceholder(t *testing.T) {
+	raw, err := parseCaddyfile(caddyfile.NewTestDispenser(`
+	security {
+	  authorization policy mypolicy {
+	    crypto key verify 0e2fdcf8-6868-41a7-884b-7308795fc286
+	    set forbidden url /forbidden?uri={http.request.uri}
+	    allow roles authp/admin
+	  }
+	}`), nil)
+	if err != nil {
+		t.Fatalf("failed parsing config: %v", err)
+	}
+	app := &App{}
+	if err := json.Unmarshal(raw.(httpcaddyfile.App).Value, app); err != nil {
+		t.Fatalf("failed unmarshaling config: %v", err)
+	}
+
+	if err := ResolveRuntimeAppConfig(context.TODO(), caddy.NewReplacer(), nil, app.Config, logutil.NewLogger()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "/forbidden?uri={http.request.uri}"
+	if diff := cmp.Diff(want, app.Config.AuthorizationPolicies[0].ForbiddenURL); diff != "" {
+		t.Errorf("ResolveRuntimeAppConfig() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestSubstituteNested(t *testing.T) {
+	t.Setenv("TEST_SUBSTITUTE_HOST", "ldap.contoso.com")
+	secretsManager := &FileSecretsManager{ID: "mysecrets"}
+	secretsManager.setSecrets(map[string]interface{}{
+		"bind_password": "foo",
+	})
+	testcases := []struct {
+		name      string
+		data      map[string]interface{}
+		want      map[string]interface{}
+		shouldErr bool
+		err       error
+	}{
+		{
+			name: "test deeply nested lists and maps",
+			data: map[string]interface{}{
+				"servers": []interface{}{
+					map[string]interface{}{
+						"address": "ldaps://{env.TEST_SUBSTITUTE_HOST}:636",
+						"timeout": json.Number("5"),
+						"port":    636,
+						"retries": int64(3),
+						"ignore":  nil,
+					},
+				},
+				"groups": []interface{}{
+					[]interface{}{
+						[]interface{}{
+							[]interface{}{"cn=admins,dc={env.TEST_SUBSTITUTE_HOST}", "authp/admin"},
+							map[string]interface{}{"password": "secrets:mysecrets:bind_password"},
+						},
+					},
+				},
+			},
+			want: map[string]interface{}{
+				"servers": []interface{}{
+					map[string]interface{}{
+						"address": "ldaps://ldap.contoso.com:636",
+						"timeout": json.Number("5"),
+						"port":    636,
+						"retries": int64(3),
+						"ignore":  nil,
+					},
+				},
+				"groups": []interface{}{
+					[]interface{}{
+						[]interface{}{
+							[]string{"cn=admins,dc=ldap.contoso.com", "authp/admin"},
+							map[string]interface{}{"password": "foo"},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "test mixed types in list",
+			data: map[string]interface{}{
+				"keys": []interface{}{"secrets:mysecrets:bind_password", 1, true},
+			},
+			want: map[string]interface{}{
+				"keys": []interface{}{"foo", 1, true},
+			},
+		},
+		{
+			name: "test unsupported type in nested list",
+			data: map[string]interface{}{
+				"groups": []interface{}{[]interface{}{[]interface{}{struct{}{}}}},
+			},
+			shouldErr: true,
+			err:       fmt.Errorf("unexpected field type: groups[0][0][0]: struct {}"),
+		},
+		{
+			name: "test missing secret in nested map",
+			data: map[string]interface{}{
+				"servers": []interface{}{
+					map[string]interface{}{"bind": []interface{}{map[string]interface{}{"password": "secrets:mysecrets:missing"}}},
+				},
+			},
+			shouldErr: true,
+			err:       fmt.Errorf(`servers[0].bind[0].password: file secrets manager "mysecrets" has no "missing" key`),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := substitute(context.TODO(), caddy.NewReplacer(), []SecretsManager{secretsManager}, tc.data, "", logutil.NewLogger())
+			if err != nil {
+				if !tc.shouldErr {
+					t.Fatalf("expected success, got: %v", err)
+				}
+				if diff := cmp.Diff(tc.err.Error(), err.Error()); diff != "" {
+					t.Fatalf("unexpected error mismatch (-want +got):\n%s", diff)
+				}
+				return
+			}
+			if tc.shouldErr {
+				t.Fatalf("unexpected success, want: %v", tc.err)
+			}
+			if diff := cmp.Diff(tc.want, tc.data); diff != "" {
+				t.Errorf("substitute() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
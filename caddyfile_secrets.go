@@ -15,6 +15,10 @@
 package security
 
 import (
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 )
@@ -30,12 +34,24 @@ const (
 //	secrets <secrets_plugin_name> <secret_id> {
 //	  ...
 //	}
+//
+//	secrets resolution <secret_id|*> {
+//	  timeout <duration>
+//	  retries <count>
+//	  backoff <duration>
+//	  cache path <path>
+//	  cache key <key>
+//	}
 func parseCaddyfileSecrets(d *caddyfile.Dispenser, app *App) error {
 	args := d.RemainingArgs()
 	if len(args) != 2 {
 		return d.ArgErr()
 	}
 
+	if args[0] == "resolution" {
+		return parseCaddyfileSecretsResolution(d, app, args[1])
+	}
+
 	modName := args[0]
 	modID := secretsPrefix + "." + modName
 	mod, err := caddyfile.UnmarshalModule(d, modID)
@@ -50,3 +66,49 @@ func parseCaddyfileSecrets(d *caddyfile.Dispenser, app *App) error {
 
 	return nil
 }
+
+// parseCaddyfileSecretsResolution parses the settings for fetching secrets
+// from a secrets manager.
+func parseCaddyfileSecretsResolution(d *caddyfile.Dispenser, app *App, id string) error {
+	for _, cfg := range app.SecretsResolution {
+		if cfg.ID == id {
+			return d.Errf("duplicate secrets resolution config: %s", id)
+		}
+	}
+	cfg := &SecretsResolutionConfig{ID: id}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		k := d.Val()
+		args := d.RemainingArgs()
+		switch {
+		case (k == "timeout" || k == "backoff") && len(args) == 1:
+			v, err := caddy.ParseDuration(args[0])
+			if err != nil || v < 0 {
+				return d.Errf("%s directive has malformed value: %s", k, args[0])
+			}
+			if k == "timeout" {
+				cfg.Timeout = caddy.Duration(v)
+			} else {
+				cfg.Backoff = caddy.Duration(v)
+			}
+		case k == "retries" && len(args) == 1:
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n < 0 {
+				return d.Errf("%s directive has malformed value: %s", k, args[0])
+			}
+			cfg.MaxRetries = n
+		case k == "cache" && len(args) == 2 && args[0] == "path":
+			cfg.CachePath = args[1]
+		case k == "cache" && len(args) == 2 && args[0] == "key":
+			cfg.CacheKey = args[1]
+		case k == "timeout", k == "backoff", k == "retries", k == "cache":
+			return d.Errf("%s directive has malformed value: %s", k, strings.Join(args, " "))
+		default:
+			return d.Errf("unsupported secrets resolution directive: %s", k)
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return d.Errf("%v", err)
+	}
+	app.SecretsResolution = append(app.SecretsResolution, cfg)
+	return nil
+}
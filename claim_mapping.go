@@ -0,0 +1,216 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"github.com/greenpau/go-authcrunch/pkg/requests"
+)
+
+// ClaimMapping maps a token claim to a key in the metadata of
+// an authenticated user, i.e. {http.auth.user.<key>} placeholder.
+// The path is the dot-separated path to the claim, e.g. "tenant.id".
+type ClaimMapping struct {
+	Path string `json:"path,omitempty" xml:"path,omitempty" yaml:"path,omitempty"`
+	Key  string `json:"key,omitempty" xml:"key,omitempty" yaml:"key,omitempty"`
+}
+
+// defaultClaimMappings are the mappings from the request identity of an
+// authorized user to the user metadata applied to all policies.
+var defaultClaimMappings = []*ClaimMapping{
+	{Path: "roles", Key: "roles"},
+	{Path: "claim_id", Key: "claim_id"},
+	{Path: "sub", Key: "sub"},
+	{Path: "email", Key: "email"},
+	{Path: "name", Key: "name"},
+	{Path: "issuer", Key: "issuer"},
+	{Path: "origin", Key: "origin"},
+	{Path: "realm", Key: "realm"},
+	{Path: "userinfo|preferred_username", Key: "username"},
+}
+
+// Validate validates ClaimMapping.
+func (m *ClaimMapping) Validate() error {
+	if m.Path == "" {
+		return fmt.Errorf("claim path is empty")
+	}
+	for _, s := range strings.Split(m.Path, ".") {
+		if s == "" {
+			return fmt.Errorf("claim path %q is malformed", m.Path)
+		}
+	}
+	if m.Key == "" {
+		return fmt.Errorf("user metadata key for %q claim is empty", m.Path)
+	}
+	if m.Key == "id" {
+		return fmt.Errorf("user metadata key %q is reserved", m.Key)
+	}
+	return nil
+}
+
+// newAuthorizedUser returns the user for an authorized request. The user
+// metadata holds the default claims of the user request identity and the
+// claims mapped by the policy.
+func newAuthorizedUser(ar *requests.AuthorizationRequest, mappings []*ClaimMapping) caddyauth.User {
+	u := caddyauth.User{
+		Metadata: make(map[string]string),
+	}
+	if v, ok := claimValueToString(ar.Response.User["id"]); ok {
+		u.ID = v
+	}
+	for _, mapping := range defaultClaimMappings {
+		if v, ok := claimValueToString(ar.Response.User[mapping.Path]); ok {
+			u.Metadata[mapping.Key] = v
+		}
+	}
+	if len(mappings) == 0 {
+		return u
+	}
+
+	claims := getTokenClaims(ar)
+	for _, mapping := range mappings {
+		v, found := getClaimValue(claims, mapping.Path)
+		if !found {
+			v, found = getClaimValue(ar.Response.User, mapping.Path)
+		}
+		if !found {
+			continue
+		}
+		if s, ok := claimValueToString(v); ok {
+			u.Metadata[mapping.Key] = s
+		}
+	}
+	return u
+}
+
+// getTokenClaims returns the claims of the JWT token of an authorized
+// request. For the requests authorized without a JWT token, e.g. with
+// API keys, it returns nil.
+func getTokenClaims(ar *requests.AuthorizationRequest) map[string]interface{} {
+	payload := getTokenPayload(ar)
+	if payload == nil {
+		return nil
+	}
+	var claims map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&claims); err != nil {
+		return nil
+	}
+	return claims
+}
+
+// getTokenPayload returns the decoded payload of the JWT token found in
+// the request. The token signature is not verified, because the token had
+// been validated by the gatekeeper.
+func getTokenPayload(ar *requests.AuthorizationRequest) []byte {
+	if !ar.Token.Found || ar.Token.IsPlainPayload {
+		return nil
+	}
+	parts := strings.Split(ar.Token.Payload, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// getClaimValue returns the value at the dot-separated path. The path
+// segments are the keys of nested objects or the indexes of lists.
+func getClaimValue(data map[string]interface{}, path string) (interface{}, bool) {
+	if data == nil {
+		return nil, false
+	}
+	if v, exists := data[path]; exists {
+		return v, true
+	}
+	var current interface{} = data
+	for _, k := range strings.Split(path, ".") {
+		switch v := current.(type) {
+		case map[string]interface{}:
+			entry, exists := v[k]
+			if !exists {
+				return nil, false
+			}
+			current = entry
+		case []interface{}:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			current = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// claimValueToString converts a claim value to the string. The lists of
+// scalar values are space-separated, like roles. The objects and the lists
+// of objects are JSON-encoded. It returns false for nil values.
+func claimValueToString(data interface{}) (string, bool) {
+	switch v := data.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case json.Number:
+		return v.String(), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32), true
+	case int:
+		return strconv.Itoa(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case []string:
+		return strings.Join(v, " "), true
+	case []interface{}:
+		entries := make([]string, 0, len(v))
+		for _, entry := range v {
+			switch entry.(type) {
+			case map[string]interface{}, []interface{}:
+				return encodeClaimValue(v)
+			}
+			if s, ok := claimValueToString(entry); ok {
+				entries = append(entries, s)
+			}
+		}
+		return strings.Join(entries, " "), true
+	}
+	return encodeClaimValue(data)
+}
+
+func encodeClaimValue(data interface{}) (string, bool) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
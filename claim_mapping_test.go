@@ -0,0 +1,146 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"github.com/google/go-cmp/cmp"
+	"github.com/greenpau/go-authcrunch/pkg/requests"
+)
+
+func newTestToken(claims string) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS512","typ":"JWT"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(claims))
+	return header + "." + payload + ".c2lnbmF0dXJl"
+}
+
+func TestNewAuthorizedUser(t *testing.T) {
+	testcases := []struct {
+		name     string
+		user     map[string]interface{}
+		token    string
+		mappings []*ClaimMapping
+		want     caddyauth.User
+	}{
+		{
+			name: "test default claims",
+			user: map[string]interface{}{
+				"id":                          "jsmith@localhost",
+				"roles":                       "authp/admin authp/user",
+				"email":                       "jsmith@localhost",
+				"realm":                       "local",
+				"userinfo|preferred_username": "jsmith",
+			},
+			want: caddyauth.User{
+				ID: "jsmith@localhost",
+				Metadata: map[string]string{
+					"roles":    "authp/admin authp/user",
+					"email":    "jsmith@localhost",
+					"realm":    "local",
+					"username": "jsmith",
+				},
+			},
+		},
+		{
+			name: "test default claims with non-string roles",
+			user: map[string]interface{}{
+				"id":    "jsmith@localhost",
+				"roles": []interface{}{"authp/admin", "authp/user"},
+			},
+			want: caddyauth.User{
+				ID: "jsmith@localhost",
+				Metadata: map[string]string{
+					"roles": "authp/admin authp/user",
+				},
+			},
+		},
+		{
+			name: "test mapped token claims",
+			user: map[string]interface{}{
+				"id":    "jsmith@localhost",
+				"roles": "authp/user",
+			},
+			token: newTestToken(`{
+				"sub": "jsmith",
+				"tenant": {"id": 12345678901234567890, "name": "acme", "tier": {"level": 2}},
+				"groups": ["dev", "ops"],
+				"scopes": [{"name": "read"}],
+				"verified": true,
+				"ratio": 0.5
+			}`),
+			mappings: []*ClaimMapping{
+				{Path: "tenant.id", Key: "tenant_id"},
+				{Path: "tenant.tier", Key: "tenant_tier"},
+				{Path: "groups", Key: "groups"},
+				{Path: "groups.1", Key: "second_group"},
+				{Path: "scopes", Key: "scopes"},
+				{Path: "verified", Key: "verified"},
+				{Path: "ratio", Key: "ratio"},
+				{Path: "roles", Key: "user_roles"},
+				{Path: "missing", Key: "missing"},
+			},
+			want: caddyauth.User{
+				ID: "jsmith@localhost",
+				Metadata: map[string]string{
+					"roles":        "authp/user",
+					"tenant_id":    "12345678901234567890",
+					"tenant_tier":  `{"level":2}`,
+					"groups":       "dev ops",
+					"second_group": "ops",
+					"scopes":       `[{"name":"read"}]`,
+					"verified":     "true",
+					"ratio":        "0.5",
+					"user_roles":   "authp/user",
+				},
+			},
+		},
+		{
+			name: "test mapped claims without token",
+			user: map[string]interface{}{
+				"id":    "jsmith@localhost",
+				"roles": "authp/user",
+				"realm": "local",
+			},
+			mappings: []*ClaimMapping{
+				{Path: "realm", Key: "auth_realm"},
+			},
+			want: caddyauth.User{
+				ID: "jsmith@localhost",
+				Metadata: map[string]string{
+					"roles":      "authp/user",
+					"realm":      "local",
+					"auth_realm": "local",
+				},
+			},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ar := requests.NewAuthorizationRequest()
+			ar.Response.User = tc.user
+			if tc.token != "" {
+				ar.Token.Found = true
+				ar.Token.Payload = tc.token
+			}
+			got := newAuthorizedUser(ar, tc.mappings)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("newAuthorizedUser() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "secrets",
+		Usage: "encrypt|decrypt|edit --key-file <path> | --key-env <name> [--format <json|yaml|dotenv>]",
+		Short: "Maintains encrypted secrets bundles",
+		Long: `
+Maintains the encrypted secrets bundles read by "secrets encrypted" secrets
+manager. The key is base64-encoded 32-byte key, e.g. the output of
+"openssl rand -base64 32", read from --key-file or --key-env.
+
+The "encrypt" subcommand encrypts the plaintext JSON, YAML, or dotenv file.
+The "decrypt" subcommand prints the plaintext of the bundle. The "edit"
+subcommand opens the plaintext of the bundle in $VISUAL or $EDITOR and
+encrypts it again after the editor exits. The bundle is created when it does
+not exist.
+
+When --format is not set, it is derived from the file extension, e.g.
+"secrets.yaml.enc" holds YAML.`,
+		CobraFunc: func(cmd *cobra.Command) {
+			cmd.PersistentFlags().String("key-file", "", "The file holding the key")
+			cmd.PersistentFlags().String("key-env", "", "The environment variable holding the key")
+			cmd.PersistentFlags().String("format", "", "The format of the plaintext, i.e. json, yaml, or dotenv")
+
+			encryptCmd := &cobra.Command{
+				Use:   "encrypt --input <path> --output <path>",
+				Short: "Encrypts plaintext secrets to a bundle",
+				RunE:  caddycmd.WrapCommandFuncForCobra(cmdSecretsEncrypt),
+			}
+			encryptCmd.Flags().String("input", "-", "The plaintext file, or - for stdin")
+			encryptCmd.Flags().String("output", "-", "The bundle file, or - for stdout")
+
+			decryptCmd := &cobra.Command{
+				Use:   "decrypt --input <path> [--output <path>]",
+				Short: "Decrypts a bundle to plaintext secrets",
+				RunE:  caddycmd.WrapCommandFuncForCobra(cmdSecretsDecrypt),
+			}
+			decryptCmd.Flags().String("input", "", "The bundle file")
+			decryptCmd.Flags().String("output", "-", "The plaintext file, or - for stdout")
+
+			editCmd := &cobra.Command{
+				Use:   "edit <path>",
+				Short: "Edits a bundle in the editor",
+				Args:  cobra.ExactArgs(1),
+				RunE: func(cmd *cobra.Command, args []string) error {
+					cmd.Flags().Set("input", args[0])
+					return caddycmd.WrapCommandFuncForCobra(cmdSecretsEdit)(cmd, args)
+				},
+			}
+			editCmd.Flags().String("input", "", "The bundle file")
+			editCmd.Flags().MarkHidden("input")
+
+			cmd.AddCommand(encryptCmd, decryptCmd, editCmd)
+		},
+	})
+}
+
+func cmdSecretsEncrypt(fl caddycmd.Flags) (int, error) {
+	key, err := loadSecretsBundleKey(fl.String("key-file"), fl.String("key-env"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	input, output := fl.String("input"), fl.String("output")
+	format := getSecretsCommandFormat(fl.String("format"), input, output)
+
+	plaintext, err := readCommandInput(input)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if _, err := parseSecrets(plaintext, format); err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("failed to parse plaintext as %q: %v", format, err)
+	}
+	b, err := encryptSecretsBundle(key, plaintext)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if err := writeCommandOutput(output, b); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdSecretsDecrypt(fl caddycmd.Flags) (int, error) {
+	key, err := loadSecretsBundleKey(fl.String("key-file"), fl.String("key-env"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	input := fl.String("input")
+	if input == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--input is required")
+	}
+	b, err := os.ReadFile(input)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	plaintext, err := decryptSecretsBundle(key, b)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("%q: %v", input, err)
+	}
+	if err := writeCommandOutput(fl.String("output"), plaintext); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdSecretsEdit(fl caddycmd.Flags) (int, error) {
+	key, err := loadSecretsBundleKey(fl.String("key-file"), fl.String("key-env"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	input := fl.String("input")
+	format := getSecretsCommandFormat(fl.String("format"), input, "")
+
+	var plaintext []byte
+	b, err := os.ReadFile(input)
+	switch {
+	case err == nil:
+		if plaintext, err = decryptSecretsBundle(key, b); err != nil {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("%q: %v", input, err)
+		}
+	case os.IsNotExist(err):
+	default:
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	// The plaintext is written to a private directory, and removed after
+	// the editor exits.
+	dir, err := os.MkdirTemp("", "authcrunch-secrets-")
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer os.RemoveAll(dir)
+	fp := filepath.Join(dir, "secrets."+format)
+	if err := os.WriteFile(fp, plaintext, 0o600); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if err := runEditor(fp); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	edited, err := os.ReadFile(fp)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if bytes.Equal(edited, plaintext) && plaintext != nil {
+		fmt.Fprintln(os.Stderr, "no changes")
+		return caddy.ExitCodeSuccess, nil
+	}
+	if _, err := parseSecrets(edited, format); err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("failed to parse edited plaintext as %q, the bundle is unchanged: %v", format, err)
+	}
+	if b, err = encryptSecretsBundle(key, edited); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if err := writeCommandOutput(input, b); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// getSecretsCommandFormat returns the format of the plaintext secrets. When
+// not provided, it is derived from the file names.
+func getSecretsCommandFormat(format string, paths ...string) string {
+	if format != "" {
+		return format
+	}
+	for _, s := range paths {
+		if s == "" || s == "-" {
+			continue
+		}
+		if format := getSecretsBundleFormat(s); format != "" {
+			return format
+		}
+	}
+	return secretsFormatJSON
+}
+
+// runEditor opens the file in $VISUAL or $EDITOR, or vi.
+func runEditor(fp string) error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	args := strings.Fields(editor)
+	cmd := exec.Command(args[0], append(args[1:], fp)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("editor %q failed: %v", editor, err)
+	}
+	return nil
+}
+
+func readCommandInput(s string) ([]byte, error) {
+	if s == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(s)
+}
+
+// writeCommandOutput writes the file via a temporary file, so that the
+// file is either old or new.
+func writeCommandOutput(s string, b []byte) error {
+	if s == "-" {
+		_, err := os.Stdout.Write(b)
+		return err
+	}
+	tmp := s + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s)
+}
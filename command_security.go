@@ -0,0 +1,279 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+const (
+	// defaultBcryptCost is the cost used by the identity stores for the
+	// passwords in plain text. The stores reject the costs below minBcryptCost.
+	defaultBcryptCost = 10
+	minBcryptCost     = 8
+
+	// apiKeyLength is the length of the generated API keys. The first
+	// apiKeyIDLength characters of the key are its id.
+	apiKeyLength   = 72
+	apiKeyIDLength = 24
+	apiKeyCharset  = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "security",
+		Usage: "lint|hash-password|gen-api-key|keys",
+		Short: "Helps maintaining security app configuration",
+		Long: `
+Helps maintaining the configuration of the security app.
+
+The "lint" subcommand adapts the Caddyfile and reports the references to
+undefined authentication portals, authorization policies, identity stores,
+identity providers, messaging providers, and credentials, along with the
+suspicious settings, e.g. the authorization policy without crypto keys
+matching any authentication portal. The command exits with non-zero code
+when it finds errors.
+
+The "hash-password" subcommand reads a password and prints the "password"
+directive of the "user" block of a local identity store, e.g.
+
+  password bcrypt:10:$2a$10$...
+
+The "gen-api-key" subcommand generates an API key and prints the "api key"
+directive of the "user" block, e.g.
+
+  api key <key_id> bcrypt:10:$2a$10$...
+
+The generated key is printed to stderr, and it is not stored anywhere. When
+a key is provided on stdin, the key is hashed instead. The password and the
+key are read from stdin, or from the terminal without echo.
+
+The "keys generate" subcommand writes a token signing key to the directory
+and prints the "crypto key" directives for the authentication portals and
+the authorization policies. The asymmetric keys are written to <kid>.key
+and <kid>.pem files, and the HS512 shared secrets to <kid>.secret file.
+
+The "keys rotate" subcommand writes a new key next to the most recent key
+in the directory. The portals sign the tokens with the new key and verify
+the tokens signed with the previous key, so that the issued tokens keep
+validating during the transition.`,
+		CobraFunc: func(cmd *cobra.Command) {
+			lintCmd := &cobra.Command{
+				Use:   "lint [--config <path>]",
+				Short: "Reports dangling references and suspicious settings",
+				RunE:  caddycmd.WrapCommandFuncForCobra(cmdSecurityLint),
+			}
+			lintCmd.Flags().StringP("config", "c", "Caddyfile", "The Caddyfile to lint")
+
+			hashPasswordCmd := &cobra.Command{
+				Use:   "hash-password [--cost <cost>]",
+				Short: "Prints bcrypt hash of a password for local identity store",
+				RunE:  caddycmd.WrapCommandFuncForCobra(cmdSecurityHashPassword),
+			}
+			hashPasswordCmd.Flags().Int("cost", defaultBcryptCost, "The bcrypt cost")
+
+			genAPIKeyCmd := &cobra.Command{
+				Use:   "gen-api-key [--cost <cost>]",
+				Short: "Generates an API key for local identity store",
+				RunE:  caddycmd.WrapCommandFuncForCobra(cmdSecurityGenAPIKey),
+			}
+			genAPIKeyCmd.Flags().Int("cost", defaultBcryptCost, "The bcrypt cost")
+
+			keysCmd := &cobra.Command{
+				Use:   "keys generate|rotate",
+				Short: "Generates and rotates token signing keys",
+			}
+			keysCmd.PersistentFlags().String("dir", ".", "The directory holding the keys")
+			keysCmd.PersistentFlags().String("kid", "", "The id of the new key, defaults to current time")
+			keysCmd.PersistentFlags().String("alg", "", "The algorithm of the new key, i.e. ES256, ES384, ES512, RS256, or HS512")
+			keysCmd.AddCommand(
+				&cobra.Command{
+					Use:   "generate [--alg <alg>] [--dir <path>] [--kid <id>]",
+					Short: "Generates a token signing key",
+					RunE:  caddycmd.WrapCommandFuncForCobra(cmdSecurityKeysGenerate),
+				},
+				&cobra.Command{
+					Use:   "rotate [--dir <path>] [--kid <id>]",
+					Short: "Adds a new token signing key next to the most recent one",
+					RunE:  caddycmd.WrapCommandFuncForCobra(cmdSecurityKeysRotate),
+				},
+			)
+
+			cmd.AddCommand(lintCmd, hashPasswordCmd, genAPIKeyCmd, keysCmd)
+		},
+	})
+}
+
+func cmdSecurityLint(fl caddycmd.Flags) (int, error) {
+	filename := fl.String("config")
+	body, err := os.ReadFile(filename)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	findings, err := lintCaddyfile(filename, body)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	var errCount int
+	for _, f := range findings {
+		if f.Severity == lintError {
+			errCount++
+		}
+		fmt.Println(f.String())
+	}
+	if errCount > 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("found %d errors and %d warnings", errCount, len(findings)-errCount)
+	}
+	fmt.Fprintf(os.Stderr, "found %d warnings\n", len(findings))
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdSecurityHashPassword(fl caddycmd.Flags) (int, error) {
+	password, err := readCommandSecret("Password: ", true)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if len(password) == 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("password is empty")
+	}
+	s, err := getPasswordDirective(password, fl.Int("cost"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	fmt.Println(s)
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdSecurityGenAPIKey(fl caddycmd.Flags) (int, error) {
+	key, err := readCommandSecret("API key (empty to generate): ", false)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if len(key) == 0 {
+		if key, err = generateAPIKey(); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		fmt.Fprintf(os.Stderr, "API key: %s\n", key)
+	}
+	s, err := getAPIKeyDirective(key, fl.Int("cost"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	fmt.Println(s)
+	return caddy.ExitCodeSuccess, nil
+}
+
+// getPasswordDirective returns the "password" directive with the bcrypt hash
+// of the password.
+func getPasswordDirective(password []byte, cost int) (string, error) {
+	hash, err := hashBcrypt(password, cost)
+	if err != nil {
+		return "", err
+	}
+	return "password " + hash, nil
+}
+
+// getAPIKeyDirective returns the "api key" directive with the bcrypt hash of
+// the key. The identity stores look up the keys by their first characters.
+func getAPIKeyDirective(key []byte, cost int) (string, error) {
+	if len(key) < 64 || len(key) > apiKeyLength {
+		return "", fmt.Errorf("api key must be 64 to %d characters long, got %d", apiKeyLength, len(key))
+	}
+	for _, c := range key {
+		if !strings.ContainsRune(apiKeyCharset, rune(c)) {
+			return "", fmt.Errorf("api key must contain letters and digits only")
+		}
+	}
+	hash, err := hashBcrypt(key, cost)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("api key %s %s", key[:apiKeyIDLength], hash), nil
+}
+
+// hashBcrypt returns the hash in "bcrypt:<cost>:<hash>" form.
+func hashBcrypt(b []byte, cost int) (string, error) {
+	if cost < minBcryptCost || cost > bcrypt.MaxCost {
+		return "", fmt.Errorf("bcrypt cost must be between %d and %d, got %d", minBcryptCost, bcrypt.MaxCost, cost)
+	}
+	hash, err := bcrypt.GenerateFromPassword(b, cost)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("bcrypt:%d:%s", cost, hash), nil
+}
+
+func generateAPIKey() ([]byte, error) {
+	key := make([]byte, apiKeyLength)
+	max := big.NewInt(int64(len(apiKeyCharset)))
+	for i := range key {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return nil, err
+		}
+		key[i] = apiKeyCharset[n.Int64()]
+	}
+	return key, nil
+}
+
+// readCommandSecret reads the secret from the terminal without echo, or the
+// first line of stdin.
+func readCommandSecret(prompt string, confirm bool) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return readSecretLine(os.Stdin)
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	b, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if confirm && len(b) > 0 {
+		fmt.Fprint(os.Stderr, "Confirm "+strings.ToLower(prompt[:1])+prompt[1:])
+		c, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(b, c) {
+			return nil, fmt.Errorf("entries do not match")
+		}
+	}
+	return b, nil
+}
+
+// readSecretLine returns the first line of the input without the line
+// ending.
+func readSecretLine(r io.Reader) ([]byte, error) {
+	b, err := bufio.NewReader(r).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return bytes.TrimRight(b, "\r\n"), nil
+}
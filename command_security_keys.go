@@ -0,0 +1,288 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+)
+
+const (
+	defaultKeyAlgorithm = "ES256"
+
+	privateKeyExt = ".key"
+	publicKeyExt  = ".pem"
+	secretKeyExt  = ".secret"
+)
+
+var keyIDRegexPattern = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// signingKey is a signing key written by "security keys" command.
+type signingKey struct {
+	ID        string
+	Algorithm string
+	// Path is the file holding either the private key or the shared secret.
+	Path string
+	// PublicPath is the file holding the public key of asymmetric keys.
+	PublicPath string
+	modTime    time.Time
+}
+
+func cmdSecurityKeysGenerate(fl caddycmd.Flags) (int, error) {
+	dir := fl.String("dir")
+	alg := fl.String("alg")
+	if alg == "" {
+		alg = defaultKeyAlgorithm
+	}
+	key, err := generateSigningKey(dir, getSigningKeyID(fl.String("kid")), alg)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	fmt.Print(getSigningKeysSnippet([]*signingKey{key}))
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdSecurityKeysRotate(fl caddycmd.Flags) (int, error) {
+	dir := fl.String("dir")
+	keys, err := findSigningKeys(dir)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if len(keys) == 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("no keys found in %q, see \"keys generate\"", dir)
+	}
+	alg := fl.String("alg")
+	if alg == "" {
+		alg = keys[0].Algorithm
+	}
+	key, err := generateSigningKey(dir, getSigningKeyID(fl.String("kid")), alg)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	fmt.Print(getSigningKeysSnippet([]*signingKey{key, keys[0]}))
+	return caddy.ExitCodeSuccess, nil
+}
+
+// getSigningKeyID returns the key id. By default, the id is the current
+// time, so that the ids of the rotated keys are ordered.
+func getSigningKeyID(s string) string {
+	if s != "" {
+		return s
+	}
+	return time.Now().UTC().Format("20060102150405")
+}
+
+// generateSigningKey writes the key files to the directory.
+func generateSigningKey(dir, kid, alg string) (*signingKey, error) {
+	if !keyIDRegexPattern.MatchString(kid) {
+		return nil, fmt.Errorf("key id %q must contain lowercase letters, digits, dashes, and underscores only", kid)
+	}
+	switch kid {
+	case "crypto", "key", "sign", "verify", "sign-verify", "auto", "system", "token", "from", "env", "as", "default":
+		return nil, fmt.Errorf("key id %q is a reserved keyword", kid)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &signingKey{ID: kid, Algorithm: alg}
+	var privBlock *pem.Block
+	var pub interface{}
+	switch alg {
+	case "HS512":
+		secret := make([]byte, 64)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		key.Path = filepath.Join(dir, kid+secretKeyExt)
+		if err := writeKeyFile(key.Path, []byte(hex.EncodeToString(secret)), 0o600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	case "ES256", "ES384", "ES512":
+		curve := map[string]elliptic.Curve{"ES256": elliptic.P256(), "ES384": elliptic.P384(), "ES512": elliptic.P521()}[alg]
+		priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		privBlock, pub = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}, &priv.PublicKey
+	case "RS256":
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		privBlock, pub = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}, &priv.PublicKey
+	case "EdDSA":
+		return nil, fmt.Errorf("EdDSA keys are not supported by the crypto key store, use ES256 instead")
+	default:
+		return nil, fmt.Errorf("unsupported key algorithm %q, expected ES256, ES384, ES512, RS256, or HS512", alg)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	key.Path = filepath.Join(dir, kid+privateKeyExt)
+	key.PublicPath = filepath.Join(dir, kid+publicKeyExt)
+	if err := writeKeyFile(key.Path, pem.EncodeToMemory(privBlock), 0o600); err != nil {
+		return nil, err
+	}
+	if err := writeKeyFile(key.PublicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o644); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// writeKeyFile writes the file, unless it exists.
+func writeKeyFile(fp string, b []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(fp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// findSigningKeys returns the keys in the directory, the most recent first.
+func findSigningKeys(dir string) ([]*signingKey, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := []*signingKey{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		ext := filepath.Ext(entry.Name())
+		if ext != privateKeyExt && ext != secretKeyExt {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		key := &signingKey{
+			ID:      strings.TrimSuffix(entry.Name(), ext),
+			Path:    filepath.Join(dir, entry.Name()),
+			modTime: fi.ModTime(),
+		}
+		if ext == secretKeyExt {
+			key.Algorithm = "HS512"
+			keys = append(keys, key)
+			continue
+		}
+		if key.Algorithm, err = getSigningKeyAlgorithm(key.Path); err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(filepath.Join(dir, key.ID+publicKeyExt)); err == nil {
+			key.PublicPath = filepath.Join(dir, key.ID+publicKeyExt)
+		}
+		keys = append(keys, key)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		if !keys[i].modTime.Equal(keys[j].modTime) {
+			return keys[i].modTime.After(keys[j].modTime)
+		}
+		return keys[i].ID > keys[j].ID
+	})
+	return keys, nil
+}
+
+// getSigningKeyAlgorithm returns the algorithm of the private key file.
+func getSigningKeyAlgorithm(fp string) (string, error) {
+	b, err := os.ReadFile(fp)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return "", fmt.Errorf("%q has no PEM data", fp)
+	}
+	if priv, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		switch priv.Curve.Params().BitSize {
+		case 384:
+			return "ES384", nil
+		case 521:
+			return "ES512", nil
+		default:
+			return "ES256", nil
+		}
+	}
+	if _, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return "RS256", nil
+	}
+	return "", fmt.Errorf("%q has unsupported key", fp)
+}
+
+// getSigningKeysSnippet returns the "crypto key" directives for the
+// authentication portals and the authorization policies. The portals sign
+// tokens with the first key. The other keys verify the tokens issued
+// before the rotation.
+func getSigningKeysSnippet(keys []*signingKey) string {
+	var portal, policy strings.Builder
+	for i, key := range keys {
+		usage := "verify"
+		if i == 0 {
+			usage = "sign-verify"
+		}
+		if key.Algorithm == "HS512" {
+			fmt.Fprintf(&portal, "crypto key %s %s {file.%s}\n", key.ID, usage, key.Path)
+			fmt.Fprintf(&policy, "crypto key %s verify {file.%s}\n", key.ID, key.Path)
+			continue
+		}
+		pub := key.PublicPath
+		if pub == "" {
+			pub = key.Path
+		}
+		if i == 0 {
+			fmt.Fprintf(&portal, "crypto key %s sign-verify from file %s\n", key.ID, key.Path)
+		} else {
+			fmt.Fprintf(&portal, "crypto key %s verify from file %s\n", key.ID, pub)
+		}
+		fmt.Fprintf(&policy, "crypto key %s verify from file %s\n", key.ID, pub)
+	}
+	return "# authentication portal\n" + portal.String() + "\n# authorization policy\n" + policy.String()
+}
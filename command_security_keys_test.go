@@ -0,0 +1,169 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/google/go-cmp/cmp"
+	"github.com/greenpau/go-authcrunch/pkg/kms"
+	"go.uber.org/zap"
+)
+
+func TestGenerateSigningKey(t *testing.T) {
+	testcases := []struct {
+		name      string
+		kid       string
+		alg       string
+		shouldErr bool
+		err       string
+	}{
+		{name: "test ES256 key", kid: "k1", alg: "ES256"},
+		{name: "test ES512 key", kid: "k1", alg: "ES512"},
+		{name: "test RS256 key", kid: "k1", alg: "RS256"},
+		{name: "test HS512 key", kid: "k1", alg: "HS512"},
+		{
+			name:      "test EdDSA key",
+			kid:       "k1",
+			alg:       "EdDSA",
+			shouldErr: true,
+			err:       "EdDSA keys are not supported by the crypto key store, use ES256 instead",
+		},
+		{
+			name:      "test invalid key id",
+			kid:       "K 1",
+			alg:       "ES256",
+			shouldErr: true,
+			err:       `key id "K 1" must contain lowercase letters, digits, dashes, and underscores only`,
+		},
+		{
+			name:      "test reserved key id",
+			kid:       "verify",
+			alg:       "ES256",
+			shouldErr: true,
+			err:       `key id "verify" is a reserved keyword`,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			key, err := generateSigningKey(dir, tc.kid, tc.alg)
+			if err != nil {
+				if !tc.shouldErr {
+					t.Fatalf("expected success, got: %v", err)
+				}
+				if diff := cmp.Diff(tc.err, err.Error()); diff != "" {
+					t.Fatalf("unexpected error mismatch (-want +got):\n%s", diff)
+				}
+				return
+			}
+			if tc.shouldErr {
+				t.Fatalf("unexpected success, want: %v", tc.err)
+			}
+
+			keys, err := findSigningKeys(dir)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(keys) != 1 {
+				t.Fatalf("unexpected number of keys: %d", len(keys))
+			}
+			got := map[string]string{"id": keys[0].ID, "alg": keys[0].Algorithm, "path": keys[0].Path, "public": keys[0].PublicPath}
+			want := map[string]string{"id": key.ID, "alg": key.Algorithm, "path": key.Path, "public": key.PublicPath}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("findSigningKeys() mismatch (-want +got):\n%s", diff)
+			}
+
+			portal, policy := loadSigningKeysSnippet(t, getSigningKeysSnippet(keys))
+			if err := portal.HasSignKeys(); err != nil {
+				t.Errorf("portal has no sign keys: %v", err)
+			}
+			if err := policy.HasVerifyKeys(); err != nil {
+				t.Errorf("policy has no verify keys: %v", err)
+			}
+		})
+	}
+}
+
+func TestRotateSigningKey(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := generateSigningKey(dir, "k1", "ES256"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keys, err := findSigningKeys(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	key, err := generateSigningKey(dir, "k2", keys[0].Algorithm)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := generateSigningKey(dir, "k2", "ES256"); err == nil {
+		t.Fatalf("expected error when overwriting existing key")
+	}
+
+	snippet := getSigningKeysSnippet([]*signingKey{key, keys[0]})
+	want := "# authentication portal\n" +
+		"crypto key k2 sign-verify from file " + dir + "/k2.key\n" +
+		"crypto key k1 verify from file " + dir + "/k1.pem\n" +
+		"\n" +
+		"# authorization policy\n" +
+		"crypto key k2 verify from file " + dir + "/k2.pem\n" +
+		"crypto key k1 verify from file " + dir + "/k1.pem\n"
+	if diff := cmp.Diff(want, snippet); diff != "" {
+		t.Errorf("getSigningKeysSnippet() mismatch (-want +got):\n%s", diff)
+	}
+
+	portal, policy := loadSigningKeysSnippet(t, snippet)
+	signKeys := portal.GetSignKeys()
+	if len(signKeys) != 1 || signKeys[0].Config.ID != "k2" {
+		t.Errorf("portal must sign with the new key")
+	}
+	if n := len(policy.GetVerifyKeys()); n != 2 {
+		t.Errorf("policy must verify with both keys, got %d keys", n)
+	}
+}
+
+// loadSigningKeysSnippet returns the key stores of the portal and the policy.
+func loadSigningKeysSnippet(t *testing.T, snippet string) (*kms.CryptoKeyStore, *kms.CryptoKeyStore) {
+	t.Helper()
+	repl := caddy.NewReplacer()
+	sections := strings.Split(snippet, "\n\n")
+	if len(sections) != 2 {
+		t.Fatalf("unexpected snippet: %s", snippet)
+	}
+	var stores []*kms.CryptoKeyStore
+	for _, section := range sections {
+		var lines []string
+		for _, line := range strings.Split(section, "\n") {
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			lines = append(lines, repl.ReplaceKnown(line, ""))
+		}
+		cfg, err := kms.NewCryptoKeyStoreConfig(lines)
+		if err != nil {
+			t.Fatalf("unexpected config error: %v", err)
+		}
+		ks, err := kms.NewCryptoKeyStore(cfg, zap.NewNop())
+		if err != nil {
+			t.Fatalf("unexpected key store error: %v\n%s", err, strings.Join(lines, "\n"))
+		}
+		stores = append(stores, ks)
+	}
+	return stores[0], stores[1]
+}
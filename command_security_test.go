@@ -0,0 +1,139 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/greenpau/go-authcrunch/pkg/identity"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestGetSecretDirectives(t *testing.T) {
+	apiKey, err := generateAPIKey()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	testcases := []struct {
+		name       string
+		directive  func([]byte, int) (string, error)
+		secret     string
+		cost       int
+		wantPrefix string
+		shouldErr  bool
+		err        string
+	}{
+		{
+			name:       "test password",
+			directive:  getPasswordDirective,
+			secret:     "My@Password123",
+			cost:       defaultBcryptCost,
+			wantPrefix: "password bcrypt:10:",
+		},
+		{
+			name:       "test password with custom cost",
+			directive:  getPasswordDirective,
+			secret:     "My@Password123",
+			cost:       8,
+			wantPrefix: "password bcrypt:8:",
+		},
+		{
+			name:      "test password with low cost",
+			directive: getPasswordDirective,
+			secret:    "My@Password123",
+			cost:      4,
+			shouldErr: true,
+			err:       "bcrypt cost must be between 8 and 31, got 4",
+		},
+		{
+			name:       "test generated api key",
+			directive:  getAPIKeyDirective,
+			secret:     string(apiKey),
+			cost:       defaultBcryptCost,
+			wantPrefix: "api key " + string(apiKey[:24]) + " bcrypt:10:",
+		},
+		{
+			name:      "test short api key",
+			directive: getAPIKeyDirective,
+			secret:    "foobar",
+			cost:      defaultBcryptCost,
+			shouldErr: true,
+			err:       "api key must be 64 to 72 characters long, got 6",
+		},
+		{
+			name:      "test api key with special characters",
+			directive: getAPIKeyDirective,
+			secret:    strings.Repeat("a", 63) + "!",
+			cost:      defaultBcryptCost,
+			shouldErr: true,
+			err:       "api key must contain letters and digits only",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.directive([]byte(tc.secret), tc.cost)
+			if err != nil {
+				if !tc.shouldErr {
+					t.Fatalf("expected success, got: %v", err)
+				}
+				if diff := cmp.Diff(tc.err, err.Error()); diff != "" {
+					t.Fatalf("unexpected error mismatch (-want +got):\n%s", diff)
+				}
+				return
+			}
+			if tc.shouldErr {
+				t.Fatalf("unexpected success, want: %v", tc.err)
+			}
+			if !strings.HasPrefix(got, tc.wantPrefix) {
+				t.Fatalf("unexpected directive: got %q, want %q prefix", got, tc.wantPrefix)
+			}
+			args := strings.Fields(got)
+			p, err := identity.ParseHashedPassword(args[len(args)-1])
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := bcrypt.CompareHashAndPassword([]byte(p.Hash), []byte(tc.secret)); err != nil {
+				t.Errorf("hash does not match the secret: %v", err)
+			}
+		})
+	}
+}
+
+func TestReadSecretLine(t *testing.T) {
+	testcases := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "test line", input: "foo\n", want: "foo"},
+		{name: "test line with carriage return", input: "foo\r\nbar\n", want: "foo"},
+		{name: "test input without line ending", input: "foo bar", want: "foo bar"},
+		{name: "test empty input", input: "", want: ""},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := readSecretLine(strings.NewReader(tc.input))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, string(got)); diff != "" {
+				t.Errorf("readSecretLine() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"net/http"
+
+	"github.com/greenpau/go-authcrunch/pkg/authz"
+)
+
+// defaultClaimHeaders are the headers injected by the gatekeeper when the
+// policy passes claims with headers.
+var defaultClaimHeaders = []string{
+	"X-Token-User-Name",
+	"X-Token-User-Email",
+	"X-Token-User-Roles",
+	"X-Token-Subject",
+}
+
+// getUntrustedHeaders returns the headers removed from the incoming requests
+// before the authorization. These are the headers the policy may inject and
+// the headers the policy strips explicitly. Otherwise, the client could
+// supply the header the policy skips, e.g. when the token has no claim.
+func getUntrustedHeaders(p *authz.PolicyConfig, ext *AuthorizationPolicyExtension) []string {
+	var headers []string
+	if p != nil {
+		if p.PassClaimsWithHeaders {
+			headers = append(headers, defaultClaimHeaders...)
+		}
+		for _, entry := range p.HeaderInjectionConfigs {
+			headers = append(headers, entry.Header)
+		}
+	}
+	for _, t := range ext.HeaderTemplates {
+		headers = append(headers, t.Header)
+	}
+	if ext.SignedAssertion != nil {
+		headers = append(headers, ext.SignedAssertion.Header)
+	}
+	headers = append(headers, ext.StripHeaders...)
+
+	seen := make(map[string]bool)
+	var untrusted []string
+	for _, k := range headers {
+		k = http.CanonicalHeaderKey(k)
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		untrusted = append(untrusted, k)
+	}
+	return untrusted
+}
+
+func stripUntrustedHeaders(r *http.Request, headers []string) {
+	for _, k := range headers {
+		r.Header.Del(k)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/greenpau/go-authcrunch/pkg/authz"
+	"github.com/greenpau/go-authcrunch/pkg/authz/injector"
+)
+
+func TestStripUntrustedHeaders(t *testing.T) {
+	testcases := []struct {
+		name   string
+		policy *authz.PolicyConfig
+		ext    *AuthorizationPolicyExtension
+		want   []string
+	}{
+		{
+			name:   "test policy without injected headers",
+			policy: &authz.PolicyConfig{},
+			ext:    &AuthorizationPolicyExtension{},
+			want:   []string{"X-Email", "X-Forwarded-User", "X-Other", "X-Token-Subject", "X-Token-User-Email", "X-User"},
+		},
+		{
+			name: "test policy with injected headers",
+			policy: &authz.PolicyConfig{
+				PassClaimsWithHeaders: true,
+				HeaderInjectionConfigs: []*injector.Config{
+					{Header: "x-email", Field: "email"},
+				},
+			},
+			ext: &AuthorizationPolicyExtension{
+				HeaderTemplates: []*HeaderTemplate{
+					{Header: "X-User", Template: "{claims.email}"},
+				},
+				StripHeaders: []string{"X-Forwarded-User", "x-email"},
+			},
+			want: []string{"X-Other"},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "https://app.example.com/", nil)
+			for _, k := range []string{"X-Email", "X-Forwarded-User", "X-Other", "X-Token-Subject", "X-Token-User-Email", "X-User"} {
+				r.Header.Set(k, "spoofed")
+			}
+			stripUntrustedHeaders(r, getUntrustedHeaders(tc.policy, tc.ext))
+			got := []string{}
+			for k := range r.Header {
+				got = append(got, k)
+			}
+			sort.Strings(got)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("stripUntrustedHeaders() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestGetUntrustedHeaders(t *testing.T) {
+	p := &authz.PolicyConfig{
+		PassClaimsWithHeaders: true,
+		HeaderInjectionConfigs: []*injector.Config{
+			{Header: "X-Token-User-Email", Field: "email"},
+		},
+	}
+	ext := &AuthorizationPolicyExtension{StripHeaders: []string{"x-forwarded-user"}}
+	want := []string{
+		"X-Token-User-Name",
+		"X-Token-User-Email",
+		"X-Token-User-Roles",
+		"X-Token-Subject",
+		http.CanonicalHeaderKey("x-forwarded-user"),
+	}
+	if diff := cmp.Diff(want, getUntrustedHeaders(p, ext)); diff != "" {
+		t.Errorf("getUntrustedHeaders() mismatch (-want +got):\n%s", diff)
+	}
+}
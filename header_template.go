@@ -0,0 +1,301 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/greenpau/go-authcrunch/pkg/requests"
+)
+
+const headerTemplatePrefix = "{claims."
+
+// HeaderTemplate injects a header rendered from the claims of an authorized
+// request. The template holds the text and the claim placeholders, e.g.
+//
+//	{claims.email}|{claims.realm}
+//	{claims.roles|join:,}
+//	{claims.email,name,roles|json|base64url}
+//	{claims.tenant.id|default:none}
+//
+// The placeholder with multiple comma-separated paths renders the object
+// holding the found claims. The filters are applied in order:
+//
+//	json          encodes the value in JSON
+//	base64url     encodes the value in unpadded base64url
+//	csv           encodes the list in a CSV record
+//	url-escape    escapes the value for a URL query
+//	join:<sep>    joins the list with the separator
+//	default:<v>   substitutes the value of a missing claim
+//
+// The backslash escapes "|" and "}" in the filter arguments. The header is
+// not injected when a claim without a default value is missing.
+type HeaderTemplate struct {
+	Header   string `json:"header,omitempty" xml:"header,omitempty" yaml:"header,omitempty"`
+	Template string `json:"template,omitempty" xml:"template,omitempty" yaml:"template,omitempty"`
+	parts    []*headerTemplatePart
+}
+
+// headerTemplatePart is either the text or the placeholder of a template.
+type headerTemplatePart struct {
+	text    string
+	paths   []string
+	filters []*headerTemplateFilter
+}
+
+type headerTemplateFilter struct {
+	name string
+	arg  string
+}
+
+// Validate validates HeaderTemplate.
+func (t *HeaderTemplate) Validate() error {
+	t.Header = strings.TrimSpace(t.Header)
+	if t.Header == "" {
+		return fmt.Errorf("undefined header name")
+	}
+	if t.Template == "" {
+		return fmt.Errorf("header %q template is empty", t.Header)
+	}
+	parts, err := parseHeaderTemplate(t.Template)
+	if err != nil {
+		return fmt.Errorf("header %q template is malformed: %v", t.Header, err)
+	}
+	t.parts = parts
+	return nil
+}
+
+func parseHeaderTemplate(s string) ([]*headerTemplatePart, error) {
+	var parts []*headerTemplatePart
+	var text strings.Builder
+	for len(s) > 0 {
+		i := strings.Index(s, headerTemplatePrefix)
+		if i < 0 {
+			text.WriteString(s)
+			break
+		}
+		text.WriteString(s[:i])
+		s = s[i+len(headerTemplatePrefix):]
+
+		// Split the placeholder at the unescaped pipes up to the closing brace.
+		var segments []string
+		var segment strings.Builder
+		closed := false
+		for j := 0; j < len(s); j++ {
+			c := s[j]
+			if c == '\\' && j+1 < len(s) && (s[j+1] == '|' || s[j+1] == '}' || s[j+1] == '\\') {
+				segment.WriteByte(s[j+1])
+				j++
+				continue
+			}
+			if c == '|' || c == '}' {
+				segments = append(segments, segment.String())
+				segment.Reset()
+			} else {
+				segment.WriteByte(c)
+			}
+			if c == '}' {
+				s = s[j+1:]
+				closed = true
+				break
+			}
+		}
+		if !closed {
+			return nil, fmt.Errorf("placeholder is not closed")
+		}
+
+		part := &headerTemplatePart{}
+		for _, p := range strings.Split(segments[0], ",") {
+			p = strings.TrimSpace(p)
+			if p == "" {
+				return nil, fmt.Errorf("placeholder has empty claim path")
+			}
+			part.paths = append(part.paths, p)
+		}
+		for _, segment := range segments[1:] {
+			filter := &headerTemplateFilter{}
+			filter.name, filter.arg, _ = strings.Cut(segment, ":")
+			switch filter.name {
+			case "json", "base64url", "csv", "url-escape":
+				if filter.arg != "" {
+					return nil, fmt.Errorf("filter %q has unexpected argument", filter.name)
+				}
+			case "join":
+				if filter.arg == "" {
+					return nil, fmt.Errorf("filter %q has no separator", filter.name)
+				}
+			case "default":
+			default:
+				return nil, fmt.Errorf("unsupported %q filter", filter.name)
+			}
+			part.filters = append(part.filters, filter)
+		}
+
+		if text.Len() > 0 {
+			parts = append(parts, &headerTemplatePart{text: text.String()})
+			text.Reset()
+		}
+		parts = append(parts, part)
+	}
+	if text.Len() > 0 {
+		parts = append(parts, &headerTemplatePart{text: text.String()})
+	}
+	return parts, nil
+}
+
+// Render returns the header value rendered from the claims. The claims are
+// looked up in the provided maps in order.
+func (t *HeaderTemplate) Render(claims ...map[string]interface{}) (string, bool) {
+	var sb strings.Builder
+	for _, part := range t.parts {
+		if part.paths == nil {
+			sb.WriteString(part.text)
+			continue
+		}
+		s, ok := part.render(claims)
+		if !ok {
+			return "", false
+		}
+		sb.WriteString(s)
+	}
+	s := sb.String()
+	if strings.ContainsAny(s, "\r\n") {
+		return "", false
+	}
+	return s, true
+}
+
+func (part *headerTemplatePart) render(claims []map[string]interface{}) (string, bool) {
+	var v interface{}
+	var found bool
+	if len(part.paths) == 1 {
+		v, found = lookupClaimValue(claims, part.paths[0])
+	} else {
+		subset := make(map[string]interface{})
+		for _, p := range part.paths {
+			if entry, exists := lookupClaimValue(claims, p); exists {
+				subset[p] = entry
+			}
+		}
+		v, found = subset, len(subset) > 0
+	}
+	for _, filter := range part.filters {
+		if filter.name == "default" {
+			if !found {
+				v, found = filter.arg, true
+			}
+			continue
+		}
+		if !found {
+			continue
+		}
+		s, ok := filter.apply(v)
+		if !ok {
+			return "", false
+		}
+		v = s
+	}
+	if !found {
+		return "", false
+	}
+	return claimValueToString(v)
+}
+
+func (filter *headerTemplateFilter) apply(v interface{}) (string, bool) {
+	switch filter.name {
+	case "json":
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", false
+		}
+		return string(b), true
+	case "base64url":
+		s, ok := claimValueToString(v)
+		if !ok {
+			return "", false
+		}
+		return base64.RawURLEncoding.EncodeToString([]byte(s)), true
+	case "url-escape":
+		s, ok := claimValueToString(v)
+		if !ok {
+			return "", false
+		}
+		return url.QueryEscape(s), true
+	case "csv":
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		if err := w.Write(claimValueToList(v)); err != nil {
+			return "", false
+		}
+		w.Flush()
+		return strings.TrimRight(buf.String(), "\r\n"), true
+	case "join":
+		return strings.Join(claimValueToList(v), filter.arg), true
+	}
+	return "", false
+}
+
+// claimValueToList converts a claim value to the list of strings. The
+// string values are split by spaces, like roles.
+func claimValueToList(data interface{}) []string {
+	switch v := data.(type) {
+	case string:
+		return strings.Fields(v)
+	case []string:
+		return v
+	case []interface{}:
+		entries := make([]string, 0, len(v))
+		for _, entry := range v {
+			if s, ok := claimValueToString(entry); ok {
+				entries = append(entries, s)
+			}
+		}
+		return entries
+	}
+	if s, ok := claimValueToString(data); ok {
+		return []string{s}
+	}
+	return nil
+}
+
+func lookupClaimValue(claims []map[string]interface{}, path string) (interface{}, bool) {
+	for _, data := range claims {
+		if v, found := getClaimValue(data, path); found && v != nil {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// injectHeaderTemplates sets the headers rendered from the claims of the
+// authorized request.
+func injectHeaderTemplates(r *http.Request, ar *requests.AuthorizationRequest, templates []*HeaderTemplate) {
+	if len(templates) == 0 {
+		return
+	}
+	claims := getTokenClaims(ar)
+	for _, t := range templates {
+		if v, ok := t.Render(claims, ar.Response.User); ok {
+			r.Header.Set(t.Header, v)
+		}
+	}
+}
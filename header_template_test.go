@@ -0,0 +1,150 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHeaderTemplateRender(t *testing.T) {
+	claims := map[string]interface{}{
+		"email": "jsmith@example.com",
+		"name":  "John Smith",
+		"roles": []interface{}{"authp/admin", "authp/user"},
+		"tenant": map[string]interface{}{
+			"id": json.Number("42"),
+		},
+	}
+	user := map[string]interface{}{
+		"email": "jsmith@example.com",
+		"realm": "local",
+	}
+
+	testcases := []struct {
+		name      string
+		template  string
+		want      string
+		missing   bool
+		shouldErr bool
+		err       string
+	}{
+		{
+			name:     "test composite claims",
+			template: "{claims.email}|{claims.realm}",
+			want:     "jsmith@example.com|local",
+		},
+		{
+			name:     "test roles joined with delimiter",
+			template: "{claims.roles|join:,}",
+			want:     "authp/admin,authp/user",
+		},
+		{
+			name:     "test roles joined with escaped pipe",
+			template: `{claims.roles|join:\|}`,
+			want:     "authp/admin|authp/user",
+		},
+		{
+			name:     "test json subset of claims",
+			template: "{claims.email,roles,tenant.id|json}",
+			want:     `{"email":"jsmith@example.com","roles":["authp/admin","authp/user"],"tenant.id":42}`,
+		},
+		{
+			name:     "test base64url encoded subset of claims",
+			template: "{claims.email,realm|json|base64url}",
+			want:     "eyJlbWFpbCI6ImpzbWl0aEBleGFtcGxlLmNvbSIsInJlYWxtIjoibG9jYWwifQ",
+		},
+		{
+			name:     "test csv encoded claims",
+			template: "{claims.roles|csv};{claims.name|csv}",
+			want:     "authp/admin,authp/user;John,Smith",
+		},
+		{
+			name:     "test url escaped claim",
+			template: "name={claims.name|url-escape}",
+			want:     "name=John+Smith",
+		},
+		{
+			name:     "test nested claim",
+			template: "tenant-{claims.tenant.id}",
+			want:     "tenant-42",
+		},
+		{
+			name:     "test default value for missing claim",
+			template: "{claims.org|default:none}/{claims.email}",
+			want:     "none/jsmith@example.com",
+		},
+		{
+			name:     "test default value is encoded",
+			template: "{claims.org|default:acme corp|url-escape}",
+			want:     "acme+corp",
+		},
+		{
+			name:     "test missing claim without default value",
+			template: "{claims.org}/{claims.email}",
+			missing:  true,
+		},
+		{
+			name:     "test text with braces",
+			template: "{email} {claims.email}",
+			want:     "{email} jsmith@example.com",
+		},
+		{
+			name:      "test unclosed placeholder",
+			template:  "{claims.email",
+			shouldErr: true,
+			err:       `header "X-User" template is malformed: placeholder is not closed`,
+		},
+		{
+			name:      "test join without separator",
+			template:  "{claims.roles|join}",
+			shouldErr: true,
+			err:       `header "X-User" template is malformed: filter "join" has no separator`,
+		},
+		{
+			name:      "test empty claim path",
+			template:  "{claims.email,}",
+			shouldErr: true,
+			err:       `header "X-User" template is malformed: placeholder has empty claim path`,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ht := &HeaderTemplate{Header: "X-User", Template: tc.template}
+			err := ht.Validate()
+			if err != nil {
+				if !tc.shouldErr {
+					t.Fatalf("expected success, got: %v", err)
+				}
+				if diff := cmp.Diff(tc.err, err.Error()); diff != "" {
+					t.Fatalf("unexpected error mismatch (-want +got):\n%s", diff)
+				}
+				return
+			}
+			if tc.shouldErr {
+				t.Fatalf("unexpected success, want: %v", tc.err)
+			}
+			got, ok := ht.Render(claims, user)
+			if ok == tc.missing {
+				t.Fatalf("unexpected render result: %q, %v", got, ok)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Render() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	outcomeAudited    = "audited"
+	outcomeAuthorized = "authorized"
+	outcomeBypassed   = "bypassed"
+	outcomeDenied     = "denied"
+	outcomeError      = "error"
+)
+
+// unknownRealm is the realm label of the realms not configured in portals.
+const unknownRealm = "unknown"
+
+// securityMetrics holds the counters and histograms of authentication
+// and authorization outcomes. The collectors are shared by all app
+// instances, so that the counters survive config reloads.
+var securityMetrics = struct {
+	once          sync.Once
+	authnRequests *prometheus.CounterVec
+	authnDuration *prometheus.HistogramVec
+	authzRequests *prometheus.CounterVec
+	authzDuration *prometheus.HistogramVec
+	auditDenials  *prometheus.CounterVec
+}{}
+
+func initSecurityMetrics(registry *prometheus.Registry) error {
+	const ns, sub = "caddy", "security"
+
+	securityMetrics.once.Do(func() {
+		securityMetrics.authnRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "authn_requests_total",
+			Help:      "Counter of requests handled by authentication portals.",
+		}, []string{"portal", "outcome", "realm"})
+		securityMetrics.authnDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "authn_request_duration_seconds",
+			Help:      "Histogram of request durations in authentication portals.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"portal", "outcome", "realm"})
+		securityMetrics.authzRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "authz_requests_total",
+			Help:      "Counter of requests handled by authorization gatekeepers.",
+		}, []string{"gatekeeper", "outcome", "realm"})
+		securityMetrics.authzDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "authz_request_duration_seconds",
+			Help:      "Histogram of request durations in authorization gatekeepers.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"gatekeeper", "outcome", "realm"})
+		securityMetrics.auditDenials = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "authz_audit_denials_total",
+			Help:      "Counter of requests that authorization gatekeepers in audit mode would have denied.",
+		}, []string{"gatekeeper", "realm"})
+	})
+
+	if registry == nil {
+		return nil
+	}
+
+	for _, c := range []prometheus.Collector{
+		securityMetrics.authnRequests,
+		securityMetrics.authnDuration,
+		securityMetrics.authzRequests,
+		securityMetrics.authzDuration,
+		securityMetrics.auditDenials,
+	} {
+		// The collectors are registered once per config load. The duplicate
+		// registration happens when a config is provisioned twice.
+		if err := registry.Register(c); err != nil {
+			var are prometheus.AlreadyRegisteredError
+			if errors.As(err, &are) {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// getRealmLabel returns the realm label of the metrics. The realm comes
+// from the request, therefore it is limited to the realms of the portal,
+// or of any portal when the portal name is empty. The other realms are
+// reported as unknown.
+func (srv *server) getRealmLabel(portalName, realm string) string {
+	if realm == "" {
+		return realm
+	}
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	for name, realms := range srv.realms {
+		if portalName != "" && name != portalName {
+			continue
+		}
+		if slices.Contains(realms, realm) {
+			return realm
+		}
+	}
+	return unknownRealm
+}
+
+func observeAuthn(portalName, outcome, realm string, start time.Time) {
+	if securityMetrics.authnRequests == nil {
+		return
+	}
+	securityMetrics.authnRequests.WithLabelValues(portalName, outcome, realm).Inc()
+	securityMetrics.authnDuration.WithLabelValues(portalName, outcome, realm).Observe(time.Since(start).Seconds())
+}
+
+func observeAuthz(gatekeeperName, outcome, realm string, start time.Time) {
+	if securityMetrics.authzRequests == nil {
+		return
+	}
+	securityMetrics.authzRequests.WithLabelValues(gatekeeperName, outcome, realm).Inc()
+	securityMetrics.authzDuration.WithLabelValues(gatekeeperName, outcome, realm).Observe(time.Since(start).Seconds())
+}
+
+func observeAuditDenial(gatekeeperName, realm string) {
+	if securityMetrics.auditDenials == nil {
+		return
+	}
+	securityMetrics.auditDenials.WithLabelValues(gatekeeperName, realm).Inc()
+}
+
+// statusRecorder records the HTTP status code of a response.
+type statusRecorder struct {
+	*caddyhttp.ResponseWriterWrapper
+	statusCode int
+}
+
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	return &statusRecorder{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+	}
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (sr *statusRecorder) WriteHeader(statusCode int) {
+	if sr.statusCode == 0 {
+		sr.statusCode = statusCode
+	}
+	sr.ResponseWriterWrapper.WriteHeader(statusCode)
+}
+
+// Write implements http.ResponseWriter.
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.statusCode == 0 {
+		sr.statusCode = http.StatusOK
+	}
+	return sr.ResponseWriterWrapper.Write(b)
+}
+
+// getAuthnOutcome returns the outcome of a request to an authentication portal.
+// The requests that neither authenticate nor deny a user, e.g. login page
+// views and static assets, are bypassed.
+func getAuthnOutcome(authenticated bool, statusCode int, err error) string {
+	switch {
+	case err != nil, statusCode >= 500:
+		return outcomeError
+	case authenticated:
+		return outcomeAuthorized
+	case statusCode == http.StatusUnauthorized, statusCode == http.StatusForbidden:
+		return outcomeDenied
+	}
+	return outcomeBypassed
+}
@@ -0,0 +1,98 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSecurityMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	for i := 0; i < 2; i++ {
+		if err := initSecurityMetrics(registry); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	observeAuthz("mypolicy", outcomeDenied, "local", time.Now())
+	observeAuthz("mypolicy", outcomeDenied, "local", time.Now())
+	observeAuthn("myportal", outcomeAuthorized, "local", time.Now())
+
+	if got := testutil.ToFloat64(securityMetrics.authzRequests.WithLabelValues("mypolicy", outcomeDenied, "local")); got != 2 {
+		t.Errorf("unexpected authz counter value: got %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(securityMetrics.authnRequests.WithLabelValues("myportal", outcomeAuthorized, "local")); got != 1 {
+		t.Errorf("unexpected authn counter value: got %v, want 1", got)
+	}
+	if n, err := testutil.GatherAndCount(registry, "caddy_security_authz_request_duration_seconds"); err != nil || n != 1 {
+		t.Errorf("unexpected authz histogram count: %d, %v", n, err)
+	}
+}
+
+func TestGetAuthnOutcome(t *testing.T) {
+	testcases := []struct {
+		authenticated bool
+		statusCode    int
+		err           error
+		want          string
+	}{
+		{authenticated: true, statusCode: http.StatusOK, want: outcomeAuthorized},
+		{statusCode: http.StatusUnauthorized, want: outcomeDenied},
+		{statusCode: http.StatusForbidden, want: outcomeDenied},
+		{statusCode: http.StatusOK, want: outcomeBypassed},
+		{statusCode: http.StatusInternalServerError, want: outcomeError},
+		{authenticated: true, err: fmt.Errorf("foo"), want: outcomeError},
+	}
+	for _, tc := range testcases {
+		t.Run(fmt.Sprintf("%t %d %v", tc.authenticated, tc.statusCode, tc.err), func(t *testing.T) {
+			if got := getAuthnOutcome(tc.authenticated, tc.statusCode, tc.err); got != tc.want {
+				t.Errorf("unexpected outcome: got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetRealmLabel(t *testing.T) {
+	srv := newServerInstance(nil, nil)
+	srv.realms = map[string][]string{
+		"myportal":    {"local"},
+		"otherportal": {"github"},
+	}
+	testcases := []struct {
+		portal string
+		realm  string
+		want   string
+	}{
+		{portal: "myportal", realm: "local", want: "local"},
+		{portal: "myportal", realm: "github", want: unknownRealm},
+		{portal: "myportal", realm: "foobar", want: unknownRealm},
+		{portal: "myportal", want: ""},
+		{realm: "github", want: "github"},
+		{realm: "foobar", want: unknownRealm},
+	}
+	for _, tc := range testcases {
+		t.Run(fmt.Sprintf("%s %s", tc.portal, tc.realm), func(t *testing.T) {
+			if got := srv.getRealmLabel(tc.portal, tc.realm); got != tc.want {
+				t.Errorf("unexpected realm label: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -18,13 +18,13 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/greenpau/caddy-security/pkg/util"
-	"github.com/greenpau/go-authcrunch/pkg/authn"
 	"github.com/greenpau/go-authcrunch/pkg/requests"
 )
 
@@ -39,7 +39,15 @@ func init() {
 type AuthnMiddleware struct {
 	RouteMatcher string `json:"route_matcher,omitempty" xml:"route_matcher,omitempty" yaml:"route_matcher,omitempty"`
 	PortalName   string `json:"portal_name,omitempty" xml:"portal_name,omitempty" yaml:"portal_name,omitempty"`
-	portal       *authn.Portal
+	// PortalSelectors route the requests to the portals by host. The requests
+	// not matching any of the selectors are routed to PortalName.
+	PortalSelectors []*PortalSelector `json:"portal_selectors,omitempty" xml:"portal_selectors,omitempty" yaml:"portal_selectors,omitempty"`
+	// RouteMatcherSetsRaw holds the matchers resolved from the named
+	// matcher in the route matcher, if any.
+	RouteMatcherSetsRaw caddyhttp.RawMatcherSets `json:"route_matcher_sets,omitempty" caddy:"namespace=http.matchers"`
+	routeMatcherSets    caddyhttp.MatcherSets
+	server              *server
+	audit               *auditLogger
 }
 
 // CaddyModule returns the Caddy module information.
@@ -65,18 +73,29 @@ func (m *AuthnMiddleware) Provision(ctx caddy.Context) error {
 		return fmt.Errorf("security app config is nil")
 	}
 
+	m.server = app.server
+	m.audit = app.audit
+
 	repl := caddy.NewReplacer()
-	if v, _, err := util.FindReplace(repl, m.PortalName); err == nil {
-		m.PortalName = v
-	} else {
-		return fmt.Errorf("authenticator config is malformed: %v", err)
+	if m.PortalName, err = m.provisionPortal(repl, m.PortalName); err != nil {
+		return err
+	}
+	for _, selector := range m.PortalSelectors {
+		if selector.PortalName, err = m.provisionPortal(repl, selector.PortalName); err != nil {
+			return err
+		}
 	}
 
-	portal, err := app.getPortal(m.PortalName)
+	if len(m.RouteMatcherSetsRaw) == 0 {
+		m.RouteMatcherSetsRaw, err = getRouteMatcherSets(m.RouteMatcher, nil)
+		if err != nil {
+			return fmt.Errorf("authenticator config is malformed: %v", err)
+		}
+	}
+	m.routeMatcherSets, err = loadRouteMatcherSets(ctx, m, "RouteMatcherSetsRaw", m.RouteMatcherSetsRaw)
 	if err != nil {
-		return fmt.Errorf("security app erred with %q authentication portal: %v", m.PortalName, err)
+		return fmt.Errorf("authenticator config is malformed: %v", err)
 	}
-	m.portal = portal
 
 	return nil
 }
@@ -84,22 +103,26 @@ func (m *AuthnMiddleware) Provision(ctx caddy.Context) error {
 // UnmarshalCaddyfile unmarshals a caddyfile.
 func (m *AuthnMiddleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	args := d.RemainingArgs()
-	switch len(args) {
-	case 3:
-		m.RouteMatcher = "*"
-		if args[1] != "with" {
-			return d.Errf("directive must contain %q keyword: %s", "with", strings.Join(args, " "))
-		}
-		m.PortalName = args[2]
-	case 4:
-		if args[2] != "with" {
-			return d.Errf("directive must contain %q keyword: %s", "with", strings.Join(args, " "))
+	if len(args) > 1 && len(args) < 5 && args[len(args)-1] == "with" {
+		routeMatcher, err := parseRouteMatcherArgs(args[1 : len(args)-1])
+		if err != nil {
+			return d.Errf("%v: %s", err, strings.Join(args, " "))
 		}
-		m.RouteMatcher = args[1]
-		m.PortalName = args[3]
-	default:
+		m.RouteMatcher = routeMatcher
+		return m.unmarshalPortalSelectors(d)
+	}
+	if len(args) < 3 || len(args) > 5 {
 		return d.Errf("malformed directive: %s", strings.Join(args, " "))
 	}
+	if args[len(args)-2] != "with" {
+		return d.Errf("directive must contain %q keyword: %s", "with", strings.Join(args, " "))
+	}
+	routeMatcher, err := parseRouteMatcherArgs(args[1 : len(args)-2])
+	if err != nil {
+		return d.Errf("%v: %s", err, strings.Join(args, " "))
+	}
+	m.RouteMatcher = routeMatcher
+	m.PortalName = args[len(args)-1]
 	return nil
 }
 
@@ -108,21 +131,73 @@ func (m *AuthnMiddleware) Validate() error {
 	if m.RouteMatcher == "" {
 		return fmt.Errorf("empty route matcher")
 	}
-	if m.PortalName == "" {
+	if m.PortalName == "" && len(m.PortalSelectors) == 0 {
 		return fmt.Errorf("empty portal name")
 	}
-	if m.portal == nil {
-		return fmt.Errorf("portal is nil")
+	for _, selector := range m.PortalSelectors {
+		if selector.Host == "" {
+			return fmt.Errorf("empty portal selector host")
+		}
+		if selector.PortalName == "" {
+			return fmt.Errorf("empty portal name for %q host", selector.Host)
+		}
+	}
+	if m.server == nil {
+		return fmt.Errorf("security app server is nil")
 	}
 
 	return nil
 }
 
 // ServeHTTP serves authentication portal.
-func (m *AuthnMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+func (m *AuthnMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	matched, err := m.routeMatcherSets.AnyMatchWithError(r)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	if !matched {
+		return next.ServeHTTP(w, r)
+	}
+
+	if jwks := m.server.getJWKS(); jwks != nil && strings.HasSuffix(r.URL.Path, assertionJWKSPath) {
+		return m.serveJWKS(w, r, jwks)
+	}
+
+	portalName, portal, err := m.getPortal(r)
+	if err != nil {
+		return caddyhttp.Error(http.StatusNotFound, err)
+	}
+
+	start := time.Now()
 	rr := requests.NewRequest()
 	rr.ID = util.GetRequestID(r)
-	return m.portal.ServeHTTP(r.Context(), w, r, rr)
+	sr := newStatusRecorder(w)
+	err = portal.ServeHTTP(r.Context(), sr, r, rr)
+	statusCode := sr.statusCode
+	if rr.Response.Code > 0 {
+		statusCode = rr.Response.Code
+	}
+	observeAuthn(portalName, getAuthnOutcome(rr.Response.Authenticated, statusCode, err), m.server.getRealmLabel(portalName, rr.Upstream.Realm), start)
+	m.audit.auditAuthn(r, rr, portalName, statusCode, err)
+	return err
+}
+
+// serveJWKS serves the keys verifying the signed assertions injected by the
+// authorization policies.
+func (m *AuthnMiddleware) serveJWKS(w http.ResponseWriter, r *http.Request, jwks []byte) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	default:
+		w.Header().Set("Allow", "GET, HEAD")
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("unsupported method %s", r.Method))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		w.Write(jwks)
+	}
+	return nil
 }
 
 func parseAuthnCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
@@ -130,6 +205,13 @@ func parseAuthnCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, e
 	if err := m.UnmarshalCaddyfile(h.Dispenser); err != nil {
 		return nil, err
 	}
+	if hasNamedRouteMatcher(m.RouteMatcher) {
+		matcherSets, err := getRouteMatcherSets(m.RouteMatcher, &h)
+		if err != nil {
+			return nil, h.Errf("%v", err)
+		}
+		m.RouteMatcherSetsRaw = matcherSets
+	}
 	return m, nil
 }
 
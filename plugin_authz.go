@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
@@ -26,10 +27,10 @@ import (
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
 	"github.com/greenpau/caddy-security/pkg/util"
-	"github.com/greenpau/go-authcrunch/pkg/authz"
 	"github.com/greenpau/go-authcrunch/pkg/errors"
 	"github.com/greenpau/go-authcrunch/pkg/requests"
 	addrutil "github.com/greenpau/go-authcrunch/pkg/util/addr"
+	"go.uber.org/zap"
 )
 
 const (
@@ -47,7 +48,14 @@ func init() {
 type AuthzMiddleware struct {
 	RouteMatcher   string `json:"route_matcher,omitempty" xml:"route_matcher,omitempty" yaml:"route_matcher,omitempty"`
 	GatekeeperName string `json:"gatekeeper_name,omitempty" xml:"gatekeeper_name,omitempty" yaml:"gatekeeper_name,omitempty"`
-	gatekeeper     *authz.Gatekeeper
+	// RouteMatcherSetsRaw holds the matchers resolved from the named
+	// matcher in the route matcher, if any.
+	RouteMatcherSetsRaw caddyhttp.RawMatcherSets `json:"route_matcher_sets,omitempty" caddy:"namespace=http.matchers"`
+	routeMatcherSets    caddyhttp.MatcherSets
+	server              *server
+	auditor             *accessListAuditor
+	audit               *auditLogger
+	logger              *zap.Logger
 }
 
 // CaddyModule returns the Caddy module information.
@@ -80,11 +88,36 @@ func (m *AuthzMiddleware) Provision(ctx caddy.Context) error {
 		return fmt.Errorf("%s config is malformed: %v", authzPluginName, err)
 	}
 
-	gatekeeper, err := app.getGatekeeper(m.GatekeeperName)
-	if err != nil {
+	if _, err := app.getGatekeeper(m.GatekeeperName); err != nil {
 		return fmt.Errorf("security app erred with %q authorization policy: %v", m.GatekeeperName, err)
 	}
-	m.gatekeeper = gatekeeper
+	m.server = app.server
+	m.logger = ctx.Logger(m)
+	m.audit = app.audit
+
+	ext := getAuthorizationPolicyExtension(app.AuthorizationPolicyExtensions, m.GatekeeperName)
+	for _, p := range app.Config.AuthorizationPolicies {
+		if p.Name != m.GatekeeperName {
+			continue
+		}
+		if ext.IsAuditMode() {
+			m.auditor, err = newAccessListAuditor(ctx, p.AccessListRules)
+			if err != nil {
+				return fmt.Errorf("security app erred with %q authorization policy audit: %v", m.GatekeeperName, err)
+			}
+		}
+	}
+
+	if len(m.RouteMatcherSetsRaw) == 0 {
+		m.RouteMatcherSetsRaw, err = getRouteMatcherSets(m.RouteMatcher, nil)
+		if err != nil {
+			return fmt.Errorf("%s config is malformed: %v", authzPluginName, err)
+		}
+	}
+	m.routeMatcherSets, err = loadRouteMatcherSets(ctx, m, "RouteMatcherSetsRaw", m.RouteMatcherSetsRaw)
+	if err != nil {
+		return fmt.Errorf("%s config is malformed: %v", authzPluginName, err)
+	}
 
 	return nil
 }
@@ -92,22 +125,18 @@ func (m *AuthzMiddleware) Provision(ctx caddy.Context) error {
 // UnmarshalCaddyfile unmarshals caddyfile.
 func (m *AuthzMiddleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	args := d.RemainingArgs()
-	switch len(args) {
-	case 3:
-		m.RouteMatcher = "*"
-		if args[1] != "with" {
-			return d.Errf("directive must contain %q keyword: %s", "with", strings.Join(args, " "))
-		}
-		m.GatekeeperName = args[2]
-	case 4:
-		if args[2] != "with" {
-			return d.Errf("directive must contain %q keyword: %s", "with", strings.Join(args, " "))
-		}
-		m.RouteMatcher = args[1]
-		m.GatekeeperName = args[3]
-	default:
+	if len(args) < 3 || len(args) > 5 {
 		return d.Errf("malformed directive: %s", strings.Join(args, " "))
 	}
+	if args[len(args)-2] != "with" {
+		return d.Errf("directive must contain %q keyword: %s", "with", strings.Join(args, " "))
+	}
+	routeMatcher, err := parseRouteMatcherArgs(args[1 : len(args)-2])
+	if err != nil {
+		return d.Errf("%v: %s", err, strings.Join(args, " "))
+	}
+	m.RouteMatcher = routeMatcher
+	m.GatekeeperName = args[len(args)-1]
 	return nil
 }
 
@@ -119,8 +148,8 @@ func (m *AuthzMiddleware) Validate() error {
 	if m.GatekeeperName == "" {
 		return fmt.Errorf("empty gatekeeper name")
 	}
-	if m.gatekeeper == nil {
-		return fmt.Errorf("gatekeeper is nil")
+	if m.server == nil {
+		return fmt.Errorf("security app server is nil")
 	}
 	return nil
 }
@@ -128,45 +157,116 @@ func (m *AuthzMiddleware) Validate() error {
 // Authenticate authorizes access based on the presense and content of
 // authorization token.
 func (m AuthzMiddleware) Authenticate(w http.ResponseWriter, r *http.Request) (caddyauth.User, bool, error) {
+	matched, err := m.routeMatcherSets.AnyMatchWithError(r)
+	if err != nil {
+		return caddyauth.User{}, false, err
+	}
+	if !matched {
+		// The requests outside of the route matcher are not subject to
+		// the authorization policy.
+		return caddyauth.User{}, true, nil
+	}
+
+	// The policy is looked up for each request, because secrets
+	// rotation may replace it.
+	policy, err := m.server.getAuthorizationPolicy(m.GatekeeperName)
+	if err != nil {
+		return caddyauth.User{}, false, fmt.Errorf("security app erred with %q authorization policy: %v", m.GatekeeperName, err)
+	}
+	ext := policy.ext
+
+	stripUntrustedHeaders(r, policy.untrustedHeaders)
+
+	start := time.Now()
+	if ext.IsBypassed(r) {
+		observeAuthz(m.GatekeeperName, outcomeBypassed, "", start)
+		return caddyauth.User{}, true, nil
+	}
+
 	ar := requests.NewAuthorizationRequest()
 	ar.ID = util.GetRequestID(r)
-	if err := m.gatekeeper.Authenticate(w, r, ar); err != nil {
-		return caddyauth.User{}, false, errors.ErrAuthorizationFailed.WithArgs(
-			getAuthorizationDetails(r, ar), err,
-		)
+	gw := w
+	var rw *recordedResponseWriter
+	if ext.IsAuditMode() {
+		rw = newRecordedResponseWriter()
+		gw = rw
+	}
+	outcome := outcomeAuthorized
+	if err := policy.gatekeeper.Authenticate(gw, r, ar); err != nil {
+		// The audit mode applies to the access list only. The requests
+		// without valid credentials are denied.
+		audited := rw != nil && isAccessListDenial(ar)
+		if audited {
+			m.auditDenial(r, ar, err)
+			audited = authorizeAuditedRequest(r, ar, policy.config) == nil
+		}
+		if !audited {
+			if rw != nil {
+				rw.writeTo(w)
+			}
+			observeAuthz(m.GatekeeperName, outcomeDenied, m.server.getRealmLabel("", getAuthorizationRealm(ar)), start)
+			m.audit.auditAuthzDenial(r, ar, m.GatekeeperName, outcomeDenied, err)
+			return caddyauth.User{}, false, errors.ErrAuthorizationFailed.WithArgs(
+				getAuthorizationDetails(r, ar), err,
+			)
+		}
+		// The request let through is handled as an allowed one.
+		m.audit.auditAuthzDenial(r, ar, m.GatekeeperName, outcomeAudited, err)
+		outcome = outcomeAudited
 	}
 
 	if ar.Response.Bypassed {
+		observeAuthz(m.GatekeeperName, outcomeBypassed, "", start)
 		return caddyauth.User{}, ar.Response.Bypassed, nil
 	}
 
 	if ar.Response.User == nil {
+		observeAuthz(m.GatekeeperName, outcomeError, "", start)
 		return caddyauth.User{}, false, errors.ErrAuthorizationFailed.WithArgs(
 			getAuthorizationDetails(r, ar), "user data not found",
 		)
 	}
 
-	u := caddyauth.User{
-		Metadata: map[string]string{
-			"roles": ar.Response.User["roles"].(string),
-		},
-	}
-	if v, exists := ar.Response.User["id"]; exists {
-		u.ID = v.(string)
-	}
-	for _, k := range []string{"claim_id", "sub", "email", "name", "issuer", "origin", "realm"} {
-		if v, exists := ar.Response.User[k]; exists {
-			u.Metadata[k] = v.(string)
+	if ext.TokenExchange != nil {
+		token, err := ext.TokenExchange.exchange(r.Context(), ar, time.Now())
+		if err != nil {
+			observeAuthz(m.GatekeeperName, outcomeError, m.server.getRealmLabel("", getAuthorizationRealm(ar)), start)
+			return caddyauth.User{}, false, errors.ErrAuthorizationFailed.WithArgs(
+				getAuthorizationDetails(r, ar), err,
+			)
 		}
+		r.Header.Set("Authorization", "Bearer "+token)
+		ext.TokenExchange.stripSubjectToken(r)
 	}
 
-	if v, exists := ar.Response.User["userinfo|preferred_username"]; exists {
-		u.Metadata["username"] = v.(string)
+	observeAuthz(m.GatekeeperName, outcome, m.server.getRealmLabel("", getAuthorizationRealm(ar)), start)
+	injectHeaderTemplates(r, ar, ext.HeaderTemplates)
+	if ext.SignedAssertion != nil {
+		if token, err := ext.SignedAssertion.mint(ar, time.Now()); err == nil {
+			r.Header.Set(ext.SignedAssertion.Header, token)
+		} else {
+			m.logger.Error(
+				"failed signing identity assertion",
+				zap.String("gatekeeper_name", m.GatekeeperName),
+				zap.Error(err),
+			)
+		}
 	}
 
+	u := newAuthorizedUser(ar, ext.ClaimMappings)
 	return u, ar.Response.Authorized, nil
 }
 
+func getAuthorizationRealm(ar *requests.AuthorizationRequest) string {
+	if ar.Response.User == nil {
+		return ""
+	}
+	if v, ok := ar.Response.User["realm"].(string); ok {
+		return v
+	}
+	return ""
+}
+
 func getAuthorizationDetails(r *http.Request, ar *requests.AuthorizationRequest) string {
 	var details []string
 	details = append(details, fmt.Sprintf("src_ip=%s", addrutil.GetSourceAddress(r)))
@@ -175,7 +275,9 @@ func getAuthorizationDetails(r *http.Request, ar *requests.AuthorizationRequest)
 		for k, v := range ar.Response.User {
 			switch k {
 			case "email", "sub", "name", "jti":
-				details = append(details, fmt.Sprintf("%s=%s", k, v.(string)))
+				if s, ok := claimValueToString(v); ok {
+					details = append(details, fmt.Sprintf("%s=%s", k, s))
+				}
 			}
 		}
 	}
@@ -187,6 +289,13 @@ func parseAuthzCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, e
 	if err := m.UnmarshalCaddyfile(h.Dispenser); err != nil {
 		return nil, err
 	}
+	if hasNamedRouteMatcher(m.RouteMatcher) {
+		matcherSets, err := getRouteMatcherSets(m.RouteMatcher, &h)
+		if err != nil {
+			return nil, h.Errf("%v", err)
+		}
+		m.RouteMatcherSetsRaw = matcherSets
+	}
 	return caddyauth.Authentication{
 		ProvidersRaw: caddy.ModuleMap{
 			authzPluginName: caddyconfig.JSON(m, nil),
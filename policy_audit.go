@@ -0,0 +1,284 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/greenpau/go-authcrunch/pkg/acl"
+	"github.com/greenpau/go-authcrunch/pkg/authz"
+	"github.com/greenpau/go-authcrunch/pkg/errors"
+	"github.com/greenpau/go-authcrunch/pkg/requests"
+	"github.com/greenpau/go-authcrunch/pkg/user"
+	addrutil "github.com/greenpau/go-authcrunch/pkg/util/addr"
+	"go.uber.org/zap"
+)
+
+const (
+	policyModeEnforce = "enforce"
+	policyModeAudit   = "audit"
+)
+
+// accessListAuditor evaluates the rules of an access list one at a time
+// to find the rule that decides on a request.
+type accessListAuditor struct {
+	rules []*auditedRule
+}
+
+// auditedRule wraps a single access list rule. The rule is loaded in two
+// access lists, one failing closed and one failing open, to tell apart
+// the rules that allow, deny, or do not match a request.
+type auditedRule struct {
+	config     *acl.RuleConfiguration
+	failClosed *acl.AccessList
+	failOpen   *acl.AccessList
+	stop       bool
+}
+
+// accessListDecision is the decision of an access list on a request.
+// The rule index is -1 when no rule matched the request.
+type accessListDecision struct {
+	RuleIndex int
+	Comment   string
+	Action    string
+	Allowed   bool
+}
+
+func newAccessListAuditor(ctx context.Context, cfgs []*acl.RuleConfiguration) (*accessListAuditor, error) {
+	auditor := &accessListAuditor{}
+	for _, cfg := range cfgs {
+		rule := &auditedRule{
+			config:     cfg,
+			failClosed: acl.NewAccessList(),
+			failOpen:   acl.NewAccessList(),
+		}
+		for _, accessList := range []*acl.AccessList{rule.failClosed, rule.failOpen} {
+			accessList.SetLogger(zap.NewNop())
+			if err := accessList.AddRule(ctx, cfg); err != nil {
+				return nil, err
+			}
+		}
+		rule.failOpen.SetDefaultAllowAction()
+		for _, s := range strings.Fields(cfg.Action) {
+			if s == "stop" {
+				rule.stop = true
+			}
+		}
+		auditor.rules = append(auditor.rules, rule)
+	}
+	return auditor, nil
+}
+
+// evaluate returns the decision of the access list, following the order
+// of evaluation in acl.AccessList.
+func (a *accessListAuditor) evaluate(ctx context.Context, data map[string]interface{}) *accessListDecision {
+	var granted *accessListDecision
+	for i, rule := range a.rules {
+		switch {
+		case rule.failClosed.Allow(ctx, data):
+			if rule.stop {
+				return newAccessListDecision(i, rule.config, true)
+			}
+			if granted == nil {
+				granted = newAccessListDecision(i, rule.config, true)
+			}
+		case !rule.failOpen.Allow(ctx, data):
+			return newAccessListDecision(i, rule.config, false)
+		}
+	}
+	if granted != nil {
+		return granted
+	}
+	return &accessListDecision{RuleIndex: -1, Action: "deny"}
+}
+
+func newAccessListDecision(i int, cfg *acl.RuleConfiguration, allowed bool) *accessListDecision {
+	return &accessListDecision{
+		RuleIndex: i,
+		Comment:   cfg.Comment,
+		Action:    cfg.Action,
+		Allowed:   allowed,
+	}
+}
+
+// auditDenial logs the request that the policy in audit mode would have
+// denied, together with the access list rule deciding on the request.
+func (m *AuthzMiddleware) auditDenial(r *http.Request, ar *requests.AuthorizationRequest, err error) {
+	realm := getAuthorizationRealm(ar)
+	observeAuditDenial(m.GatekeeperName, m.server.getRealmLabel("", realm))
+
+	fields := []zap.Field{
+		zap.String("gatekeeper", m.GatekeeperName),
+		zap.String("request_id", ar.ID),
+		zap.String("realm", realm),
+		zap.String("src_ip", addrutil.GetSourceAddress(r)),
+		zap.String("src_conn_ip", addrutil.GetSourceConnAddress(r)),
+		zap.String("method", r.Method),
+		zap.String("url", addrutil.GetTargetURL(r)),
+		zap.Error(err),
+	}
+	if m.auditor != nil {
+		if data := getAccessListData(r, ar); data != nil {
+			decision := m.auditor.evaluate(r.Context(), data)
+			fields = append(fields,
+				zap.Int("rule_index", decision.RuleIndex),
+				zap.String("rule_comment", decision.Comment),
+				zap.String("rule_action", decision.Action),
+				zap.Bool("acl_allowed", decision.Allowed),
+			)
+		}
+	}
+	m.logger.Warn("authorization policy in audit mode would have denied request", fields...)
+}
+
+// getAccessListData returns the data evaluated by the access list of
+// a policy for the user of the request. The data comes from the token
+// payload, therefore it is returned only for the tokens validated by
+// the gatekeeper.
+func getAccessListData(r *http.Request, ar *requests.AuthorizationRequest) map[string]interface{} {
+	if !isAccessListDenial(ar) {
+		return nil
+	}
+	payload := getTokenPayload(ar)
+	if payload == nil {
+		return nil
+	}
+	usr, err := user.NewUser(payload)
+	if err != nil {
+		return nil
+	}
+	data := make(map[string]interface{})
+	for k, v := range usr.GetData() {
+		data[k] = v
+	}
+	data["method"] = r.Method
+	data["path"] = path.Clean("/" + r.URL.Path)
+	return data
+}
+
+// authorizeAuditedRequest authorizes the request that the policy in audit
+// mode lets through. The gatekeeper keeps only a few claims of the users
+// it denies, therefore the identity of the user is built from the claims
+// of the validated token. The claim headers are injected, and the token
+// is stripped, as the gatekeeper does for the allowed requests.
+func authorizeAuditedRequest(r *http.Request, ar *requests.AuthorizationRequest, p *authz.PolicyConfig) error {
+	payload := getTokenPayload(ar)
+	if ar.Token.IsPlainPayload && ar.Token.Payload != "" {
+		payload = []byte(ar.Token.Payload)
+	}
+	if payload == nil {
+		return fmt.Errorf("token claims not found")
+	}
+	usr, err := user.NewUser(payload)
+	if err != nil {
+		return err
+	}
+
+	if p.PassClaimsWithHeaders {
+		injected := make(map[string]bool)
+		for _, entry := range p.HeaderInjectionConfigs {
+			injected[entry.Header] = true
+		}
+		headers := map[string]string{
+			"X-Token-User-Name":  usr.Claims.Name,
+			"X-Token-User-Email": usr.Claims.Email,
+			"X-Token-User-Roles": strings.Join(usr.Claims.Roles, " "),
+			"X-Token-Subject":    usr.Claims.Subject,
+		}
+		for k, v := range headers {
+			if v == "" || injected[k] {
+				continue
+			}
+			r.Header.Set(k, v)
+		}
+	}
+	for _, entry := range p.HeaderInjectionConfigs {
+		if v := usr.GetClaimValueByField(entry.Field); v != "" {
+			r.Header.Set(entry.Header, v)
+		}
+	}
+
+	if p.StripTokenEnabled && ar.Token.Source == "cookie" && ar.Token.Name != "" {
+		cookies := r.Cookies()
+		r.Header.Del("Cookie")
+		for _, c := range cookies {
+			if c.Name != ar.Token.Name {
+				r.AddCookie(c)
+			}
+		}
+	}
+
+	ar.Response.User = usr.BuildRequestIdentity(p.UserIdentityField)
+	ar.Response.Authorized = true
+	return nil
+}
+
+// isAccessListDenial returns true when the access list of a policy denied
+// the request. The gatekeeper sets the user of the request only after it
+// validated the token of the request.
+func isAccessListDenial(ar *requests.AuthorizationRequest) bool {
+	if ar.Response.User == nil {
+		return false
+	}
+	return ar.Response.Error == errors.ErrAccessNotAllowed || ar.Response.Error == errors.ErrAccessNotAllowedByPathACL
+}
+
+// recordedResponseWriter is the response writer for the gatekeeper in
+// audit mode. It holds the redirects and errors of denied requests. They
+// are discarded when the request is let through, and written otherwise.
+type recordedResponseWriter struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func newRecordedResponseWriter() *recordedResponseWriter {
+	return &recordedResponseWriter{header: make(http.Header)}
+}
+
+// Header implements http.ResponseWriter.
+func (w *recordedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+// Write implements http.ResponseWriter.
+func (w *recordedResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (w *recordedResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+}
+
+// writeTo writes the recorded response to rw.
+func (w *recordedResponseWriter) writeTo(rw http.ResponseWriter) {
+	for k, v := range w.header {
+		rw.Header()[k] = v
+	}
+	if w.statusCode > 0 {
+		rw.WriteHeader(w.statusCode)
+	}
+	if w.body.Len() > 0 {
+		rw.Write(w.body.Bytes())
+	}
+}
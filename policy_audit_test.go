@@ -0,0 +1,277 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwtlib "github.com/golang-jwt/jwt/v5"
+	"github.com/google/go-cmp/cmp"
+	"github.com/greenpau/go-authcrunch/pkg/acl"
+	"github.com/greenpau/go-authcrunch/pkg/authz"
+	"github.com/greenpau/go-authcrunch/pkg/authz/injector"
+	"github.com/greenpau/go-authcrunch/pkg/errors"
+	"github.com/greenpau/go-authcrunch/pkg/requests"
+)
+
+func TestAccessListAuditor(t *testing.T) {
+	rules := []*acl.RuleConfiguration{
+		{
+			Comment:    "admins",
+			Conditions: []string{"match roles authp/admin"},
+			Action:     "allow stop log info",
+		},
+		{
+			Comment:    "guests",
+			Conditions: []string{"match roles authp/guest"},
+			Action:     "deny log warn",
+		},
+		{
+			Comment:    "users",
+			Conditions: []string{"match roles authp/user"},
+			Action:     "allow log debug",
+		},
+		{
+			Comment:    "users without billing",
+			Conditions: []string{"match roles authp/user", "partial match path /billing"},
+			Action:     "deny log warn",
+		},
+	}
+
+	testcases := []struct {
+		name   string
+		claims string
+		path   string
+		want   *accessListDecision
+	}{
+		{
+			name:   "test allow with stop",
+			claims: `{"sub": "jsmith", "roles": ["authp/admin", "authp/guest"]}`,
+			path:   "/billing",
+			want:   &accessListDecision{RuleIndex: 0, Comment: "admins", Action: "allow stop log info", Allowed: true},
+		},
+		{
+			name:   "test deny",
+			claims: `{"sub": "jsmith", "roles": ["authp/guest", "authp/user"]}`,
+			path:   "/",
+			want:   &accessListDecision{RuleIndex: 1, Comment: "guests", Action: "deny log warn"},
+		},
+		{
+			name:   "test allow without stop",
+			claims: `{"sub": "jsmith", "roles": ["authp/user"]}`,
+			path:   "/",
+			want:   &accessListDecision{RuleIndex: 2, Comment: "users", Action: "allow log debug", Allowed: true},
+		},
+		{
+			name:   "test deny after allow without stop",
+			claims: `{"sub": "jsmith", "roles": ["authp/user"]}`,
+			path:   "/billing/invoices",
+			want:   &accessListDecision{RuleIndex: 3, Comment: "users without billing", Action: "deny log warn"},
+		},
+		{
+			name:   "test default deny",
+			claims: `{"sub": "jsmith", "roles": ["authp/viewer"]}`,
+			path:   "/",
+			want:   &accessListDecision{RuleIndex: -1, Action: "deny"},
+		},
+	}
+
+	auditor, err := newAccessListAuditor(context.Background(), rules)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tc.path, nil)
+			ar := requests.NewAuthorizationRequest()
+			ar.Token.Found = true
+			ar.Token.Payload = newTestToken(tc.claims)
+			ar.Response.User = map[string]interface{}{"sub": "jsmith"}
+			ar.Response.Error = errors.ErrAccessNotAllowed
+			data := getAccessListData(r, ar)
+			if data == nil {
+				t.Fatalf("access list data is nil")
+			}
+			got := auditor.evaluate(context.Background(), data)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("evaluate() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestIsAccessListDenial(t *testing.T) {
+	testcases := []struct {
+		name string
+		user map[string]interface{}
+		err  error
+		want bool
+	}{
+		{
+			name: "test access list denial",
+			user: map[string]interface{}{"sub": "jsmith"},
+			err:  errors.ErrAccessNotAllowed,
+			want: true,
+		},
+		{
+			name: "test path access list denial",
+			user: map[string]interface{}{"sub": "jsmith"},
+			err:  errors.ErrAccessNotAllowedByPathACL,
+			want: true,
+		},
+		{
+			name: "test token without valid signature",
+			err:  errors.ErrCryptoKeyStoreParseTokenFailed,
+		},
+		{
+			name: "test request without token",
+			err:  errors.ErrNoTokenFound,
+		},
+		{
+			name: "test source address mismatch",
+			user: map[string]interface{}{"sub": "jsmith"},
+			err:  errors.ErrSourceAddressNotFound,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ar := requests.NewAuthorizationRequest()
+			ar.Response.User = tc.user
+			ar.Response.Error = tc.err
+			if got := isAccessListDenial(ar); got != tc.want {
+				t.Errorf("isAccessListDenial() got %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAuthorizeAuditedRequest(t *testing.T) {
+	token, err := jwtlib.NewWithClaims(jwtlib.SigningMethodHS512, jwtlib.MapClaims{
+		"sub":   "jsmith",
+		"email": "jsmith@contoso.com",
+		"name":  "John Smith",
+		"roles": []string{"authp/user"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		name        string
+		payload     string
+		policy      *authz.PolicyConfig
+		wantUser    map[string]interface{}
+		wantHeaders map[string]string
+		wantCookies []string
+		shouldErr   bool
+	}{
+		{
+			name:    "test user built from token claims",
+			payload: token,
+			policy:  &authz.PolicyConfig{},
+			wantUser: map[string]interface{}{
+				"id":    "jsmith@contoso.com",
+				"sub":   "jsmith",
+				"email": "jsmith@contoso.com",
+				"name":  "John Smith",
+				"roles": "authp/user",
+			},
+			wantHeaders: map[string]string{},
+			wantCookies: []string{"AUTHP_ACCESS_TOKEN", "foo"},
+		},
+		{
+			name:    "test claim headers injected and token stripped",
+			payload: token,
+			policy: &authz.PolicyConfig{
+				PassClaimsWithHeaders:  true,
+				HeaderInjectionConfigs: []*injector.Config{{Header: "X-Token-Subject", Field: "email"}},
+				StripTokenEnabled:      true,
+				UserIdentityField:      "sub",
+			},
+			wantUser: map[string]interface{}{
+				"id":    "jsmith",
+				"sub":   "jsmith",
+				"email": "jsmith@contoso.com",
+				"name":  "John Smith",
+				"roles": "authp/user",
+			},
+			wantHeaders: map[string]string{
+				"X-Token-User-Name":  "John Smith",
+				"X-Token-User-Email": "jsmith@contoso.com",
+				"X-Token-User-Roles": "authp/user",
+				"X-Token-Subject":    "jsmith@contoso.com",
+			},
+			wantCookies: []string{"foo"},
+		},
+		{
+			name:      "test malformed token",
+			payload:   "foo",
+			policy:    &authz.PolicyConfig{},
+			shouldErr: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(&http.Cookie{Name: "AUTHP_ACCESS_TOKEN", Value: tc.payload})
+			r.AddCookie(&http.Cookie{Name: "foo", Value: "bar"})
+			ar := requests.NewAuthorizationRequest()
+			ar.Token.Found = true
+			ar.Token.Source = "cookie"
+			ar.Token.Name = "AUTHP_ACCESS_TOKEN"
+			ar.Token.Payload = tc.payload
+			ar.Response.User = map[string]interface{}{"sub": "jsmith"}
+
+			err := authorizeAuditedRequest(r, ar, tc.policy)
+			if tc.shouldErr {
+				if err == nil {
+					t.Fatalf("unexpected success, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !ar.Response.Authorized {
+				t.Errorf("request is not authorized")
+			}
+			if diff := cmp.Diff(tc.wantUser, ar.Response.User); diff != "" {
+				t.Errorf("authorizeAuditedRequest() user mismatch (-want +got):\n%s", diff)
+			}
+			gotHeaders := make(map[string]string)
+			for _, k := range defaultClaimHeaders {
+				if v := r.Header.Get(k); v != "" {
+					gotHeaders[k] = v
+				}
+			}
+			if diff := cmp.Diff(tc.wantHeaders, gotHeaders); diff != "" {
+				t.Errorf("authorizeAuditedRequest() headers mismatch (-want +got):\n%s", diff)
+			}
+			var gotCookies []string
+			for _, c := range r.Cookies() {
+				gotCookies = append(gotCookies, c.Name)
+			}
+			if diff := cmp.Diff(tc.wantCookies, gotCookies); diff != "" {
+				t.Errorf("authorizeAuditedRequest() cookies mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
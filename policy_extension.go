@@ -0,0 +1,175 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/greenpau/go-authcrunch/pkg/authz"
+)
+
+// AuthorizationPolicyExtension holds the settings of an authorization policy
+// enforced by the authorize middleware, rather than by authz.Gatekeeper.
+type AuthorizationPolicyExtension struct {
+	Name string `json:"name,omitempty" xml:"name,omitempty" yaml:"name,omitempty"`
+	// Mode is either "enforce", the default, or "audit". In audit mode, the
+	// requests denied by the policy are logged and then let through.
+	Mode          string          `json:"mode,omitempty" xml:"mode,omitempty" yaml:"mode,omitempty"`
+	ClaimMappings []*ClaimMapping `json:"claim_mappings,omitempty" xml:"claim_mappings,omitempty" yaml:"claim_mappings,omitempty"`
+	// BypassRules are the bypass rules with the conditions other than
+	// a single uri condition, which authz.Gatekeeper handles itself.
+	BypassRules []*BypassRule `json:"bypass_rules,omitempty" xml:"bypass_rules,omitempty" yaml:"bypass_rules,omitempty"`
+	// HeaderTemplates are the headers rendered from the claims of the
+	// authorized requests.
+	HeaderTemplates []*HeaderTemplate `json:"header_templates,omitempty" xml:"header_templates,omitempty" yaml:"header_templates,omitempty"`
+	// StripHeaders are the headers removed from the incoming requests, in
+	// addition to the headers the policy may inject.
+	StripHeaders []string `json:"strip_headers,omitempty" xml:"strip_headers,omitempty" yaml:"strip_headers,omitempty"`
+	// SignedAssertion injects the signed token asserting the identity of
+	// the authorized user.
+	SignedAssertion *SignedAssertion `json:"signed_assertion,omitempty" xml:"signed_assertion,omitempty" yaml:"signed_assertion,omitempty"`
+	// TokenExchange replaces the token of the authorized requests with the
+	// access token issued for the upstream.
+	TokenExchange *TokenExchange `json:"token_exchange,omitempty" xml:"token_exchange,omitempty" yaml:"token_exchange,omitempty"`
+}
+
+// IsAuditMode returns true when the policy is in audit mode.
+func (ext *AuthorizationPolicyExtension) IsAuditMode() bool {
+	return ext.Mode == policyModeAudit
+}
+
+// IsEmpty returns true when the extension has no settings.
+func (ext *AuthorizationPolicyExtension) IsEmpty() bool {
+	return ext.Mode == "" && len(ext.ClaimMappings) == 0 && len(ext.BypassRules) == 0 && len(ext.HeaderTemplates) == 0 && len(ext.StripHeaders) == 0 && ext.SignedAssertion == nil && ext.TokenExchange == nil
+}
+
+// IsBypassed returns true when the request matches any of the bypass rules.
+func (ext *AuthorizationPolicyExtension) IsBypassed(r *http.Request) bool {
+	for _, rule := range ext.BypassRules {
+		if rule.Match(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate validates AuthorizationPolicyExtension.
+func (ext *AuthorizationPolicyExtension) Validate() error {
+	if ext.Name == "" {
+		return fmt.Errorf("authorization policy extension name is empty")
+	}
+	switch ext.Mode {
+	case "", policyModeEnforce, policyModeAudit:
+	default:
+		return fmt.Errorf("authorization policy %q has unsupported mode: %s", ext.Name, ext.Mode)
+	}
+	for _, mapping := range ext.ClaimMappings {
+		if err := mapping.Validate(); err != nil {
+			return fmt.Errorf("authorization policy %q extension is malformed: %v", ext.Name, err)
+		}
+	}
+	for _, rule := range ext.BypassRules {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("authorization policy %q extension is malformed: %v", ext.Name, err)
+		}
+	}
+	for _, t := range ext.HeaderTemplates {
+		if err := t.Validate(); err != nil {
+			return fmt.Errorf("authorization policy %q extension is malformed: %v", ext.Name, err)
+		}
+	}
+	for _, k := range ext.StripHeaders {
+		if strings.TrimSpace(k) == "" {
+			return fmt.Errorf("authorization policy %q extension is malformed: stripped header name is empty", ext.Name)
+		}
+	}
+	if ext.SignedAssertion != nil {
+		if err := ext.SignedAssertion.Validate(); err != nil {
+			return fmt.Errorf("authorization policy %q extension is malformed: %v", ext.Name, err)
+		}
+	}
+	if ext.TokenExchange != nil {
+		if err := ext.TokenExchange.Validate(); err != nil {
+			return fmt.Errorf("authorization policy %q extension is malformed: %v", ext.Name, err)
+		}
+	}
+	return nil
+}
+
+// provision loads the keys signing the assertions and the exchanged tokens
+// from the crypto key store config of the policy.
+func (ext *AuthorizationPolicyExtension) provision(policies []*authz.PolicyConfig) error {
+	if ext.SignedAssertion == nil && ext.TokenExchange == nil {
+		return nil
+	}
+	for _, p := range policies {
+		if p.Name != ext.Name {
+			continue
+		}
+		if ext.SignedAssertion != nil {
+			if err := ext.SignedAssertion.loadKey(p); err != nil {
+				return fmt.Errorf("authorization policy %q extension is malformed: %v", ext.Name, err)
+			}
+		}
+		if ext.TokenExchange != nil {
+			if err := ext.TokenExchange.provision(p); err != nil {
+				return fmt.Errorf("authorization policy %q extension is malformed: %v", ext.Name, err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("authorization policy %q extension has no policy", ext.Name)
+}
+
+// getSigners returns the signers of the tokens the policy mints locally.
+func (ext *AuthorizationPolicyExtension) getSigners() []*SignedAssertion {
+	var signers []*SignedAssertion
+	if ext.SignedAssertion != nil {
+		signers = append(signers, ext.SignedAssertion)
+	}
+	if ext.TokenExchange != nil && ext.TokenExchange.signer != nil {
+		signers = append(signers, ext.TokenExchange.signer)
+	}
+	return signers
+}
+
+// clone returns the copy of the extension without the state set by provision.
+func (ext *AuthorizationPolicyExtension) clone() *AuthorizationPolicyExtension {
+	c := *ext
+	if ext.SignedAssertion != nil {
+		signedAssertion := *ext.SignedAssertion
+		signedAssertion.method, signedAssertion.key = nil, nil
+		c.SignedAssertion = &signedAssertion
+	}
+	if ext.TokenExchange != nil {
+		tokenExchange := *ext.TokenExchange
+		tokenExchange.signer, tokenExchange.clientSecret, tokenExchange.cache = nil, "", nil
+		c.TokenExchange = &tokenExchange
+	}
+	return &c
+}
+
+// getAuthorizationPolicyExtension returns the extension of the authorization
+// policy. If the policy has no extension, it returns an empty one.
+func getAuthorizationPolicyExtension(exts []*AuthorizationPolicyExtension, s string) *AuthorizationPolicyExtension {
+	for _, ext := range exts {
+		if ext.Name == s {
+			return ext
+		}
+	}
+	return &AuthorizationPolicyExtension{Name: s}
+}
@@ -0,0 +1,138 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/greenpau/go-authcrunch/pkg/authn"
+)
+
+// PortalSelector routes the requests for a host to an authentication
+// portal. The host may be a wildcard, e.g. "*.example.com", matching
+// a single label. The portal name may contain request placeholders,
+// e.g. "{http.request.host.labels.2}", resolved for each request.
+type PortalSelector struct {
+	Host       string `json:"host,omitempty" xml:"host,omitempty" yaml:"host,omitempty"`
+	PortalName string `json:"portal_name,omitempty" xml:"portal_name,omitempty" yaml:"portal_name,omitempty"`
+}
+
+// unmarshalPortalSelectors parses the portal selection block, e.g.
+//
+//	authenticate with {
+//	  host a.example.com portal A
+//	  host *.b.example.com portal B
+//	  default portal C
+//	}
+func (m *AuthnMiddleware) unmarshalPortalSelectors(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		args := append([]string{d.Val()}, d.RemainingArgs()...)
+		switch {
+		case len(args) == 4 && args[0] == "host" && args[2] == "portal":
+			m.PortalSelectors = append(m.PortalSelectors, &PortalSelector{
+				Host:       strings.ToLower(args[1]),
+				PortalName: args[3],
+			})
+		case len(args) == 3 && args[0] == "default" && args[1] == "portal":
+			if m.PortalName != "" {
+				return d.Errf("duplicate default portal: %s", strings.Join(args, " "))
+			}
+			m.PortalName = args[2]
+		default:
+			return d.Errf("malformed portal selector: %s", strings.Join(args, " "))
+		}
+	}
+	if m.PortalName == "" && len(m.PortalSelectors) == 0 {
+		return d.Errf("portal selection block is empty")
+	}
+	return nil
+}
+
+// provisionPortal resolves the global placeholders in the portal name.
+// The portals without request placeholders are checked at provisioning.
+func (m *AuthnMiddleware) provisionPortal(repl *caddy.Replacer, s string) (string, error) {
+	if s == "" {
+		return s, nil
+	}
+	name := repl.ReplaceKnown(s, "")
+	if name == "" {
+		return "", fmt.Errorf("portal name %q resolved to empty string", s)
+	}
+	if strings.Contains(name, "{") {
+		return name, nil
+	}
+	if _, err := m.server.GetPortalByName(name); err != nil {
+		return "", fmt.Errorf("security app erred with %q authentication portal: %v", name, err)
+	}
+	return name, nil
+}
+
+// getPortal returns the authentication portal for the request. The portal
+// is looked up for each request, because secrets rotation may replace it.
+func (m *AuthnMiddleware) getPortal(r *http.Request) (string, *authn.Portal, error) {
+	name := m.PortalName
+	host := getRequestHost(r)
+	for _, selector := range m.PortalSelectors {
+		if matchHost(selector.Host, host) {
+			name = selector.PortalName
+			break
+		}
+	}
+	if name == "" {
+		return "", nil, fmt.Errorf("authentication portal not found for host %q", host)
+	}
+
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		name = repl.ReplaceAll(name, "")
+	}
+	portal, err := m.server.GetPortalByName(name)
+	if err != nil {
+		return name, nil, fmt.Errorf("authentication portal %q not found for host %q", name, host)
+	}
+	return name, portal, nil
+}
+
+// getRequestHost returns the host name of the request. It falls back to
+// TLS server name when the Host header is empty.
+func getRequestHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if host == "" && r.TLS != nil {
+		host = r.TLS.ServerName
+	}
+	return strings.ToLower(host)
+}
+
+// matchHost returns true when the host matches the pattern. The wildcard
+// in the pattern matches a single label, e.g. "*.example.com" matches
+// "foo.example.com", but not "example.com" or "bar.foo.example.com".
+func matchHost(pattern, host string) bool {
+	if pattern == host {
+		return true
+	}
+	suffix, found := strings.CutPrefix(pattern, "*")
+	if !found || !strings.HasPrefix(suffix, ".") {
+		return false
+	}
+	label, found := strings.CutSuffix(host, suffix)
+	return found && label != "" && !strings.Contains(label, ".")
+}
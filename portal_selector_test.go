@@ -0,0 +1,189 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/google/go-cmp/cmp"
+	"github.com/greenpau/go-authcrunch/pkg/authn"
+)
+
+func TestParsePortalSelectors(t *testing.T) {
+	testcases := []struct {
+		name      string
+		d         *caddyfile.Dispenser
+		want      *AuthnMiddleware
+		shouldErr bool
+		err       error
+	}{
+		{
+			name: "test portal selection block",
+			d: caddyfile.NewTestDispenser(`authenticate with {
+				host a.example.com portal A
+				host *.B.example.com portal B
+				default portal C
+			}`),
+			want: &AuthnMiddleware{
+				RouteMatcher: "*",
+				PortalName:   "C",
+				PortalSelectors: []*PortalSelector{
+					{Host: "a.example.com", PortalName: "A"},
+					{Host: "*.b.example.com", PortalName: "B"},
+				},
+			},
+		},
+		{
+			name: "test portal selection block with route matcher and without default",
+			d: caddyfile.NewTestDispenser(`authenticate not /assets/* with {
+				host a.example.com portal {http.request.host.labels.2}
+			}`),
+			want: &AuthnMiddleware{
+				RouteMatcher: "not /assets/*",
+				PortalSelectors: []*PortalSelector{
+					{Host: "a.example.com", PortalName: "{http.request.host.labels.2}"},
+				},
+			},
+		},
+		{
+			name: "test portal selection block with duplicate default",
+			d: caddyfile.NewTestDispenser(`authenticate with {
+				default portal A
+				default portal B
+			}`),
+			shouldErr: true,
+			err:       fmt.Errorf("duplicate default portal: default portal B, at Testfile:3"),
+		},
+		{
+			name: "test portal selection block with malformed selector",
+			d: caddyfile.NewTestDispenser(`authenticate with {
+				host a.example.com A
+			}`),
+			shouldErr: true,
+			err:       fmt.Errorf("malformed portal selector: host a.example.com A, at Testfile:2"),
+		},
+		{
+			name:      "test empty portal selection block",
+			d:         caddyfile.NewTestDispenser(`authenticate with`),
+			shouldErr: true,
+			err:       fmt.Errorf("portal selection block is empty, at Testfile:1"),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &AuthnMiddleware{}
+			err := m.UnmarshalCaddyfile(tc.d)
+			if err != nil {
+				if !tc.shouldErr {
+					t.Fatalf("expected success, got: %v", err)
+				}
+				if diff := cmp.Diff(err.Error(), tc.err.Error()); diff != "" {
+					t.Fatalf("unexpected error: %v, want: %v", err, tc.err)
+				}
+				return
+			}
+			if tc.shouldErr {
+				t.Fatalf("unexpected success, want: %v", tc.err)
+			}
+			if diff := cmp.Diff(tc.want.RouteMatcher, m.RouteMatcher); diff != "" {
+				t.Errorf("route matcher mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.want.PortalName, m.PortalName); diff != "" {
+				t.Errorf("default portal mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.want.PortalSelectors, m.PortalSelectors); diff != "" {
+				t.Errorf("portal selectors mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestGetPortalByHost(t *testing.T) {
+	portals := map[string]*authn.Portal{
+		"A":      {},
+		"B":      {},
+		"C":      {},
+		"tenant": {},
+	}
+	m := &AuthnMiddleware{
+		PortalName: "C",
+		PortalSelectors: []*PortalSelector{
+			{Host: "a.example.com", PortalName: "A"},
+			{Host: "*.b.example.com", PortalName: "B"},
+			{Host: "*.tenants.example.com", PortalName: "{http.request.host.labels.3}"},
+		},
+		server: &server{portals: portals},
+	}
+
+	testcases := []struct {
+		name      string
+		host      string
+		want      string
+		shouldErr bool
+		err       error
+	}{
+		{name: "test exact host", host: "a.example.com", want: "A"},
+		{name: "test exact host with port and mixed case", host: "A.Example.com:8443", want: "A"},
+		{name: "test wildcard host", host: "foo.b.example.com", want: "B"},
+		{name: "test wildcard host with multiple labels", host: "bar.foo.b.example.com", want: "C"},
+		{name: "test default portal", host: "b.example.com", want: "C"},
+		{name: "test portal name with placeholders", host: "tenant.tenants.example.com", want: "tenant"},
+		{
+			name:      "test portal name with placeholders without portal",
+			host:      "foo.tenants.example.com",
+			shouldErr: true,
+			err:       fmt.Errorf(`authentication portal "foo" not found for host "foo.tenants.example.com"`),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Host = tc.host
+			repl := caddy.NewReplacer()
+			repl.Map(func(key string) (any, bool) {
+				if key == "http.request.host.labels.3" {
+					return r.Host[:len(r.Host)-len(".tenants.example.com")], true
+				}
+				return nil, false
+			})
+			r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+
+			name, portal, err := m.getPortal(r)
+			if err != nil {
+				if !tc.shouldErr {
+					t.Fatalf("expected success, got: %v", err)
+				}
+				if diff := cmp.Diff(err.Error(), tc.err.Error()); diff != "" {
+					t.Fatalf("unexpected error: %v, want: %v", err, tc.err)
+				}
+				return
+			}
+			if tc.shouldErr {
+				t.Fatalf("unexpected success, want: %v", tc.err)
+			}
+			if diff := cmp.Diff(tc.want, name); diff != "" {
+				t.Errorf("portal name mismatch (-want +got):\n%s", diff)
+			}
+			if portal != portals[tc.want] {
+				t.Errorf("unexpected portal instance for %q", tc.want)
+			}
+		})
+	}
+}
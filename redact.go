@@ -0,0 +1,191 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	cfgutil "github.com/greenpau/go-authcrunch/pkg/util/cfg"
+	"go.uber.org/zap"
+)
+
+const (
+	redactedValue = "**redacted**"
+
+	// redactedAdapterName is the name of the config adapter printing the
+	// Caddyfile with the security app secrets redacted, i.e.
+	// "caddy adapt --adapter caddyfile-redacted".
+	redactedAdapterName = "caddyfile-redacted"
+)
+
+func init() {
+	caddyconfig.RegisterAdapter(redactedAdapterName, redactedAdapter{
+		Adapter: caddyfile.Adapter{ServerType: httpcaddyfile.ServerType{}},
+	})
+}
+
+// redactedAdapter adapts the Caddyfile and redacts the sensitive values
+// of the security app. The adapted config is meant to be shared, not
+// loaded.
+type redactedAdapter struct {
+	caddyconfig.Adapter
+}
+
+// Adapt adapts the Caddyfile to JSON with the secrets redacted.
+func (a redactedAdapter) Adapt(body []byte, options map[string]interface{}) ([]byte, []caddyconfig.Warning, error) {
+	result, warnings, err := a.Adapter.Adapt(body, options)
+	if err != nil {
+		return nil, warnings, err
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(result, &config); err != nil {
+		return nil, warnings, err
+	}
+	if apps, ok := config["apps"].(map[string]interface{}); ok {
+		if app, exists := apps[appName]; exists {
+			apps[appName] = redactValue("", app)
+		}
+	}
+	b, err := json.Marshal(config)
+	if err != nil {
+		return nil, warnings, err
+	}
+	return b, warnings, nil
+}
+
+// placeholderRegexp matches the values consisting of a single placeholder,
+// e.g. "{env.CLIENT_SECRET}". The other values in braces, e.g. JSON
+// documents, may hold secrets.
+var placeholderRegexp = regexp.MustCompile(`^\{[a-zA-Z0-9_.:-]+\}$`)
+
+// sensitiveConfigKeys are the keys of config maps and the leading keywords
+// of config instructions holding credentials.
+var sensitiveConfigKeys = map[string]bool{
+	"password":      true,
+	"bind_password": true,
+	"client_secret": true,
+	"token_secret":  true,
+	"shared_secret": true,
+	"secret":        true,
+	"api_key":       true,
+	"private_key":   true,
+	"secret_key":    true,
+	"cache_key":     true,
+}
+
+// redactSecret returns the placeholder of a sensitive value. The
+// placeholder carries a truncated SHA-256 fingerprint of the value, so
+// that the equal values have equal placeholders. The secret references
+// and the placeholders, e.g. "{env.CLIENT_SECRET}", are not sensitive.
+func redactSecret(s string) string {
+	if hasSecretKey(s) || placeholderRegexp.MatchString(s) {
+		return s
+	}
+	sum := sha256.Sum256([]byte(s))
+	return redactedValue + "(sha256:" + hex.EncodeToString(sum[:6]) + ")"
+}
+
+// checkRedactedValue returns an error when the value was redacted, e.g.
+// the config printed by the redacting adapter was loaded.
+func checkRedactedValue(path, s string) error {
+	if strings.Contains(s, redactedValue+"(sha256:") {
+		return fmt.Errorf("%s: holds redacted value, the config adapted with %q adapter cannot be loaded", path, redactedAdapterName)
+	}
+	return nil
+}
+
+// redactedField returns a zap field holding the config with sensitive
+// values replaced with placeholders.
+func redactedField(key string, data interface{}) zap.Field {
+	return zap.Any(key, redactConfig(data))
+}
+
+// redactConfig returns a copy of the provided config with sensitive values
+// replaced with a placeholder.
+func redactConfig(data interface{}) interface{} {
+	var m interface{}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil
+	}
+	return redactValue("", m)
+}
+
+func redactValue(key string, data interface{}) interface{} {
+	switch v := data.(type) {
+	case map[string]interface{}:
+		for k, entry := range v {
+			v[k] = redactValue(k, entry)
+		}
+		return v
+	case []interface{}:
+		for i, entry := range v {
+			v[i] = redactValue(key, entry)
+		}
+		return v
+	case string:
+		if sensitiveConfigKeys[key] && v != "" {
+			return redactSecret(v)
+		}
+		return redactInstruction(v)
+	}
+	return data
+}
+
+// redactInstruction redacts the values in config instructions, e.g.
+// "password foo" or "crypto key sign-verify foo".
+func redactInstruction(s string) string {
+	args, err := cfgutil.DecodeArgs(s)
+	if err != nil || len(args) < 2 {
+		return s
+	}
+	var redacted bool
+	if sensitiveConfigKeys[args[0]] {
+		for i := 1; i < len(args); i++ {
+			args[i] = redactSecret(args[i])
+		}
+		redacted = true
+	}
+	if args[0] == cryptoKeyword {
+		for i := 1; i < len(args)-1; i++ {
+			switch args[i] {
+			case "sign-verify", "sign", "verify":
+			default:
+				continue
+			}
+			if args[i+1] == "from" {
+				break
+			}
+			args[i+1] = redactSecret(args[i+1])
+			redacted = true
+			break
+		}
+	}
+	if !redacted {
+		return s
+	}
+	return cfgutil.EncodeArgs(args)
+}
@@ -0,0 +1,156 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+const (
+	routeMatcherAny    = "*"
+	routeMatcherNot    = "not"
+	routeMatcherPrefix = "@"
+)
+
+// parseRouteMatcherArgs parses the route matcher of the authenticate and
+// authorize directives, i.e. the arguments between the directive name and
+// the "with" keyword. The supported forms are:
+//
+//	<directive> with <name>
+//	<directive> <path_glob> with <name>
+//	<directive> not <path_glob|@matcher_name> with <name>
+//
+// The path and named matchers preceding the "with" keyword directly are
+// handled by Caddy itself, because it wraps the directive in a route.
+func parseRouteMatcherArgs(args []string) (string, error) {
+	switch len(args) {
+	case 0:
+		return routeMatcherAny, nil
+	case 1:
+		if args[0] == routeMatcherNot {
+			return "", fmt.Errorf("route matcher negation requires a matcher")
+		}
+		if strings.HasPrefix(args[0], routeMatcherPrefix) {
+			return "", fmt.Errorf("named route matcher %q must precede the directive arguments", args[0])
+		}
+		return args[0], nil
+	case 2:
+		if args[0] != routeMatcherNot {
+			return "", fmt.Errorf("route matcher must start with %q keyword: %s", routeMatcherNot, strings.Join(args, " "))
+		}
+		if args[1] == routeMatcherAny || args[1] == routeMatcherNot {
+			return "", fmt.Errorf("unsupported negated route matcher: %s", args[1])
+		}
+		return strings.Join(args, " "), nil
+	}
+	return "", fmt.Errorf("malformed route matcher: %s", strings.Join(args, " "))
+}
+
+// hasNamedRouteMatcher returns true when the route matcher refers to a named
+// matcher, which is only resolvable when adapting a Caddyfile.
+func hasNamedRouteMatcher(s string) bool {
+	_, name := splitRouteMatcher(s)
+	return strings.HasPrefix(name, routeMatcherPrefix)
+}
+
+func splitRouteMatcher(s string) (bool, string) {
+	if name, found := strings.CutPrefix(s, routeMatcherNot+" "); found {
+		return true, name
+	}
+	return false, s
+}
+
+// getRouteMatcherSets returns the raw matcher sets for the provided route
+// matcher. The named matchers are resolved with Caddyfile helper. When the
+// helper is nil, e.g. for JSON configs, the named matchers are not supported.
+func getRouteMatcherSets(s string, h *httpcaddyfile.Helper) (caddyhttp.RawMatcherSets, error) {
+	if s == "" || s == routeMatcherAny {
+		return nil, nil
+	}
+
+	negated, name := splitRouteMatcher(s)
+
+	var matcherSet caddy.ModuleMap
+	switch {
+	case strings.HasPrefix(name, routeMatcherPrefix):
+		if h == nil {
+			return nil, fmt.Errorf("named route matcher %q is supported in Caddyfile only", name)
+		}
+		ms, err := getNamedMatcherSet(h, name)
+		if err != nil {
+			return nil, err
+		}
+		matcherSet = ms
+	default:
+		matcherSet = caddy.ModuleMap{
+			"path": caddyconfig.JSON(caddyhttp.MatchPath{name}, nil),
+		}
+	}
+
+	if negated {
+		matcherSet = caddy.ModuleMap{
+			"not": caddyconfig.JSON(caddyhttp.MatchNot{
+				MatcherSetsRaw: []caddy.ModuleMap{matcherSet},
+			}, nil),
+		}
+	}
+
+	return caddyhttp.RawMatcherSets{matcherSet}, nil
+}
+
+// getNamedMatcherSet returns the definition of the named matcher referenced
+// in the arguments of the directive being parsed.
+func getNamedMatcherSet(h *httpcaddyfile.Helper, name string) (caddy.ModuleMap, error) {
+	h.Reset()
+	h.Next()
+	for h.NextArg() {
+		if h.Val() != name {
+			continue
+		}
+		h.Prev()
+		ms, found, err := h.MatcherToken()
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			return ms, nil
+		}
+		break
+	}
+	return nil, fmt.Errorf("unrecognized matcher name: %s", name)
+}
+
+// loadRouteMatcherSets loads the raw matcher sets in the provided field
+// of a module.
+func loadRouteMatcherSets(ctx caddy.Context, m interface{}, fieldName string, raw caddyhttp.RawMatcherSets) (caddyhttp.MatcherSets, error) {
+	var matcherSets caddyhttp.MatcherSets
+	if len(raw) == 0 {
+		return matcherSets, nil
+	}
+	mods, err := ctx.LoadModule(m, fieldName)
+	if err != nil {
+		return nil, fmt.Errorf("loading route matchers: %v", err)
+	}
+	if err := matcherSets.FromInterface(mods); err != nil {
+		return nil, err
+	}
+	return matcherSets, nil
+}
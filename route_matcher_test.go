@@ -0,0 +1,166 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseRouteMatcher(t *testing.T) {
+	testcases := []struct {
+		name      string
+		d         *caddyfile.Dispenser
+		want      string
+		shouldErr bool
+		err       error
+	}{
+		{
+			name: "test directive without route matcher",
+			d:    caddyfile.NewTestDispenser(`authenticate with myportal`),
+			want: "*",
+		},
+		{
+			name: "test directive with path glob route matcher",
+			d:    caddyfile.NewTestDispenser(`authenticate *.html with myportal`),
+			want: "*.html",
+		},
+		{
+			name: "test directive with negated path route matcher",
+			d:    caddyfile.NewTestDispenser(`authenticate not /assets/* with myportal`),
+			want: "not /assets/*",
+		},
+		{
+			name: "test directive with negated named route matcher",
+			d:    caddyfile.NewTestDispenser(`authenticate not @public with myportal`),
+			want: "not @public",
+		},
+		{
+			name:      "test directive with negated wildcard route matcher",
+			d:         caddyfile.NewTestDispenser(`authenticate not * with myportal`),
+			shouldErr: true,
+			err:       fmt.Errorf("unsupported negated route matcher: *: authenticate not * with myportal, at Testfile:1"),
+		},
+		{
+			name:      "test directive with malformed route matcher",
+			d:         caddyfile.NewTestDispenser(`authenticate foo /bar with myportal`),
+			shouldErr: true,
+			err:       fmt.Errorf(`route matcher must start with "not" keyword: foo /bar: authenticate foo /bar with myportal, at Testfile:1`),
+		},
+		{
+			name:      "test directive without with keyword",
+			d:         caddyfile.NewTestDispenser(`authenticate not /foo for myportal`),
+			shouldErr: true,
+			err:       fmt.Errorf(`directive must contain "with" keyword: authenticate not /foo for myportal, at Testfile:1`),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &AuthnMiddleware{}
+			err := m.UnmarshalCaddyfile(tc.d)
+			if err != nil {
+				if !tc.shouldErr {
+					t.Fatalf("expected success, got: %v", err)
+				}
+				if diff := cmp.Diff(err.Error(), tc.err.Error()); diff != "" {
+					t.Fatalf("unexpected error: %v, want: %v", err, tc.err)
+				}
+				return
+			}
+			if tc.shouldErr {
+				t.Fatalf("unexpected success, want: %v", tc.err)
+			}
+			if diff := cmp.Diff(tc.want, m.RouteMatcher); diff != "" {
+				t.Errorf("UnmarshalCaddyfile() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRouteMatcherSets(t *testing.T) {
+	testcases := []struct {
+		name         string
+		routeMatcher string
+		want         map[string]bool
+	}{
+		{
+			name:         "test wildcard route matcher",
+			routeMatcher: "*",
+			want: map[string]bool{
+				"/":           true,
+				"/app/assets": true,
+			},
+		},
+		{
+			name:         "test path glob route matcher",
+			routeMatcher: "/app/*",
+			want: map[string]bool{
+				"/":            false,
+				"/app/foo":     true,
+				"/app/foo/bar": true,
+			},
+		},
+		{
+			name:         "test negated path glob route matcher",
+			routeMatcher: "not /app/assets/*",
+			want: map[string]bool{
+				"/app/foo":            true,
+				"/app/assets/app.js":  false,
+				"/app/assets/app.css": false,
+			},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+
+			m := &AuthnMiddleware{RouteMatcher: tc.routeMatcher}
+			raw, err := getRouteMatcherSets(m.RouteMatcher, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			m.RouteMatcherSetsRaw = raw
+			matcherSets, err := loadRouteMatcherSets(ctx, m, "RouteMatcherSetsRaw", m.RouteMatcherSetsRaw)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := make(map[string]bool)
+			for p := range tc.want {
+				r := httptest.NewRequest("GET", p, nil)
+				r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+				matched, err := matcherSets.AnyMatchWithError(r)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				got[p] = matched
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("route matcher mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	if _, err := getRouteMatcherSets("not @public", nil); err == nil {
+		t.Errorf("expected named route matcher error in JSON config")
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+const (
+	secretsBundleVersion = 1
+	secretsBundleCipher  = "aes-256-gcm"
+	secretsBundleKeySize = 32
+)
+
+func init() {
+	caddy.RegisterModule(EncryptedSecretsManager{})
+}
+
+// EncryptedSecretsManager is a secrets manager reading secrets from an
+// encrypted bundle, i.e. a JSON, YAML, or dotenv file encrypted with
+// AES-256-GCM. The bundle is safe to keep alongside the Caddyfile, the key
+// is not. The bundles are maintained with "authcrunch secrets" command.
+type EncryptedSecretsManager struct {
+	ID   string `json:"id,omitempty" xml:"id,omitempty" yaml:"id,omitempty"`
+	Path string `json:"path,omitempty" xml:"path,omitempty" yaml:"path,omitempty"`
+	// Format is the format of the decrypted bundle, i.e. "json", "yaml", or
+	// "dotenv". When empty, the format is derived from the file extension,
+	// e.g. "secrets.yaml.enc" is "yaml".
+	Format string `json:"format,omitempty" xml:"format,omitempty" yaml:"format,omitempty"`
+	// KeyFile is the file holding base64-encoded 32-byte key.
+	KeyFile string `json:"key_file,omitempty" xml:"key_file,omitempty" yaml:"key_file,omitempty"`
+	// KeyEnv is the environment variable holding base64-encoded 32-byte key.
+	KeyEnv string `json:"key_env,omitempty" xml:"key_env,omitempty" yaml:"key_env,omitempty"`
+
+	secrets map[string]interface{}
+}
+
+// secretsBundle is the encrypted secrets file.
+type secretsBundle struct {
+	Version int    `json:"version"`
+	Cipher  string `json:"cipher"`
+	Nonce   string `json:"nonce"`
+	Data    string `json:"data"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (EncryptedSecretsManager) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  secretsPrefix + ".encrypted",
+		New: func() caddy.Module { return new(EncryptedSecretsManager) },
+	}
+}
+
+// UnmarshalCaddyfile unmarshals a caddyfile.
+//
+// Syntax:
+//
+//	secrets encrypted <secret_id> {
+//	  path <path>
+//	  format <json|yaml|dotenv>
+//	  key file <path>
+//	  key env <name>
+//	}
+func (m *EncryptedSecretsManager) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume secret id
+	m.ID = d.Val()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		k := d.Val()
+		args := d.RemainingArgs()
+		switch {
+		case k == "path" && len(args) == 1:
+			m.Path = args[0]
+		case k == "format" && len(args) == 1:
+			m.Format = args[0]
+		case k == "key" && len(args) == 2 && args[0] == "file":
+			m.KeyFile = args[1]
+		case k == "key" && len(args) == 2 && args[0] == "env":
+			m.KeyEnv = args[1]
+		case k == "path", k == "format", k == "key":
+			return d.Errf("%s directive has malformed value: %s", k, strings.Join(args, " "))
+		default:
+			return d.Errf("unsupported encrypted secrets manager directive: %s", k)
+		}
+	}
+	return nil
+}
+
+// Provision decrypts the secrets.
+func (m *EncryptedSecretsManager) Provision(_ caddy.Context) error {
+	repl := caddy.NewReplacer()
+	m.Path = repl.ReplaceKnown(m.Path, "")
+	m.KeyFile = repl.ReplaceKnown(m.KeyFile, "")
+	if m.Format == "" {
+		m.Format = getSecretsBundleFormat(m.Path)
+	}
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	key, err := loadSecretsBundleKey(m.KeyFile, m.KeyEnv)
+	if err != nil {
+		return fmt.Errorf("encrypted secrets manager %q erred: %v", m.ID, err)
+	}
+	b, err := os.ReadFile(m.Path)
+	if err != nil {
+		return fmt.Errorf("encrypted secrets manager %q erred: %v", m.ID, err)
+	}
+	plaintext, err := decryptSecretsBundle(key, b)
+	if err != nil {
+		return fmt.Errorf("encrypted secrets manager %q erred: %q: %v", m.ID, m.Path, err)
+	}
+	if m.secrets, err = parseSecrets(plaintext, m.Format); err != nil {
+		return fmt.Errorf("encrypted secrets manager %q erred: failed to parse %q: %v", m.ID, m.Path, err)
+	}
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (m *EncryptedSecretsManager) Validate() error {
+	if m.ID == "" {
+		return fmt.Errorf("encrypted secrets manager id is empty")
+	}
+	if m.Path == "" {
+		return fmt.Errorf("encrypted secrets manager %q path is empty", m.ID)
+	}
+	switch m.Format {
+	case secretsFormatJSON, secretsFormatYAML, secretsFormatDotenv:
+	default:
+		return fmt.Errorf("encrypted secrets manager %q has unsupported format: %q", m.ID, m.Format)
+	}
+	if (m.KeyFile == "") == (m.KeyEnv == "") {
+		return fmt.Errorf("encrypted secrets manager %q requires either key file or key env", m.ID)
+	}
+	return nil
+}
+
+// GetConfig returns the config of the secrets manager.
+func (m *EncryptedSecretsManager) GetConfig(_ context.Context) map[string]interface{} {
+	return map[string]interface{}{
+		"id":       m.ID,
+		"driver":   "encrypted",
+		"path":     m.Path,
+		"format":   m.Format,
+		"key_file": m.KeyFile,
+		"key_env":  m.KeyEnv,
+	}
+}
+
+// GetSecret returns the secret.
+func (m *EncryptedSecretsManager) GetSecret(_ context.Context) (map[string]interface{}, error) {
+	if m.secrets == nil {
+		return nil, fmt.Errorf("encrypted secrets manager %q has no secrets", m.ID)
+	}
+	secrets := make(map[string]interface{}, len(m.secrets))
+	for k, v := range m.secrets {
+		secrets[k] = v
+	}
+	return secrets, nil
+}
+
+// GetSecretByKey returns the value of the secret key.
+func (m *EncryptedSecretsManager) GetSecretByKey(_ context.Context, key string) (interface{}, error) {
+	v, exists := m.secrets[key]
+	if !exists {
+		return nil, fmt.Errorf("encrypted secrets manager %q has no %q key", m.ID, key)
+	}
+	return v, nil
+}
+
+// getSecretsBundleFormat returns the format of the decrypted bundle based
+// on the file extension, e.g. "secrets.yaml.enc" is "yaml".
+func getSecretsBundleFormat(s string) string {
+	return getSecretsFileFormat(strings.TrimSuffix(s, ".enc"))
+}
+
+// loadSecretsBundleKey returns the key from the file or the environment
+// variable. The key file must not be accessible by group or others.
+func loadSecretsBundleKey(keyFile, keyEnv string) ([]byte, error) {
+	var s string
+	switch {
+	case keyFile != "":
+		b, err := readPrivateFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		s = string(b)
+	case keyEnv != "":
+		v, exists := os.LookupEnv(keyEnv)
+		if !exists {
+			return nil, fmt.Errorf("environment variable %s is not set", keyEnv)
+		}
+		s = v
+	default:
+		return nil, fmt.Errorf("key is not configured")
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("key is not base64-encoded: %v", err)
+	}
+	if len(key) != secretsBundleKeySize {
+		return nil, fmt.Errorf("key is %d bytes long, expected %d", len(key), secretsBundleKeySize)
+	}
+	return key, nil
+}
+
+// encryptSecretsBundle encrypts the plaintext to a bundle.
+func encryptSecretsBundle(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newSecretsBundleCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	bundle := &secretsBundle{
+		Version: secretsBundleVersion,
+		Cipher:  secretsBundleCipher,
+		Nonce:   base64.StdEncoding.EncodeToString(nonce),
+		Data:    base64.StdEncoding.EncodeToString(gcm.Seal(nil, nonce, plaintext, nil)),
+	}
+	b, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// decryptSecretsBundle decrypts the bundle to the plaintext.
+func decryptSecretsBundle(key, b []byte) ([]byte, error) {
+	bundle := &secretsBundle{}
+	if err := json.Unmarshal(b, bundle); err != nil {
+		return nil, fmt.Errorf("malformed bundle: %v", err)
+	}
+	if bundle.Version != secretsBundleVersion || bundle.Cipher != secretsBundleCipher {
+		return nil, fmt.Errorf("unsupported bundle version %d with %q cipher", bundle.Version, bundle.Cipher)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(bundle.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("malformed bundle nonce: %v", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(bundle.Data)
+	if err != nil {
+		return nil, fmt.Errorf("malformed bundle data: %v", err)
+	}
+	gcm, err := newSecretsBundleCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("malformed bundle nonce")
+	}
+	plaintext, err := gcm.Open(nil, nonce, data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt bundle, wrong key or tampered data")
+	}
+	return plaintext, nil
+}
+
+func newSecretsBundleCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*EncryptedSecretsManager)(nil)
+	_ caddy.Validator       = (*EncryptedSecretsManager)(nil)
+	_ caddyfile.Unmarshaler = (*EncryptedSecretsManager)(nil)
+	_ SecretsManager        = (*EncryptedSecretsManager)(nil)
+)
@@ -0,0 +1,287 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+const (
+	testSecretsBundleKey   = "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+	testSecretsBundleOther = "HxwdHh8AAQIDBAUGBwgJCgsMDQ4PEBESExQVFhcYGRo="
+)
+
+func TestEncryptedSecretsManager(t *testing.T) {
+	testcases := []struct {
+		name      string
+		plaintext string
+		path      string
+		format    string
+		keyFile   string
+		keyMode   os.FileMode
+		keyEnv    string
+		bundle    string
+		want      map[string]interface{}
+		shouldErr bool
+		err       string
+	}{
+		{
+			name:      "test json bundle with key file",
+			plaintext: `{"shared_secret": "foo", "users": {"jsmith": "bar"}}`,
+			path:      "secrets.json.enc",
+			keyFile:   testSecretsBundleKey,
+			want: map[string]interface{}{
+				"shared_secret": "foo",
+				"users":         map[string]interface{}{"jsmith": "bar"},
+			},
+		},
+		{
+			name:      "test yaml bundle with key env",
+			plaintext: "shared_secret: foo\n",
+			path:      "secrets.yaml.enc",
+			keyEnv:    testSecretsBundleKey,
+			want: map[string]interface{}{
+				"shared_secret": "foo",
+			},
+		},
+		{
+			name:      "test dotenv bundle with explicit format",
+			plaintext: "SHARED_SECRET=foo\n",
+			path:      "secrets.bin",
+			format:    "dotenv",
+			keyEnv:    testSecretsBundleKey,
+			want: map[string]interface{}{
+				"SHARED_SECRET": "foo",
+			},
+		},
+		{
+			name:      "test wrong key",
+			plaintext: `{"shared_secret": "foo"}`,
+			path:      "secrets.json.enc",
+			keyEnv:    testSecretsBundleOther,
+			shouldErr: true,
+			err:       `encrypted secrets manager "mysecrets" erred: "{dir}/secrets.json.enc": failed to decrypt bundle, wrong key or tampered data`,
+		},
+		{
+			name:      "test short key",
+			plaintext: `{"shared_secret": "foo"}`,
+			path:      "secrets.json.enc",
+			keyEnv:    base64.StdEncoding.EncodeToString([]byte("foo")),
+			shouldErr: true,
+			err:       `encrypted secrets manager "mysecrets" erred: key is 3 bytes long, expected 32`,
+		},
+		{
+			name:      "test unsupported bundle version",
+			path:      "secrets.json.enc",
+			keyEnv:    testSecretsBundleKey,
+			bundle:    `{"version": 2, "cipher": "aes-256-gcm"}`,
+			shouldErr: true,
+			err:       `encrypted secrets manager "mysecrets" erred: "{dir}/secrets.json.enc": unsupported bundle version 2 with "aes-256-gcm" cipher`,
+		},
+		{
+			name:      "test malformed plaintext",
+			plaintext: `{"shared_secret":`,
+			path:      "secrets.json.enc",
+			keyEnv:    testSecretsBundleKey,
+			shouldErr: true,
+			err:       `encrypted secrets manager "mysecrets" erred: failed to parse "{dir}/secrets.json.enc": unexpected end of JSON input`,
+		},
+		{
+			name:      "test group-readable key file",
+			plaintext: `{"shared_secret": "foo"}`,
+			path:      "secrets.json.enc",
+			keyFile:   testSecretsBundleKey,
+			keyMode:   0o640,
+			shouldErr: true,
+			err:       `encrypted secrets manager "mysecrets" erred: "{dir}/secrets.key" has loose permissions 0640, expected no more than 0600`,
+		},
+		{
+			name:      "test without key",
+			path:      "secrets.json.enc",
+			shouldErr: true,
+			err:       `encrypted secrets manager "mysecrets" requires either key file or key env`,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if runtime.GOOS == "windows" && tc.keyMode != 0 {
+				t.Skip("file permissions are not checked on windows")
+			}
+			dir := t.TempDir()
+			bundle := []byte(tc.bundle)
+			if tc.bundle == "" {
+				key, _ := base64.StdEncoding.DecodeString(testSecretsBundleKey)
+				b, err := encryptSecretsBundle(key, []byte(tc.plaintext))
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				bundle = b
+			}
+			if err := os.WriteFile(filepath.Join(dir, tc.path), bundle, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			m := &EncryptedSecretsManager{
+				ID:     "mysecrets",
+				Path:   filepath.Join(dir, tc.path),
+				Format: tc.format,
+			}
+			if tc.keyFile != "" {
+				m.KeyFile = filepath.Join(dir, "secrets.key")
+				keyMode := tc.keyMode
+				if keyMode == 0 {
+					keyMode = 0o600
+				}
+				if err := os.WriteFile(m.KeyFile, []byte(tc.keyFile+"\n"), keyMode); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chmod(m.KeyFile, keyMode); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.keyEnv != "" {
+				m.KeyEnv = "TEST_SECRETS_BUNDLE_KEY"
+				t.Setenv(m.KeyEnv, tc.keyEnv)
+			}
+
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+			err := m.Provision(ctx)
+			if err != nil {
+				if !tc.shouldErr {
+					t.Fatalf("expected success, got: %v", err)
+				}
+				want := strings.ReplaceAll(tc.err, "{dir}", dir)
+				if diff := cmp.Diff(want, err.Error()); diff != "" {
+					t.Fatalf("unexpected error mismatch (-want +got):\n%s", diff)
+				}
+				return
+			}
+			if tc.shouldErr {
+				t.Fatalf("unexpected success, want: %v", tc.err)
+			}
+
+			got, err := m.GetSecret(ctx)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("GetSecret() mismatch (-want +got):\n%s", diff)
+			}
+			for k, v := range tc.want {
+				value, err := m.GetSecretByKey(ctx, k)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if diff := cmp.Diff(v, value); diff != "" {
+					t.Errorf("GetSecretByKey(%q) mismatch (-want +got):\n%s", k, diff)
+				}
+			}
+			if _, err := m.GetSecretByKey(ctx, "missing"); err == nil {
+				t.Errorf("GetSecretByKey() expected error for missing key")
+			}
+		})
+	}
+}
+
+func TestUnmarshalEncryptedSecretsManager(t *testing.T) {
+	testcases := []struct {
+		name      string
+		d         *caddyfile.Dispenser
+		want      *EncryptedSecretsManager
+		shouldErr bool
+		err       error
+	}{
+		{
+			name: "test encrypted secrets manager with key file",
+			d: caddyfile.NewTestDispenser(`
+			mysecrets {
+				path /etc/caddy/secrets.yaml.enc
+				key file /etc/caddy/secrets.key
+			}`),
+			want: &EncryptedSecretsManager{
+				ID:      "mysecrets",
+				Path:    "/etc/caddy/secrets.yaml.enc",
+				KeyFile: "/etc/caddy/secrets.key",
+			},
+		},
+		{
+			name: "test encrypted secrets manager with key env",
+			d: caddyfile.NewTestDispenser(`
+			mysecrets {
+				path /etc/caddy/secrets.enc
+				format dotenv
+				key env SECRETS_KEY
+			}`),
+			want: &EncryptedSecretsManager{
+				ID:     "mysecrets",
+				Path:   "/etc/caddy/secrets.enc",
+				Format: "dotenv",
+				KeyEnv: "SECRETS_KEY",
+			},
+		},
+		{
+			name: "test encrypted secrets manager with malformed key",
+			d: caddyfile.NewTestDispenser(`
+			mysecrets {
+				key /etc/caddy/secrets.key
+			}`),
+			shouldErr: true,
+			err:       fmt.Errorf("key directive has malformed value: /etc/caddy/secrets.key, at %s:3", tf),
+		},
+		{
+			name: "test encrypted secrets manager with unsupported directive",
+			d: caddyfile.NewTestDispenser(`
+			mysecrets {
+				password foo
+			}`),
+			shouldErr: true,
+			err:       fmt.Errorf("unsupported encrypted secrets manager directive: password, at %s:3", tf),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &EncryptedSecretsManager{}
+			err := m.UnmarshalCaddyfile(tc.d)
+			if err != nil {
+				if !tc.shouldErr {
+					t.Fatalf("expected success, got: %v", err)
+				}
+				if diff := cmp.Diff(tc.err.Error(), err.Error()); diff != "" {
+					t.Fatalf("unexpected error mismatch (-want +got):\n%s", diff)
+				}
+				return
+			}
+			if tc.shouldErr {
+				t.Fatalf("unexpected success, want: %v", tc.err)
+			}
+			if diff := cmp.Diff(tc.want, m, cmpopts.IgnoreUnexported(EncryptedSecretsManager{})); diff != "" {
+				t.Errorf("UnmarshalCaddyfile() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+var (
+	// unsetEnvSecrets holds the environment variables removed from the
+	// process environment by the env secrets managers. The config reloads
+	// find the variables there.
+	unsetEnvSecrets   = make(map[string]string)
+	unsetEnvSecretsMu sync.Mutex
+)
+
+func init() {
+	caddy.RegisterModule(EnvSecretsManager{})
+}
+
+// EnvSecretsManager is a secrets manager exposing the environment variables
+// with the configured prefix. The key of a secret is the variable name
+// without the prefix, e.g. "secrets:<id>:DB_PASSWORD" for the variable
+// "CADDY_SECRET_DB_PASSWORD" and the prefix "CADDY_SECRET_".
+type EnvSecretsManager struct {
+	ID     string `json:"id,omitempty" xml:"id,omitempty" yaml:"id,omitempty"`
+	Prefix string `json:"prefix,omitempty" xml:"prefix,omitempty" yaml:"prefix,omitempty"`
+	// Unset removes the variables from the process environment after they
+	// are loaded, so that child processes could not read them.
+	Unset bool `json:"unset,omitempty" xml:"unset,omitempty" yaml:"unset,omitempty"`
+
+	secrets map[string]interface{}
+}
+
+// CaddyModule returns the Caddy module information.
+func (EnvSecretsManager) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  secretsPrefix + ".env",
+		New: func() caddy.Module { return new(EnvSecretsManager) },
+	}
+}
+
+// UnmarshalCaddyfile unmarshals a caddyfile.
+//
+// Syntax:
+//
+//	secrets env <secret_id> {
+//	  prefix <prefix>
+//	  unset
+//	}
+func (m *EnvSecretsManager) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume secret id
+	m.ID = d.Val()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		k := d.Val()
+		args := d.RemainingArgs()
+		switch k {
+		case "prefix":
+			if len(args) != 1 {
+				return d.Errf("%s directive has malformed value: %s", k, strings.Join(args, " "))
+			}
+			m.Prefix = args[0]
+		case "unset":
+			if len(args) != 0 {
+				return d.Errf("%s directive has malformed value: %s", k, strings.Join(args, " "))
+			}
+			m.Unset = true
+		default:
+			return d.Errf("unsupported env secrets manager directive: %s", k)
+		}
+	}
+	return nil
+}
+
+// Provision loads the environment variables with the prefix.
+func (m *EnvSecretsManager) Provision(_ caddy.Context) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	m.secrets = loadEnvSecrets(m.Prefix, m.Unset)
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (m *EnvSecretsManager) Validate() error {
+	if m.ID == "" {
+		return fmt.Errorf("env secrets manager id is empty")
+	}
+	if m.Prefix == "" {
+		return fmt.Errorf("env secrets manager %q prefix is empty", m.ID)
+	}
+	return nil
+}
+
+// GetConfig returns the config of the secrets manager.
+func (m *EnvSecretsManager) GetConfig(_ context.Context) map[string]interface{} {
+	return map[string]interface{}{
+		"id":     m.ID,
+		"driver": "env",
+		"prefix": m.Prefix,
+		"unset":  m.Unset,
+	}
+}
+
+// GetSecret returns the secret.
+func (m *EnvSecretsManager) GetSecret(_ context.Context) (map[string]interface{}, error) {
+	if m.secrets == nil {
+		return nil, fmt.Errorf("env secrets manager %q has no secrets", m.ID)
+	}
+	secrets := make(map[string]interface{}, len(m.secrets))
+	for k, v := range m.secrets {
+		secrets[k] = v
+	}
+	return secrets, nil
+}
+
+// GetSecretByKey returns the value of the secret key.
+func (m *EnvSecretsManager) GetSecretByKey(_ context.Context, key string) (interface{}, error) {
+	v, exists := m.secrets[key]
+	if !exists {
+		return nil, fmt.Errorf("env secrets manager %q has no %q key, i.e. %s%s environment variable", m.ID, key, m.Prefix, key)
+	}
+	return v, nil
+}
+
+// loadEnvSecrets returns the environment variables with the prefix, keyed
+// by the variable names without the prefix. When unset is true, the
+// variables are removed from the process environment.
+func loadEnvSecrets(prefix string, unset bool) map[string]interface{} {
+	unsetEnvSecretsMu.Lock()
+	defer unsetEnvSecretsMu.Unlock()
+
+	secrets := make(map[string]interface{})
+	for k, v := range unsetEnvSecrets {
+		if key, found := strings.CutPrefix(k, prefix); found && key != "" {
+			secrets[key] = v
+		}
+	}
+	for _, entry := range os.Environ() {
+		k, v, _ := strings.Cut(entry, "=")
+		key, found := strings.CutPrefix(k, prefix)
+		if !found || key == "" {
+			continue
+		}
+		secrets[key] = v
+		if unset {
+			unsetEnvSecrets[k] = v
+			os.Unsetenv(k)
+		}
+	}
+	return secrets
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*EnvSecretsManager)(nil)
+	_ caddy.Validator       = (*EnvSecretsManager)(nil)
+	_ caddyfile.Unmarshaler = (*EnvSecretsManager)(nil)
+	_ SecretsManager        = (*EnvSecretsManager)(nil)
+)
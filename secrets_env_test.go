@@ -0,0 +1,160 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEnvSecretsManager(t *testing.T) {
+	testcases := []struct {
+		name        string
+		env         map[string]string
+		prefix      string
+		unset       bool
+		want        map[string]interface{}
+		wantUnset   []string
+		secretPath  string
+		secretValue string
+	}{
+		{
+			name: "test env secrets with prefix",
+			env: map[string]string{
+				"TEST_SECRETS_A_SHARED_SECRET": "foo",
+				"TEST_SECRETS_A_DB_PASSWORD":   "bar",
+				"TEST_OTHER_A_SHARED_SECRET":   "baz",
+			},
+			prefix: "TEST_SECRETS_A_",
+			want: map[string]interface{}{
+				"SHARED_SECRET": "foo",
+				"DB_PASSWORD":   "bar",
+			},
+			secretPath:  "secrets:mysecrets:DB_PASSWORD",
+			secretValue: "bar",
+		},
+		{
+			name: "test env secrets unset after load",
+			env: map[string]string{
+				"TEST_SECRETS_B_SHARED_SECRET": "foo",
+			},
+			prefix: "TEST_SECRETS_B_",
+			unset:  true,
+			want: map[string]interface{}{
+				"SHARED_SECRET": "foo",
+			},
+			wantUnset:   []string{"TEST_SECRETS_B_SHARED_SECRET"},
+			secretPath:  "secrets:mysecrets:SHARED_SECRET",
+			secretValue: "foo",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+
+			// The second instance imitates a config reload.
+			for i := 0; i < 2; i++ {
+				m := &EnvSecretsManager{ID: "mysecrets", Prefix: tc.prefix, Unset: tc.unset}
+				if err := m.Provision(ctx); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				got, err := m.GetSecret(ctx)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if diff := cmp.Diff(tc.want, got); diff != "" {
+					t.Errorf("GetSecret() mismatch (-want +got):\n%s", diff)
+				}
+				value, _, err := replaceSecretValue(ctx, []SecretsManager{m}, tc.secretPath)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if value != tc.secretValue {
+					t.Errorf("replaceSecretValue() got %q, want %q", value, tc.secretValue)
+				}
+			}
+
+			for _, k := range tc.wantUnset {
+				if _, exists := os.LookupEnv(k); exists {
+					t.Errorf("environment variable %s is not unset", k)
+				}
+			}
+		})
+	}
+}
+
+func TestUnmarshalEnvSecretsManager(t *testing.T) {
+	testcases := []struct {
+		name      string
+		d         *caddyfile.Dispenser
+		want      *EnvSecretsManager
+		shouldErr bool
+		err       error
+	}{
+		{
+			name: "test env secrets manager",
+			d: caddyfile.NewTestDispenser(`
+			mysecrets {
+				prefix CADDY_SECRET_
+				unset
+			}`),
+			want: &EnvSecretsManager{
+				ID:     "mysecrets",
+				Prefix: "CADDY_SECRET_",
+				Unset:  true,
+			},
+		},
+		{
+			name: "test env secrets manager with malformed prefix",
+			d: caddyfile.NewTestDispenser(`
+			mysecrets {
+				prefix
+			}`),
+			shouldErr: true,
+			err:       fmt.Errorf("prefix directive has malformed value: , at %s:3", tf),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &EnvSecretsManager{}
+			err := m.UnmarshalCaddyfile(tc.d)
+			if err != nil {
+				if !tc.shouldErr {
+					t.Fatalf("expected success, got: %v", err)
+				}
+				if diff := cmp.Diff(tc.err.Error(), err.Error()); diff != "" {
+					t.Fatalf("unexpected error mismatch (-want +got):\n%s", diff)
+				}
+				return
+			}
+			if tc.shouldErr {
+				t.Fatalf("unexpected success, want: %v", tc.err)
+			}
+			if diff := cmp.Diff(tc.want, m, cmp.AllowUnexported(EnvSecretsManager{})); diff != "" {
+				t.Errorf("UnmarshalCaddyfile() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,370 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	secretsFormatJSON   = "json"
+	secretsFormatYAML   = "yaml"
+	secretsFormatDotenv = "dotenv"
+	secretsFormatDir    = "dir"
+
+	// looseSecretsFilePerms are the permission bits that make a secrets
+	// file writable by group, or accessible by others.
+	looseSecretsFilePerms os.FileMode = 0o037
+	// loosePrivateFilePerms are the permission bits that make a key or
+	// a cache file accessible by group or others.
+	loosePrivateFilePerms os.FileMode = 0o077
+)
+
+func init() {
+	caddy.RegisterModule(FileSecretsManager{})
+}
+
+// FileSecretsManager is a secrets manager reading secrets from a JSON,
+// YAML, or dotenv file, or from a directory where each file holds
+// a single key, e.g. mounted Kubernetes or Docker secrets.
+type FileSecretsManager struct {
+	ID   string `json:"id,omitempty" xml:"id,omitempty" yaml:"id,omitempty"`
+	Path string `json:"path,omitempty" xml:"path,omitempty" yaml:"path,omitempty"`
+	// Format is one of "json", "yaml", "dotenv", or "dir". When empty,
+	// the format is derived from the file extension.
+	Format string `json:"format,omitempty" xml:"format,omitempty" yaml:"format,omitempty"`
+	// RefreshInterval is how often the secrets are read again. Zero
+	// disables the refresh.
+	RefreshInterval caddy.Duration `json:"refresh_interval,omitempty" xml:"refresh_interval,omitempty" yaml:"refresh_interval,omitempty"`
+
+	// secrets holds map[string]interface{}, replaced by rotation.
+	secrets atomic.Value
+}
+
+// CaddyModule returns the Caddy module information.
+func (FileSecretsManager) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  secretsPrefix + ".file",
+		New: func() caddy.Module { return new(FileSecretsManager) },
+	}
+}
+
+// UnmarshalCaddyfile unmarshals a caddyfile.
+//
+// Syntax:
+//
+//	secrets file <secret_id> {
+//	  path <path>
+//	  format <json|yaml|dotenv|dir>
+//	  refresh interval <duration>
+//	}
+func (m *FileSecretsManager) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume secret id
+	m.ID = d.Val()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		k := d.Val()
+		args := d.RemainingArgs()
+		switch {
+		case k == "path" && len(args) == 1:
+			m.Path = args[0]
+		case k == "format" && len(args) == 1:
+			m.Format = args[0]
+		case k == "refresh" && len(args) == 2 && args[0] == "interval":
+			interval, err := caddy.ParseDuration(args[1])
+			if err != nil {
+				return d.Errf("%s directive has malformed value: %s: %v", k, strings.Join(args, " "), err)
+			}
+			m.RefreshInterval = caddy.Duration(interval)
+		case k == "path", k == "format", k == "refresh":
+			return d.Errf("%s directive has malformed value: %s", k, strings.Join(args, " "))
+		default:
+			return d.Errf("unsupported file secrets manager directive: %s", k)
+		}
+	}
+	return nil
+}
+
+// Provision reads the secrets.
+func (m *FileSecretsManager) Provision(ctx caddy.Context) error {
+	repl := caddy.NewReplacer()
+	m.Path = repl.ReplaceKnown(m.Path, "")
+	if m.Format == "" {
+		m.Format = getSecretsFileFormat(m.Path)
+	}
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	secrets, err := readSecretsFile(m.Path, m.Format)
+	if err != nil {
+		return fmt.Errorf("file secrets manager %q erred: %v", m.ID, err)
+	}
+	m.setSecrets(secrets)
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (m *FileSecretsManager) Validate() error {
+	if m.ID == "" {
+		return fmt.Errorf("file secrets manager id is empty")
+	}
+	if m.Path == "" {
+		return fmt.Errorf("file secrets manager %q path is empty", m.ID)
+	}
+	switch m.Format {
+	case secretsFormatJSON, secretsFormatYAML, secretsFormatDotenv, secretsFormatDir:
+	default:
+		return fmt.Errorf("file secrets manager %q has unsupported format: %q", m.ID, m.Format)
+	}
+	if m.RefreshInterval < 0 {
+		return fmt.Errorf("file secrets manager %q has negative refresh interval", m.ID)
+	}
+	return nil
+}
+
+// GetConfig returns the config of the secrets manager.
+func (m *FileSecretsManager) GetConfig(_ context.Context) map[string]interface{} {
+	return map[string]interface{}{
+		"id":     m.ID,
+		"driver": "file",
+		"path":   m.Path,
+		"format": m.Format,
+	}
+}
+
+// GetRotationInterval returns the refresh interval of the secrets.
+func (m *FileSecretsManager) GetRotationInterval(_ context.Context) time.Duration {
+	return time.Duration(m.RefreshInterval)
+}
+
+// RotateSecrets reads the secrets again and returns true when they changed.
+func (m *FileSecretsManager) RotateSecrets(_ context.Context) (bool, error) {
+	secrets, err := readSecretsFile(m.Path, m.Format)
+	if err != nil {
+		return false, fmt.Errorf("file secrets manager %q erred: %v", m.ID, err)
+	}
+	changed := !reflect.DeepEqual(m.getSecrets(), secrets)
+	if changed {
+		m.setSecrets(secrets)
+	}
+	return changed, nil
+}
+
+func (m *FileSecretsManager) getSecrets() map[string]interface{} {
+	secrets, _ := m.secrets.Load().(map[string]interface{})
+	return secrets
+}
+
+func (m *FileSecretsManager) setSecrets(secrets map[string]interface{}) {
+	m.secrets.Store(secrets)
+}
+
+// GetSecret returns the secret.
+func (m *FileSecretsManager) GetSecret(_ context.Context) (map[string]interface{}, error) {
+	current := m.getSecrets()
+	if current == nil {
+		return nil, fmt.Errorf("file secrets manager %q has no secrets", m.ID)
+	}
+	secrets := make(map[string]interface{}, len(current))
+	for k, v := range current {
+		secrets[k] = v
+	}
+	return secrets, nil
+}
+
+// GetSecretByKey returns the value of the secret key.
+func (m *FileSecretsManager) GetSecretByKey(_ context.Context, key string) (interface{}, error) {
+	v, exists := m.getSecrets()[key]
+	if !exists {
+		return nil, fmt.Errorf("file secrets manager %q has no %q key", m.ID, key)
+	}
+	return v, nil
+}
+
+// getSecretsFileFormat returns the format of the secrets file based on
+// its extension. The directories have "dir" format.
+func getSecretsFileFormat(s string) string {
+	if fi, err := os.Stat(s); err == nil && fi.IsDir() {
+		return secretsFormatDir
+	}
+	switch strings.ToLower(filepath.Ext(s)) {
+	case ".json":
+		return secretsFormatJSON
+	case ".yaml", ".yml":
+		return secretsFormatYAML
+	case ".env":
+		return secretsFormatDotenv
+	}
+	if strings.ToLower(filepath.Base(s)) == ".env" {
+		return secretsFormatDotenv
+	}
+	return ""
+}
+
+// readSecretsFile reads the secrets from the file in the provided format.
+func readSecretsFile(s, format string) (map[string]interface{}, error) {
+	if format == secretsFormatDir {
+		return readSecretsDir(s)
+	}
+	b, err := readSecretFile(s)
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := parseSecrets(b, format)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %v", s, err)
+	}
+	return secrets, nil
+}
+
+// parseSecrets parses the secrets in JSON, YAML, or dotenv format.
+func parseSecrets(b []byte, format string) (map[string]interface{}, error) {
+	secrets := make(map[string]interface{})
+	switch format {
+	case secretsFormatJSON:
+		if err := json.Unmarshal(b, &secrets); err != nil {
+			return nil, err
+		}
+	case secretsFormatYAML:
+		if err := yaml.Unmarshal(b, &secrets); err != nil {
+			return nil, err
+		}
+	case secretsFormatDotenv:
+		return parseDotenv(b)
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+	return secrets, nil
+}
+
+// readSecretsDir reads the secrets from the directory, where the file
+// name is the key and the file content is the value. The hidden files,
+// e.g. "..data" of Kubernetes secret volumes, are skipped.
+func readSecretsDir(s string) (map[string]interface{}, error) {
+	entries, err := os.ReadDir(s)
+	if err != nil {
+		return nil, err
+	}
+	secrets := make(map[string]interface{})
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		fp := filepath.Join(s, entry.Name())
+		fi, err := os.Stat(fp)
+		if err != nil {
+			return nil, err
+		}
+		if fi.IsDir() {
+			continue
+		}
+		b, err := readSecretFile(fp)
+		if err != nil {
+			return nil, err
+		}
+		secrets[entry.Name()] = strings.TrimRight(string(b), "\r\n")
+	}
+	return secrets, nil
+}
+
+// readSecretFile reads the file after checking that the file is not
+// writable by group and not accessible by others.
+func readSecretFile(s string) ([]byte, error) {
+	return readFileWithPerms(s, looseSecretsFilePerms)
+}
+
+// readPrivateFile reads the file after checking that the file is not
+// accessible by group or others, e.g. the master key of the secrets.
+func readPrivateFile(s string) ([]byte, error) {
+	return readFileWithPerms(s, loosePrivateFilePerms)
+}
+
+func readFileWithPerms(s string, loosePerms os.FileMode) ([]byte, error) {
+	fi, err := os.Stat(s)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, fmt.Errorf("%q is a directory", s)
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm()&loosePerms != 0 {
+		return nil, fmt.Errorf("%q has loose permissions %04o, expected no more than %04o", s, fi.Mode().Perm(), 0o666&^loosePerms)
+	}
+	return os.ReadFile(s)
+}
+
+// parseDotenv parses KEY=VALUE lines. The values may be single-quoted,
+// taken literally, or double-quoted, with escape sequences.
+func parseDotenv(b []byte) (map[string]interface{}, error) {
+	secrets := make(map[string]interface{})
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	var lineNum int
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		k, v, found := strings.Cut(line, "=")
+		k = strings.TrimSpace(k)
+		if !found || k == "" {
+			return nil, fmt.Errorf("line %d is malformed", lineNum)
+		}
+		v = strings.TrimSpace(v)
+		switch {
+		case len(v) > 1 && strings.HasPrefix(v, "'") && strings.HasSuffix(v, "'"):
+			v = v[1 : len(v)-1]
+		case len(v) > 1 && strings.HasPrefix(v, "\"") && strings.HasSuffix(v, "\""):
+			s, err := strconv.Unquote(v)
+			if err != nil {
+				return nil, fmt.Errorf("line %d is malformed: %v", lineNum, err)
+			}
+			v = s
+		}
+		secrets[k] = v
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*FileSecretsManager)(nil)
+	_ caddy.Validator       = (*FileSecretsManager)(nil)
+	_ caddyfile.Unmarshaler = (*FileSecretsManager)(nil)
+	_ SecretsManager        = (*FileSecretsManager)(nil)
+	_ SecretsRotator        = (*FileSecretsManager)(nil)
+)
@@ -0,0 +1,310 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+type testSecretFile struct {
+	name    string
+	content string
+	mode    os.FileMode
+	// link is the target of the symbolic link created instead of the file.
+	link string
+}
+
+func TestFileSecretsManager(t *testing.T) {
+	testcases := []struct {
+		name      string
+		files     []testSecretFile
+		path      string
+		format    string
+		want      map[string]interface{}
+		shouldErr bool
+		err       string
+	}{
+		{
+			name: "test json file",
+			files: []testSecretFile{
+				{name: "secrets.json", content: `{"shared_secret": "foo", "users": {"jsmith": "bar"}}`, mode: 0o600},
+			},
+			path: "secrets.json",
+			want: map[string]interface{}{
+				"shared_secret": "foo",
+				"users":         map[string]interface{}{"jsmith": "bar"},
+			},
+		},
+		{
+			name: "test yaml file",
+			files: []testSecretFile{
+				{name: "secrets.yml", content: "shared_secret: foo\nusers:\n  jsmith: bar\n", mode: 0o640},
+			},
+			path: "secrets.yml",
+			want: map[string]interface{}{
+				"shared_secret": "foo",
+				"users":         map[string]interface{}{"jsmith": "bar"},
+			},
+		},
+		{
+			name: "test dotenv file",
+			files: []testSecretFile{
+				{name: "secrets.env", content: "# comment\nSHARED_SECRET=foo\nexport API_KEY='b\\ar'\nPASSWORD=\"line1\\nline2\"\n", mode: 0o400},
+			},
+			path: "secrets.env",
+			want: map[string]interface{}{
+				"SHARED_SECRET": "foo",
+				"API_KEY":       `b\ar`,
+				"PASSWORD":      "line1\nline2",
+			},
+		},
+		{
+			name: "test dotenv file with explicit format",
+			files: []testSecretFile{
+				{name: "secrets", content: "SHARED_SECRET=foo\n", mode: 0o600},
+			},
+			path:   "secrets",
+			format: "dotenv",
+			want: map[string]interface{}{
+				"SHARED_SECRET": "foo",
+			},
+		},
+		{
+			name: "test secrets directory",
+			files: []testSecretFile{
+				{name: "secrets/shared_secret", content: "foo\n", mode: 0o400},
+				{name: "secrets/api_key", content: "bar", mode: 0o440},
+				{name: "secrets/..data/shared_secret", content: "foo\n", mode: 0o400},
+			},
+			path: "secrets",
+			want: map[string]interface{}{
+				"shared_secret": "foo",
+				"api_key":       "bar",
+			},
+		},
+		{
+			name: "test kubernetes secrets volume",
+			files: []testSecretFile{
+				{name: "secrets/..data/shared_secret", content: "foo\n", mode: 0o440},
+				{name: "secrets/shared_secret", link: "..data/shared_secret"},
+			},
+			path: "secrets",
+			want: map[string]interface{}{
+				"shared_secret": "foo",
+			},
+		},
+		{
+			name: "test world-readable file",
+			files: []testSecretFile{
+				{name: "secrets.json", content: `{"shared_secret": "foo"}`, mode: 0o644},
+			},
+			path:      "secrets.json",
+			shouldErr: true,
+			err:       `file secrets manager "mysecrets" erred: "{dir}/secrets.json" has loose permissions 0644, expected no more than 0640`,
+		},
+		{
+			name: "test world-readable file in secrets directory",
+			files: []testSecretFile{
+				{name: "secrets/shared_secret", content: "foo", mode: 0o444},
+			},
+			path:      "secrets",
+			shouldErr: true,
+			err:       `file secrets manager "mysecrets" erred: "{dir}/secrets/shared_secret" has loose permissions 0444, expected no more than 0640`,
+		},
+		{
+			name: "test group-writable file in secrets directory",
+			files: []testSecretFile{
+				{name: "secrets/shared_secret", content: "foo", mode: 0o660},
+			},
+			path:      "secrets",
+			shouldErr: true,
+			err:       `file secrets manager "mysecrets" erred: "{dir}/secrets/shared_secret" has loose permissions 0660, expected no more than 0640`,
+		},
+		{
+			name: "test unknown file format",
+			files: []testSecretFile{
+				{name: "secrets.txt", content: "foo", mode: 0o600},
+			},
+			path:      "secrets.txt",
+			shouldErr: true,
+			err:       `file secrets manager "mysecrets" has unsupported format: ""`,
+		},
+		{
+			name: "test malformed dotenv file",
+			files: []testSecretFile{
+				{name: "secrets.env", content: "FOO=bar\nBAZ\n", mode: 0o600},
+			},
+			path:      "secrets.env",
+			shouldErr: true,
+			err:       `file secrets manager "mysecrets" erred: failed to parse "{dir}/secrets.env": line 2 is malformed`,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if runtime.GOOS == "windows" && tc.shouldErr {
+				t.Skip("file permissions are not checked on windows")
+			}
+			dir := t.TempDir()
+			for _, f := range tc.files {
+				fp := filepath.Join(dir, f.name)
+				if err := os.MkdirAll(filepath.Dir(fp), 0o700); err != nil {
+					t.Fatal(err)
+				}
+				if f.link != "" {
+					if err := os.Symlink(f.link, fp); err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				if err := os.WriteFile(fp, []byte(f.content), f.mode); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chmod(fp, f.mode); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			m := &FileSecretsManager{
+				ID:     "mysecrets",
+				Path:   filepath.Join(dir, tc.path),
+				Format: tc.format,
+			}
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+			err := m.Provision(ctx)
+			if err != nil {
+				if !tc.shouldErr {
+					t.Fatalf("expected success, got: %v", err)
+				}
+				want := strings.ReplaceAll(tc.err, "{dir}", dir)
+				if diff := cmp.Diff(want, err.Error()); diff != "" {
+					t.Fatalf("unexpected error mismatch (-want +got):\n%s", diff)
+				}
+				return
+			}
+			if tc.shouldErr {
+				t.Fatalf("unexpected success, want: %v", tc.err)
+			}
+
+			got, err := m.GetSecret(ctx)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("GetSecret() mismatch (-want +got):\n%s", diff)
+			}
+			for k, v := range tc.want {
+				value, err := m.GetSecretByKey(ctx, k)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if diff := cmp.Diff(v, value); diff != "" {
+					t.Errorf("GetSecretByKey(%q) mismatch (-want +got):\n%s", k, diff)
+				}
+			}
+			if _, err := m.GetSecretByKey(ctx, "missing"); err == nil {
+				t.Errorf("GetSecretByKey() expected error for missing key")
+			}
+		})
+	}
+}
+
+func TestUnmarshalFileSecretsManager(t *testing.T) {
+	testcases := []struct {
+		name      string
+		d         *caddyfile.Dispenser
+		want      *FileSecretsManager
+		shouldErr bool
+		err       error
+	}{
+		{
+			name: "test file secrets manager",
+			d: caddyfile.NewTestDispenser(`
+			mysecrets {
+				path /etc/caddy/secrets.yaml
+				format yaml
+			}`),
+			want: &FileSecretsManager{
+				ID:     "mysecrets",
+				Path:   "/etc/caddy/secrets.yaml",
+				Format: "yaml",
+			},
+		},
+		{
+			name: "test file secrets manager with refresh interval",
+			d: caddyfile.NewTestDispenser(`
+			mysecrets {
+				path /etc/caddy/secrets.json
+				refresh interval 5m
+			}`),
+			want: &FileSecretsManager{
+				ID:              "mysecrets",
+				Path:            "/etc/caddy/secrets.json",
+				RefreshInterval: caddy.Duration(5 * time.Minute),
+			},
+		},
+		{
+			name: "test file secrets manager with malformed refresh interval",
+			d: caddyfile.NewTestDispenser(`
+			mysecrets {
+				refresh 5m
+			}`),
+			shouldErr: true,
+			err:       fmt.Errorf("refresh directive has malformed value: 5m, at %s:3", tf),
+		},
+		{
+			name: "test file secrets manager with unsupported directive",
+			d: caddyfile.NewTestDispenser(`
+			mysecrets {
+				file /etc/caddy/secrets.yaml
+			}`),
+			shouldErr: true,
+			err:       fmt.Errorf("unsupported file secrets manager directive: file, at %s:3", tf),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &FileSecretsManager{}
+			err := m.UnmarshalCaddyfile(tc.d)
+			if err != nil {
+				if !tc.shouldErr {
+					t.Fatalf("expected success, got: %v", err)
+				}
+				if diff := cmp.Diff(tc.err.Error(), err.Error()); diff != "" {
+					t.Fatalf("unexpected error mismatch (-want +got):\n%s", diff)
+				}
+				return
+			}
+			if tc.shouldErr {
+				t.Fatalf("unexpected success, want: %v", tc.err)
+			}
+			if diff := cmp.Diff(tc.want, m, cmpopts.IgnoreUnexported(FileSecretsManager{})); diff != "" {
+				t.Errorf("UnmarshalCaddyfile() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,369 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	// anySecretsManager is the id of the resolution config applying to
+	// the secrets managers without their own config.
+	anySecretsManager = "*"
+
+	defaultSecretsTimeout = 30 * time.Second
+	defaultSecretsBackoff = time.Second
+)
+
+// SecretsResolutionConfig holds the settings for fetching secrets from
+// a secrets manager during config resolution.
+type SecretsResolutionConfig struct {
+	// ID is the id of the secrets manager, or "*" for all secrets managers
+	// without their own config.
+	ID string `json:"id,omitempty" xml:"id,omitempty" yaml:"id,omitempty"`
+	// Timeout is the limit of a single request to the secrets manager.
+	Timeout caddy.Duration `json:"timeout,omitempty" xml:"timeout,omitempty" yaml:"timeout,omitempty"`
+	// MaxRetries is the number of retries after a failed request.
+	MaxRetries int `json:"max_retries,omitempty" xml:"max_retries,omitempty" yaml:"max_retries,omitempty"`
+	// Backoff is the delay before the first retry. The delay doubles
+	// with every retry.
+	Backoff caddy.Duration `json:"backoff,omitempty" xml:"backoff,omitempty" yaml:"backoff,omitempty"`
+	// CachePath is the file holding the last-known-good secrets. When the
+	// secrets manager is unreachable, the secrets are served from the file.
+	CachePath string `json:"cache_path,omitempty" xml:"cache_path,omitempty" yaml:"cache_path,omitempty"`
+	// CacheKey is the key encrypting the cache file. It is expected to be
+	// a random string, e.g. "{env.SECRETS_CACHE_KEY}".
+	CacheKey string `json:"cache_key,omitempty" xml:"cache_key,omitempty" yaml:"cache_key,omitempty"`
+}
+
+// Validate validates the secrets resolution config.
+func (cfg *SecretsResolutionConfig) Validate() error {
+	if cfg.ID == "" {
+		return fmt.Errorf("secrets resolution id is empty")
+	}
+	if cfg.Timeout < 0 {
+		return fmt.Errorf("secrets resolution %q has negative timeout", cfg.ID)
+	}
+	if cfg.MaxRetries < 0 {
+		return fmt.Errorf("secrets resolution %q has negative max retries", cfg.ID)
+	}
+	if cfg.Backoff < 0 {
+		return fmt.Errorf("secrets resolution %q has negative backoff", cfg.ID)
+	}
+	if (cfg.CachePath == "") != (cfg.CacheKey == "") {
+		return fmt.Errorf("secrets resolution %q cache requires both path and key", cfg.ID)
+	}
+	return nil
+}
+
+func (cfg *SecretsResolutionConfig) getTimeout() time.Duration {
+	if cfg.Timeout == 0 {
+		return defaultSecretsTimeout
+	}
+	return time.Duration(cfg.Timeout)
+}
+
+func (cfg *SecretsResolutionConfig) getBackoff() time.Duration {
+	if cfg.Backoff == 0 {
+		return defaultSecretsBackoff
+	}
+	return time.Duration(cfg.Backoff)
+}
+
+// errSecretsTimeout is the error of the secrets manager requests exceeding
+// the timeout.
+var errSecretsTimeout = errors.New("request timed out")
+
+// secretsResolver is a SecretsManager in front of another secrets manager.
+// It limits the duration of the requests, retries the failed ones, and
+// fetches every key once. A resolver lives for a single config
+// resolution, so that the rotated secrets are fetched again.
+type secretsResolver struct {
+	SecretsManager
+	id     string
+	config *SecretsResolutionConfig
+	logger *zap.Logger
+
+	mu      sync.Mutex
+	fetched map[string]interface{}
+	cached  map[string]interface{}
+}
+
+// newSecretsResolvers returns the resolvers for the secrets managers. The
+// resolvers are used in place of the secrets managers for the duration
+// of a config resolution.
+func newSecretsResolvers(ctx context.Context, secretsManagers []SecretsManager, configs []*SecretsResolutionConfig, logger *zap.Logger) []SecretsManager {
+	byID := make(map[string]*SecretsResolutionConfig)
+	for _, cfg := range configs {
+		byID[cfg.ID] = cfg
+	}
+	defaultConfig, found := byID[anySecretsManager]
+	if !found {
+		defaultConfig = &SecretsResolutionConfig{ID: anySecretsManager}
+	}
+	resolvers := []SecretsManager{}
+	for _, secretsManager := range secretsManagers {
+		id, _ := secretsManager.GetConfig(ctx)["id"].(string)
+		cfg, found := byID[id]
+		if !found {
+			cfg = defaultConfig
+		}
+		resolvers = append(resolvers, &secretsResolver{
+			SecretsManager: secretsManager,
+			id:             id,
+			config:         cfg,
+			logger:         logger,
+			fetched:        make(map[string]interface{}),
+		})
+	}
+	return resolvers
+}
+
+// GetSecret returns the secret.
+func (r *secretsResolver) GetSecret(ctx context.Context) (map[string]interface{}, error) {
+	v, err := r.retry(ctx, func(ctx context.Context) (interface{}, error) {
+		return r.SecretsManager.GetSecret(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(map[string]interface{}), nil
+}
+
+// GetSecretByKey returns the value of the secret key. When the secrets
+// manager is unreachable, the value comes from the last-known-good cache.
+// The other errors, e.g. a missing key or a denied access, are returned.
+func (r *secretsResolver) GetSecretByKey(ctx context.Context, key string) (interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if v, found := r.fetched[key]; found {
+		return v, nil
+	}
+
+	value, err := r.retry(ctx, func(ctx context.Context) (interface{}, error) {
+		return r.SecretsManager.GetSecretByKey(ctx, key)
+	})
+	if err != nil {
+		if !isSecretsTransportError(err) {
+			return nil, err
+		}
+		v, found := r.getCachedSecret(key)
+		if !found {
+			return nil, err
+		}
+		r.logger.Warn(
+			"serving last-known-good secret from cache",
+			zap.String("secrets_manager", r.id),
+			zap.String("key", key),
+			zap.Error(err),
+		)
+		value = v
+	}
+	r.fetched[key] = value
+	return value, nil
+}
+
+// retry calls fn until it succeeds, limiting each call to the timeout and
+// waiting for the backoff between the calls.
+func (r *secretsResolver) retry(ctx context.Context, fn func(context.Context) (interface{}, error)) (interface{}, error) {
+	backoff := r.config.getBackoff()
+	var err error
+	for attempt := 0; attempt <= r.config.MaxRetries; attempt++ {
+		if attempt > 0 {
+			r.logger.Debug(
+				"retrying secrets manager request",
+				zap.String("secrets_manager", r.id),
+				zap.Int("attempt", attempt),
+				zap.Duration("backoff", backoff),
+				zap.Error(err),
+			)
+			select {
+			case <-ctx.Done():
+				return nil, fmt.Errorf("secrets manager %q request cancelled: %v", r.id, err)
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		var v interface{}
+		if v, err = r.call(ctx, fn); err == nil {
+			return v, nil
+		}
+	}
+	return nil, err
+}
+
+// call calls fn with the timeout. The secrets managers ignoring the
+// context do not stall the resolution past the timeout.
+func (r *secretsResolver) call(ctx context.Context, fn func(context.Context) (interface{}, error)) (interface{}, error) {
+	type result struct {
+		value interface{}
+		err   error
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.config.getTimeout())
+	defer cancel()
+	done := make(chan result, 1)
+	go func() {
+		v, err := fn(ctx)
+		done <- result{value: v, err: err}
+	}()
+	select {
+	case res := <-done:
+		return res.value, res.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("secrets manager %q %w after %s", r.id, errSecretsTimeout, r.config.getTimeout())
+	}
+}
+
+// isSecretsTransportError returns true when the request to the secrets
+// manager timed out or failed in transport, i.e. the secrets manager was
+// not reached.
+func isSecretsTransportError(err error) bool {
+	if errors.Is(err, errSecretsTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func (r *secretsResolver) getCachedSecret(key string) (interface{}, bool) {
+	if r.config.CachePath == "" {
+		return nil, false
+	}
+	if r.cached == nil {
+		cached, err := readSecretsCache(r.config.CachePath, r.config.CacheKey, r.id)
+		if err != nil {
+			r.logger.Warn(
+				"failed reading secrets cache",
+				zap.String("secrets_manager", r.id),
+				zap.String("path", r.config.CachePath),
+				zap.Error(err),
+			)
+			cached = make(map[string]interface{})
+		}
+		r.cached = cached
+	}
+	v, found := r.cached[key]
+	return v, found
+}
+
+// saveSecretsCache writes the secrets fetched by the resolvers to the
+// cache files of their secrets managers.
+func saveSecretsCache(resolvers []SecretsManager, logger *zap.Logger) {
+	for _, entry := range resolvers {
+		r, ok := entry.(*secretsResolver)
+		if !ok || r.config.CachePath == "" || len(r.fetched) == 0 {
+			continue
+		}
+		if err := writeSecretsCache(r.config.CachePath, r.config.CacheKey, r.id, r.fetched); err != nil {
+			logger.Warn(
+				"failed writing secrets cache",
+				zap.String("secrets_manager", r.id),
+				zap.String("path", r.config.CachePath),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// readSecretsCache returns the cached secrets of the secrets manager.
+func readSecretsCache(s, key, id string) (map[string]interface{}, error) {
+	doc, err := readSecretsCacheDocument(s, key)
+	if err != nil {
+		return nil, err
+	}
+	secrets, found := doc[id]
+	if !found {
+		return nil, fmt.Errorf("%q has no secrets of %q", s, id)
+	}
+	return secrets, nil
+}
+
+// readSecretsCacheDocument reads the cache file. The file holds a nonce
+// followed by AES-GCM encrypted JSON document, keyed by the secrets
+// manager id, so that the secrets managers may share the file.
+func readSecretsCacheDocument(s, key string) (map[string]map[string]interface{}, error) {
+	b, err := readPrivateFile(s)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newSecretsCacheCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < gcm.NonceSize() {
+		return nil, fmt.Errorf("%q is malformed", s)
+	}
+	plaintext, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %q: %v", s, err)
+	}
+	doc := make(map[string]map[string]interface{})
+	if err := json.Unmarshal(plaintext, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %v", s, err)
+	}
+	return doc, nil
+}
+
+func writeSecretsCache(s, key, id string, secrets map[string]interface{}) error {
+	doc, err := readSecretsCacheDocument(s, key)
+	if err != nil {
+		doc = make(map[string]map[string]interface{})
+	}
+	doc[id] = secrets
+	plaintext, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	gcm, err := newSecretsCacheCipher(key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s), 0o700); err != nil {
+		return err
+	}
+	tmp := s + ".tmp"
+	if err := os.WriteFile(tmp, gcm.Seal(nonce, nonce, plaintext, nil), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s)
+}
+
+func newSecretsCacheCipher(key string) (cipher.AEAD, error) {
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
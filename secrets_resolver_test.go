@@ -0,0 +1,185 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/google/go-cmp/cmp"
+	logutil "github.com/greenpau/go-authcrunch/pkg/util/log"
+)
+
+// testSecretsManager is a secrets manager failing the first requests in
+// transport.
+type testSecretsManager struct {
+	id       string
+	secrets  map[string]interface{}
+	failures int
+	delay    time.Duration
+	calls    atomic.Int32
+}
+
+func (m *testSecretsManager) GetConfig(_ context.Context) map[string]interface{} {
+	return map[string]interface{}{"id": m.id}
+}
+
+func (m *testSecretsManager) GetSecret(_ context.Context) (map[string]interface{}, error) {
+	return m.secrets, nil
+}
+
+func (m *testSecretsManager) GetSecretByKey(_ context.Context, key string) (interface{}, error) {
+	if int(m.calls.Add(1)) <= m.failures {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	}
+	time.Sleep(m.delay)
+	v, found := m.secrets[key]
+	if !found {
+		return nil, fmt.Errorf("no %q key", key)
+	}
+	return v, nil
+}
+
+func TestSecretsResolver(t *testing.T) {
+	cachePath := filepath.Join(t.TempDir(), "secrets.cache")
+	testcases := []struct {
+		name      string
+		manager   *testSecretsManager
+		config    *SecretsResolutionConfig
+		keys      []string
+		want      map[string]interface{}
+		wantCalls int
+		shouldErr bool
+		err       error
+	}{
+		{
+			name:      "test identical keys fetched once",
+			manager:   &testSecretsManager{id: "mysecrets", secrets: map[string]interface{}{"foo": "bar"}},
+			config:    &SecretsResolutionConfig{ID: anySecretsManager},
+			keys:      []string{"foo", "foo", "foo"},
+			want:      map[string]interface{}{"foo": "bar"},
+			wantCalls: 1,
+		},
+		{
+			name:      "test retries after failures",
+			manager:   &testSecretsManager{id: "mysecrets", secrets: map[string]interface{}{"foo": "bar"}, failures: 2},
+			config:    &SecretsResolutionConfig{ID: "mysecrets", MaxRetries: 2, Backoff: caddy.Duration(time.Millisecond)},
+			keys:      []string{"foo"},
+			want:      map[string]interface{}{"foo": "bar"},
+			wantCalls: 3,
+		},
+		{
+			name:      "test retries exhausted",
+			manager:   &testSecretsManager{id: "mysecrets", secrets: map[string]interface{}{"foo": "bar"}, failures: 3},
+			config:    &SecretsResolutionConfig{ID: "mysecrets", MaxRetries: 1, Backoff: caddy.Duration(time.Millisecond)},
+			keys:      []string{"foo"},
+			wantCalls: 2,
+			shouldErr: true,
+			err:       fmt.Errorf("dial tcp: connection refused"),
+		},
+		{
+			name:      "test request timeout",
+			manager:   &testSecretsManager{id: "mysecrets", secrets: map[string]interface{}{"foo": "bar"}, delay: time.Second},
+			config:    &SecretsResolutionConfig{ID: "mysecrets", Timeout: caddy.Duration(10 * time.Millisecond)},
+			keys:      []string{"foo"},
+			wantCalls: 1,
+			shouldErr: true,
+			err:       fmt.Errorf(`secrets manager "mysecrets" request timed out after 10ms`),
+		},
+		{
+			name:      "test populate cache",
+			manager:   &testSecretsManager{id: "mysecrets", secrets: map[string]interface{}{"foo": "bar", "baz": "qux"}},
+			config:    &SecretsResolutionConfig{ID: "mysecrets", CachePath: cachePath, CacheKey: "secret"},
+			keys:      []string{"foo", "baz"},
+			want:      map[string]interface{}{"foo": "bar", "baz": "qux"},
+			wantCalls: 2,
+		},
+		{
+			name:      "test serve from cache when backend is unavailable",
+			manager:   &testSecretsManager{id: "mysecrets", failures: 10},
+			config:    &SecretsResolutionConfig{ID: "mysecrets", CachePath: cachePath, CacheKey: "secret"},
+			keys:      []string{"foo"},
+			want:      map[string]interface{}{"foo": "bar"},
+			wantCalls: 1,
+		},
+		{
+			name:      "test serve from cache when request times out",
+			manager:   &testSecretsManager{id: "mysecrets", secrets: map[string]interface{}{"foo": "baz"}, delay: time.Second},
+			config:    &SecretsResolutionConfig{ID: "mysecrets", Timeout: caddy.Duration(10 * time.Millisecond), CachePath: cachePath, CacheKey: "secret"},
+			keys:      []string{"foo"},
+			want:      map[string]interface{}{"foo": "bar"},
+			wantCalls: 1,
+		},
+		{
+			name:      "test missing key not served from cache",
+			manager:   &testSecretsManager{id: "mysecrets", secrets: map[string]interface{}{}},
+			config:    &SecretsResolutionConfig{ID: "mysecrets", CachePath: cachePath, CacheKey: "secret"},
+			keys:      []string{"foo"},
+			wantCalls: 1,
+			shouldErr: true,
+			err:       fmt.Errorf(`no "foo" key`),
+		},
+		{
+			name:      "test cache with wrong key",
+			manager:   &testSecretsManager{id: "mysecrets", failures: 10},
+			config:    &SecretsResolutionConfig{ID: "mysecrets", CachePath: cachePath, CacheKey: "other"},
+			keys:      []string{"foo"},
+			wantCalls: 1,
+			shouldErr: true,
+			err:       fmt.Errorf("dial tcp: connection refused"),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			logger := logutil.NewLogger()
+			resolvers := newSecretsResolvers(context.Background(), []SecretsManager{tc.manager}, []*SecretsResolutionConfig{tc.config}, logger)
+			got := make(map[string]interface{})
+			var err error
+			for _, k := range tc.keys {
+				var v interface{}
+				if v, err = resolvers[0].GetSecretByKey(context.Background(), k); err != nil {
+					break
+				}
+				got[k] = v
+			}
+			if calls := int(tc.manager.calls.Load()); calls != tc.wantCalls {
+				t.Errorf("unexpected secrets manager calls: got %d, want %d", calls, tc.wantCalls)
+			}
+			if err != nil {
+				if !tc.shouldErr {
+					t.Fatalf("expected success, got: %v", err)
+				}
+				if diff := cmp.Diff(tc.err.Error(), err.Error()); diff != "" {
+					t.Fatalf("unexpected error mismatch (-want +got):\n%s", diff)
+				}
+				return
+			}
+			if tc.shouldErr {
+				t.Fatalf("unexpected success, want: %v", tc.err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("GetSecretByKey() mismatch (-want +got):\n%s", diff)
+			}
+			saveSecretsCache(resolvers, logger)
+		})
+	}
+}
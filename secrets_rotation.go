@@ -0,0 +1,318 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/greenpau/go-authcrunch"
+	"github.com/greenpau/go-authcrunch/pkg/kms"
+	cfgutil "github.com/greenpau/go-authcrunch/pkg/util/cfg"
+	"go.uber.org/zap"
+)
+
+// SecretsRotator is implemented by the secrets managers whose secrets
+// change over time, e.g. the secrets with TTL.
+type SecretsRotator interface {
+	// GetRotationInterval returns how often the secrets are reloaded.
+	// Zero disables periodic reloads.
+	GetRotationInterval(context.Context) time.Duration
+	// RotateSecrets reloads the secrets and returns true when they changed.
+	RotateSecrets(context.Context) (bool, error)
+}
+
+// SecretsChangeNotifier is implemented by the secrets managers notifying
+// about the changes of their secrets, e.g. by watching a backend. The
+// notification is sent after the secrets manager reloaded the secrets.
+type SecretsChangeNotifier interface {
+	SecretsChanged() <-chan struct{}
+}
+
+// hasSecretsRotation returns true when any of the secrets managers of the
+// app reloads its secrets or notifies about their changes.
+func (app *App) hasSecretsRotation(ctx context.Context) bool {
+	for _, secretsManager := range app.secretsManagers {
+		if rotator, ok := secretsManager.(SecretsRotator); ok && rotator.GetRotationInterval(ctx) > 0 {
+			return true
+		}
+		if _, ok := secretsManager.(SecretsChangeNotifier); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// startSecretsRotation reloads the rotating secrets in the background until
+// the app context is cancelled. When the secrets change, the config is
+// resolved again and the affected components are rebuilt.
+func (app *App) startSecretsRotation(ctx caddy.Context) {
+	type scheduledRotator struct {
+		rotator  SecretsRotator
+		interval time.Duration
+		next     time.Time
+	}
+
+	var rotators []*scheduledRotator
+	var tick time.Duration
+	changed := make(chan struct{}, 1)
+	now := time.Now()
+	for _, secretsManager := range app.secretsManagers {
+		if rotator, ok := secretsManager.(SecretsRotator); ok {
+			if interval := rotator.GetRotationInterval(ctx); interval > 0 {
+				rotators = append(rotators, &scheduledRotator{rotator: rotator, interval: interval, next: now.Add(interval)})
+				if tick == 0 || interval < tick {
+					tick = interval
+				}
+			}
+		}
+		if notifier, ok := secretsManager.(SecretsChangeNotifier); ok {
+			go func(ch <-chan struct{}) {
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case _, ok := <-ch:
+						if !ok {
+							return
+						}
+						select {
+						case changed <- struct{}{}:
+						default:
+						}
+					}
+				}
+			}(notifier.SecretsChanged())
+		}
+	}
+
+	var ticks <-chan time.Time
+	if tick > 0 {
+		ticker := time.NewTicker(tick)
+		ticks = ticker.C
+		defer ticker.Stop()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		case now := <-ticks:
+			var rotated bool
+			for _, entry := range rotators {
+				if now.Before(entry.next) {
+					continue
+				}
+				entry.next = now.Add(entry.interval)
+				ok, err := entry.rotator.RotateSecrets(ctx)
+				if err != nil {
+					app.logger.Error(
+						"failed rotating secrets",
+						zap.String("app", app.Name),
+						redactedField("secrets_manager", entry.rotator.(SecretsManager).GetConfig(ctx)),
+						zap.Error(err),
+					)
+					continue
+				}
+				rotated = rotated || ok
+			}
+			if !rotated {
+				continue
+			}
+		}
+		if err := app.applyRotatedSecrets(ctx); err != nil {
+			app.logger.Error(
+				"failed applying rotated secrets",
+				zap.String("app", app.Name),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// applyRotatedSecrets resolves the config of the app with the current
+// secrets and swaps the components whose resolved config changed. The
+// other components, and their in-memory state, are kept.
+//
+// The gatekeepers offer no way to replace their credentials, therefore
+// the changed ones are rebuilt. The verify keys of their rotated secrets
+// are retained for the token lifetime, so that the tokens issued before
+// the rotation remain valid. The extensions of the rebuilt authorization
+// policies are provisioned again.
+//
+// Rebuilding a portal would log out its users, because the sessions and
+// the sandboxes live in the portal. The changed portals are kept with
+// their previous config until the next config reload.
+func (app *App) applyRotatedSecrets(ctx context.Context) error {
+	config := authcrunch.NewConfig()
+	if err := json.Unmarshal(app.rawConfig, config); err != nil {
+		return fmt.Errorf("failed decoding config: %v", err)
+	}
+	secretsResolvers := newSecretsResolvers(ctx, app.secretsManagers, app.SecretsResolution, app.logger)
+	if err := ResolveRuntimeAppConfig(ctx, caddy.NewReplacer(), secretsResolvers, config, app.logger); err != nil {
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	saveSecretsCache(secretsResolvers, app.logger)
+
+	retained := getRetainedKeys(config, app.server, time.Now())
+	next, changes, err := newServer(config, app.server, retained, true, app.logger)
+	if err != nil {
+		return err
+	}
+	if err := next.provisionPolicies(app.AuthorizationPolicyExtensions, app.server); err != nil {
+		return err
+	}
+	app.server.swap(next)
+
+	for _, change := range changes {
+		if change.Action == componentUnchanged {
+			continue
+		}
+		if change.Action == componentReloadRequired {
+			app.logger.Warn(
+				"app component requires config reload to apply rotated secrets",
+				zap.String("app", app.Name),
+				zap.String("component_kind", change.Kind),
+				zap.String("component_name", change.Name),
+			)
+			continue
+		}
+		app.logger.Info(
+			"rotated secrets of app component",
+			zap.String("app", app.Name),
+			zap.String("component_kind", change.Kind),
+			zap.String("component_name", change.Name),
+			zap.String("action", change.Action),
+			zap.Int("retained_keys", len(retained[getComponentKey(change.Kind, change.Name)])),
+		)
+	}
+	return nil
+}
+
+// retainedKey is the verify key of a rotated secret. It keeps the tokens
+// signed with the secret valid until the tokens expire.
+type retainedKey struct {
+	secret    string
+	tokenName string
+	expiresAt time.Time
+}
+
+// getRetainedKeys returns the verify keys of the portals and the gatekeepers
+// of prev whose secrets are absent in the config, by component key. The
+// keys are retained for the longest token lifetime of the config.
+func getRetainedKeys(config *authcrunch.Config, prev *server, now time.Time) map[string][]*retainedKey {
+	prev.mu.RLock()
+	defer prev.mu.RUnlock()
+	retained := make(map[string][]*retainedKey)
+	if prev.config == nil {
+		return retained
+	}
+	lifetime := time.Duration(getMaxTokenLifetime(config)) * time.Second
+
+	add := func(key string, statements, prevStatements []string) {
+		secrets := make(map[string]bool)
+		for _, cfg := range parseCryptoKeyConfigs(statements) {
+			secrets[cfg.Secret] = true
+		}
+		for _, cfg := range parseCryptoKeyConfigs(prevStatements) {
+			if cfg.Secret == "" || secrets[cfg.Secret] {
+				continue
+			}
+			if cfg.Usage != "verify" && cfg.Usage != "sign-verify" {
+				continue
+			}
+			secrets[cfg.Secret] = true
+			entry := &retainedKey{secret: cfg.Secret, tokenName: cfg.TokenName, expiresAt: now.Add(lifetime)}
+			for _, k := range prev.retainedKeys[key] {
+				if k.secret == cfg.Secret {
+					entry.expiresAt = k.expiresAt
+				}
+			}
+			if !entry.expiresAt.After(now) {
+				continue
+			}
+			retained[key] = append(retained[key], entry)
+		}
+	}
+
+	for _, cfg := range config.AuthenticationPortals {
+		for _, prevCfg := range prev.config.AuthenticationPortals {
+			if prevCfg.Name == cfg.Name {
+				add(getComponentKey(portalComponent, cfg.Name), cfg.RawCryptoKeyStoreConfig, prevCfg.RawCryptoKeyStoreConfig)
+			}
+		}
+	}
+	for _, cfg := range config.AuthorizationPolicies {
+		for _, prevCfg := range prev.config.AuthorizationPolicies {
+			if prevCfg.Name == cfg.Name {
+				add(getComponentKey(gatekeeperComponent, cfg.Name), cfg.RawCryptoKeyStoreConfig, prevCfg.RawCryptoKeyStoreConfig)
+			}
+		}
+	}
+	return retained
+}
+
+// getRetainedKeyConfigs returns the crypto key store configs of the
+// retained keys. The key id is derived from the secret.
+func getRetainedKeyConfigs(keys []*retainedKey) []string {
+	var configs []string
+	for _, k := range keys {
+		h := sha256.Sum256([]byte(k.secret))
+		kid := "retained-" + hex.EncodeToString(h[:6])
+		configs = append(configs, cfgutil.EncodeArgs([]string{"crypto", "key", kid, "verify", k.secret}))
+		if k.tokenName != "" {
+			configs = append(configs, cfgutil.EncodeArgs([]string{"crypto", "key", kid, "token", "name", k.tokenName}))
+		}
+	}
+	return configs
+}
+
+// getMaxTokenLifetime returns the longest lifetime, in seconds, of the
+// tokens signed or verified by the portals and the gatekeepers.
+func getMaxTokenLifetime(config *authcrunch.Config) int {
+	var lifetime int
+	var statements [][]string
+	for _, cfg := range config.AuthenticationPortals {
+		statements = append(statements, cfg.RawCryptoKeyStoreConfig)
+	}
+	for _, cfg := range config.AuthorizationPolicies {
+		statements = append(statements, cfg.RawCryptoKeyStoreConfig)
+	}
+	for _, entry := range statements {
+		for _, cfg := range parseCryptoKeyConfigs(entry) {
+			lifetime = max(lifetime, cfg.TokenLifetime)
+		}
+	}
+	return lifetime
+}
+
+// parseCryptoKeyConfigs returns the key configs of the crypto key store
+// config. The config was validated, and the errors are ignored.
+func parseCryptoKeyConfigs(statements []string) []*kms.CryptoKeyConfig {
+	if len(statements) == 0 {
+		return nil
+	}
+	cfgs, _ := kms.ParseCryptoKeyConfigs(statements)
+	return cfgs
+}
@@ -0,0 +1,251 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	jwtlib "github.com/golang-jwt/jwt/v5"
+	"github.com/google/go-cmp/cmp"
+	"github.com/greenpau/go-authcrunch"
+	"github.com/greenpau/go-authcrunch/pkg/authz"
+	"github.com/greenpau/go-authcrunch/pkg/requests"
+	logutil "github.com/greenpau/go-authcrunch/pkg/util/log"
+)
+
+const testRotationCaddyfile = `
+security {
+  local identity store localdb {
+    realm local
+    path %s
+  }
+  authentication portal myportal {
+    crypto key sign-verify secrets:keys:portal_key
+    enable identity store localdb
+  }
+  authorization policy mypolicy {
+    crypto key verify secrets:keys:policy_key
+    allow roles authp/admin
+  }
+}`
+
+func TestApplyRotatedSecrets(t *testing.T) {
+	dir := t.TempDir()
+	secretsPath := filepath.Join(dir, "keys.json")
+	if err := os.WriteFile(secretsPath, []byte(`{"policy_key": "foo", "portal_key": "baz"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	secretsManager := &FileSecretsManager{ID: "keys", Path: secretsPath}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := secretsManager.Provision(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	raw, err := parseCaddyfile(caddyfile.NewTestDispenser(fmt.Sprintf(testRotationCaddyfile, filepath.Join(dir, "users.json"))), nil)
+	if err != nil {
+		t.Fatalf("failed parsing config: %v", err)
+	}
+	app := &App{logger: logutil.NewLogger(), secretsManagers: []SecretsManager{secretsManager}}
+	if err := json.Unmarshal(raw.(httpcaddyfile.App).Value, app); err != nil {
+		t.Fatalf("failed unmarshaling config: %v", err)
+	}
+	if app.rawConfig, err = json.Marshal(app.Config); err != nil {
+		t.Fatalf("failed encoding config: %v", err)
+	}
+	app.server = newServerInstance(nil, app.logger)
+	if err := app.applyRotatedSecrets(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	portal, err := app.getPortal("myportal")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	gatekeeper, err := app.getGatekeeper("mypolicy")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	testcases := []struct {
+		name             string
+		secrets          string
+		changed          bool
+		reusedGatekeeper bool
+		reloadRequired   bool
+		verifiedKeys     []string
+	}{
+		{
+			name:             "test unchanged secrets",
+			secrets:          `{"policy_key": "foo", "portal_key": "baz"}`,
+			reusedGatekeeper: true,
+			verifiedKeys:     []string{"foo"},
+		},
+		{
+			name:         "test rotated policy key",
+			secrets:      `{"policy_key": "bar", "portal_key": "baz"}`,
+			changed:      true,
+			verifiedKeys: []string{"foo", "bar"},
+		},
+		{
+			name:             "test unchanged secrets after rotation",
+			secrets:          `{"policy_key": "bar", "portal_key": "baz"}`,
+			reusedGatekeeper: true,
+			verifiedKeys:     []string{"foo", "bar"},
+		},
+		{
+			name:             "test rotated portal key keeps portal",
+			secrets:          `{"policy_key": "bar", "portal_key": "qux"}`,
+			changed:          true,
+			reusedGatekeeper: true,
+			reloadRequired:   true,
+			verifiedKeys:     []string{"foo", "bar"},
+		},
+		{
+			name:             "test unchanged secrets after portal key rotation",
+			secrets:          `{"policy_key": "bar", "portal_key": "qux"}`,
+			reusedGatekeeper: true,
+			reloadRequired:   true,
+			verifiedKeys:     []string{"foo", "bar"},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := os.WriteFile(secretsPath, []byte(tc.secrets), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			changed, err := secretsManager.RotateSecrets(ctx)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if changed != tc.changed {
+				t.Fatalf("RotateSecrets() got %t, want %t", changed, tc.changed)
+			}
+			if err := app.applyRotatedSecrets(ctx); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			gotPortal, err := app.getPortal("myportal")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if gotPortal != portal {
+				t.Errorf("portal was rebuilt after secrets rotation")
+			}
+			fp := app.server.fingerprints[getComponentKey(portalComponent, "myportal")]
+			if got := fp == ""; got != tc.reloadRequired {
+				t.Errorf("unexpected portal reload requirement: got %t, want %t", got, tc.reloadRequired)
+			}
+			gotGatekeeper, err := app.getGatekeeper("mypolicy")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := gotGatekeeper == gatekeeper; got != tc.reusedGatekeeper {
+				t.Errorf("unexpected gatekeeper reuse: got %t, want %t", got, tc.reusedGatekeeper)
+			}
+			gatekeeper = gotGatekeeper
+
+			for _, k := range tc.verifiedKeys {
+				token, err := jwtlib.NewWithClaims(jwtlib.SigningMethodHS512, jwtlib.MapClaims{
+					"sub":   "jsmith",
+					"roles": []string{"authp/admin"},
+					"exp":   time.Now().Add(time.Hour).Unix(),
+				}).SignedString([]byte(k))
+				if err != nil {
+					t.Fatal(err)
+				}
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.AddCookie(&http.Cookie{Name: "AUTHP_ACCESS_TOKEN", Value: token})
+				if err := gatekeeper.Authenticate(httptest.NewRecorder(), r, requests.NewAuthorizationRequest()); err != nil {
+					t.Errorf("token signed with %q key failed verification: %v", k, err)
+				}
+			}
+		})
+	}
+}
+
+func TestGetRetainedKeys(t *testing.T) {
+	now := time.Now()
+	newConfig := func(statements ...string) *authcrunch.Config {
+		config := authcrunch.NewConfig()
+		config.AuthorizationPolicies = []*authz.PolicyConfig{
+			{Name: "mypolicy", RawCryptoKeyStoreConfig: statements},
+		}
+		return config
+	}
+	key := getComponentKey(gatekeeperComponent, "mypolicy")
+
+	testcases := []struct {
+		name     string
+		config   *authcrunch.Config
+		prev     *authcrunch.Config
+		retained []*retainedKey
+		want     []*retainedKey
+	}{
+		{
+			name:   "test rotated key",
+			config: newConfig("crypto key verify bar", "crypto default token lifetime 3600"),
+			prev:   newConfig("crypto key verify foo", "crypto default token lifetime 3600"),
+			want: []*retainedKey{
+				{secret: "foo", tokenName: "access_token", expiresAt: now.Add(time.Hour)},
+			},
+		},
+		{
+			name:   "test unchanged key",
+			config: newConfig("crypto key verify foo"),
+			prev:   newConfig("crypto key verify foo"),
+		},
+		{
+			name:   "test retained key",
+			config: newConfig("crypto key verify baz"),
+			prev:   newConfig(append([]string{"crypto key verify bar"}, getRetainedKeyConfigs([]*retainedKey{{secret: "foo", tokenName: "access_token"}})...)...),
+			retained: []*retainedKey{
+				{secret: "foo", tokenName: "access_token", expiresAt: now.Add(time.Minute)},
+			},
+			want: []*retainedKey{
+				{secret: "bar", tokenName: "access_token", expiresAt: now.Add(15 * time.Minute)},
+				{secret: "foo", tokenName: "access_token", expiresAt: now.Add(time.Minute)},
+			},
+		},
+		{
+			name:   "test expired retained key",
+			config: newConfig("crypto key verify bar"),
+			prev:   newConfig(append([]string{"crypto key verify bar"}, getRetainedKeyConfigs([]*retainedKey{{secret: "foo", tokenName: "access_token"}})...)...),
+			retained: []*retainedKey{
+				{secret: "foo", tokenName: "access_token", expiresAt: now.Add(-time.Minute)},
+			},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			prev := newServerInstance(tc.prev, logutil.NewLogger())
+			prev.retainedKeys[key] = tc.retained
+			got := getRetainedKeys(tc.config, prev, now)
+			if diff := cmp.Diff(tc.want, got[key], cmp.AllowUnexported(retainedKey{})); diff != "" {
+				t.Errorf("getRetainedKeys() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,661 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/greenpau/go-authcrunch"
+	"github.com/greenpau/go-authcrunch/pkg/authn"
+	"github.com/greenpau/go-authcrunch/pkg/authproxy"
+	"github.com/greenpau/go-authcrunch/pkg/authz"
+	"github.com/greenpau/go-authcrunch/pkg/errors"
+	"github.com/greenpau/go-authcrunch/pkg/idp"
+	"github.com/greenpau/go-authcrunch/pkg/ids"
+	"github.com/greenpau/go-authcrunch/pkg/kms"
+	"github.com/greenpau/go-authcrunch/pkg/registry"
+	"github.com/greenpau/go-authcrunch/pkg/sso"
+	"go.uber.org/zap"
+)
+
+const (
+	identityStoreComponent    = "identity_store"
+	identityProviderComponent = "identity_provider"
+	ssoProviderComponent      = "sso_provider"
+	userRegistryComponent     = "user_registry"
+	portalComponent           = "portal"
+	gatekeeperComponent       = "gatekeeper"
+)
+
+const (
+	componentAdded     = "added"
+	componentUpdated   = "updated"
+	componentRemoved   = "removed"
+	componentUnchanged = "unchanged"
+	// componentReloadRequired is the action of a changed portal kept by
+	// secrets rotation. The portal is rebuilt by the next config reload.
+	componentReloadRequired = "reload_required"
+)
+
+// server is the runtime of the security app. It mirrors authcrunch.Server,
+// but it is assembled component by component, so that a config reload
+// carries over the components whose configuration did not change,
+// together with their in-memory state, e.g. sessions and sandboxes.
+type server struct {
+	// mu guards the components replaced by secrets rotation.
+	mu                sync.RWMutex
+	config            *authcrunch.Config
+	portals           map[string]*authn.Portal
+	gatekeepers       map[string]*authz.Gatekeeper
+	identityStores    map[string]ids.IdentityStore
+	identityProviders map[string]idp.IdentityProvider
+	ssoProviders      map[string]sso.SingleSignOnProvider
+	userRegistries    map[string]registry.Provider
+	// policies holds the runtime of the authorization policies.
+	policies map[string]*authorizationPolicy
+	// jwks holds the keys verifying the tokens minted by the policies.
+	jwks []byte
+	// realms holds the realms of the identity stores and providers
+	// enabled in each portal.
+	realms map[string][]string
+	// retainedKeys holds the verify keys of the rotated secrets, by
+	// component key.
+	retainedKeys map[string][]*retainedKey
+	// fingerprints holds the hashes of component configurations.
+	fingerprints map[string]string
+	logger       *zap.Logger
+}
+
+// authorizationPolicy is the runtime of an authorization policy, i.e. its
+// gatekeeper and its extension provisioned with the same config.
+type authorizationPolicy struct {
+	config           *authz.PolicyConfig
+	gatekeeper       *authz.Gatekeeper
+	ext              *AuthorizationPolicyExtension
+	untrustedHeaders []string
+	// fingerprint is the hash of the extension configuration.
+	fingerprint string
+}
+
+// serverChange is a change to a component between two server instances.
+type serverChange struct {
+	Kind   string
+	Name   string
+	Action string
+}
+
+func newServerInstance(config *authcrunch.Config, logger *zap.Logger) *server {
+	return &server{
+		config:            config,
+		portals:           make(map[string]*authn.Portal),
+		gatekeepers:       make(map[string]*authz.Gatekeeper),
+		identityStores:    make(map[string]ids.IdentityStore),
+		identityProviders: make(map[string]idp.IdentityProvider),
+		ssoProviders:      make(map[string]sso.SingleSignOnProvider),
+		userRegistries:    make(map[string]registry.Provider),
+		policies:          make(map[string]*authorizationPolicy),
+		realms:            make(map[string][]string),
+		retainedKeys:      make(map[string][]*retainedKey),
+		fingerprints:      make(map[string]string),
+		logger:            logger,
+	}
+}
+
+// newServer returns an instance of server for the provided, validated
+// config. When prev is not nil, the components of prev whose
+// configuration and dependencies are unchanged are carried over, and only
+// the added and changed components are built. The retained keys, by
+// component key, are added to the crypto key store configs of the
+// portals and the gatekeepers. When keepPortals is true, the portals of
+// prev are kept even when they changed, because rebuilding a portal drops
+// its sessions and sandboxes.
+func newServer(config *authcrunch.Config, prev *server, retained map[string][]*retainedKey, keepPortals bool, logger *zap.Logger) (*server, []*serverChange, error) {
+	srv := newServerInstance(config, logger)
+	if prev == nil {
+		prev = newServerInstance(nil, logger)
+	}
+	prev.mu.RLock()
+	defer prev.mu.RUnlock()
+
+	// The fingerprints are taken before the cookie names of the portals
+	// are added to the authorization policies.
+	changes, err := srv.addFingerprints(prev)
+	if err != nil {
+		return nil, nil, err
+	}
+	isChanged := func(kind, name string) bool {
+		return slices.ContainsFunc(changes, func(c *serverChange) bool {
+			return c.Kind == kind && c.Name == name && c.Action != componentUnchanged
+		})
+	}
+
+	// The retained keys are not part of the fingerprints, so that they do
+	// not rebuild the components when they expire. The config is already
+	// validated, therefore the parsed crypto key store configs are
+	// replaced as well.
+	for _, cfg := range config.AuthenticationPortals {
+		keys := retained[getComponentKey(portalComponent, cfg.Name)]
+		if len(keys) == 0 {
+			continue
+		}
+		cfg.RawCryptoKeyStoreConfig = append(cfg.RawCryptoKeyStoreConfig, getRetainedKeyConfigs(keys)...)
+		if cfg.CryptoKeyStoreConfig, err = kms.NewCryptoKeyStoreConfig(cfg.RawCryptoKeyStoreConfig); err != nil {
+			return nil, nil, errors.ErrNewServer.WithArgs("failed adding retained keys of "+cfg.Name, err)
+		}
+	}
+	for _, cfg := range config.AuthorizationPolicies {
+		keys := retained[getComponentKey(gatekeeperComponent, cfg.Name)]
+		if len(keys) == 0 {
+			continue
+		}
+		cfg.RawCryptoKeyStoreConfig = append(cfg.RawCryptoKeyStoreConfig, getRetainedKeyConfigs(keys)...)
+		if cfg.CryptoKeyStoreConfig, err = kms.NewCryptoKeyStoreConfig(cfg.RawCryptoKeyStoreConfig); err != nil {
+			return nil, nil, errors.ErrNewServer.WithArgs("failed adding retained keys of "+cfg.Name, err)
+		}
+	}
+	for key, keys := range retained {
+		srv.retainedKeys[key] = keys
+	}
+
+	for _, cfg := range config.IdentityProviders {
+		if !isChanged(identityProviderComponent, cfg.Name) {
+			srv.identityProviders[cfg.Name] = prev.identityProviders[cfg.Name]
+			continue
+		}
+		provider, err := idp.NewIdentityProvider(cfg, logger)
+		if err != nil {
+			return nil, nil, errors.ErrNewServer.WithArgs("failed initializing identity provider", err)
+		}
+		if err := provider.Configure(); err != nil {
+			return nil, nil, errors.ErrNewServer.WithArgs("failed configuring identity provider", err)
+		}
+		srv.identityProviders[cfg.Name] = provider
+	}
+
+	for _, cfg := range config.IdentityStores {
+		if !isChanged(identityStoreComponent, cfg.Name) {
+			srv.identityStores[cfg.Name] = prev.identityStores[cfg.Name]
+			continue
+		}
+		store, err := ids.NewIdentityStore(cfg, logger)
+		if err != nil {
+			return nil, nil, errors.ErrNewServer.WithArgs("failed initializing identity store", err)
+		}
+		if err := store.Configure(); err != nil {
+			return nil, nil, errors.ErrNewServer.WithArgs("failed configuring identity store", err)
+		}
+		srv.identityStores[cfg.Name] = store
+	}
+
+	for _, cfg := range config.SingleSignOnProviders {
+		if !isChanged(ssoProviderComponent, cfg.Name) {
+			srv.ssoProviders[cfg.Name] = prev.ssoProviders[cfg.Name]
+			continue
+		}
+		provider, err := sso.NewSingleSignOnProvider(cfg, logger)
+		if err != nil {
+			return nil, nil, errors.ErrNewServer.WithArgs("failed initializing sso provider", err)
+		}
+		if err := provider.Configure(); err != nil {
+			return nil, nil, errors.ErrNewServer.WithArgs("failed configuring sso provider", err)
+		}
+		srv.ssoProviders[cfg.Name] = provider
+	}
+
+	if config.UserRegistration != nil {
+		for _, userRegistry := range config.UserRegistration.GetProviders() {
+			if !isChanged(userRegistryComponent, userRegistry.GetName()) {
+				srv.userRegistries[userRegistry.GetName()] = prev.userRegistries[userRegistry.GetName()]
+				continue
+			}
+			if err := userRegistry.Activate(logger); err != nil {
+				return nil, nil, errors.ErrNewServer.WithArgs("failed configuring user registry", err)
+			}
+			srv.userRegistries[userRegistry.GetName()] = userRegistry
+		}
+	}
+
+	var portalsRebuilt bool
+	for i, cfg := range config.AuthenticationPortals {
+		srv.realms[cfg.Name] = srv.getPortalRealms(cfg)
+		if !isChanged(portalComponent, cfg.Name) {
+			if !srv.hasChangedPortalDependencies(cfg, isChanged) {
+				srv.portals[cfg.Name] = prev.portals[cfg.Name]
+				continue
+			}
+			setComponentChange(changes, portalComponent, cfg.Name, componentUpdated)
+		}
+		if prevCfg := prev.getPortalConfig(cfg.Name); keepPortals && prevCfg != nil {
+			// The kept portal runs with its previous config. Its fingerprint
+			// matches no config, so that the next reload rebuilds it.
+			config.AuthenticationPortals[i] = prevCfg
+			srv.portals[cfg.Name] = prev.portals[cfg.Name]
+			srv.fingerprints[getComponentKey(portalComponent, cfg.Name)] = ""
+			setComponentChange(changes, portalComponent, cfg.Name, componentReloadRequired)
+			continue
+		}
+		portalsRebuilt = true
+
+		portal, err := authn.NewPortal(authn.PortalParameters{
+			Config:                cfg,
+			Logger:                logger,
+			IdentityStores:        srv.getIdentityStores(),
+			IdentityProviders:     srv.getIdentityProviders(),
+			SingleSignOnProviders: srv.getSingleSignOnProviders(),
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		enabledIdentityStores := portal.GetIdentityStoreNames()
+		for _, userRegistry := range srv.getUserRegistries() {
+			if _, exists := enabledIdentityStores[userRegistry.GetIdentityStoreName()]; !exists {
+				continue
+			}
+			if err := portal.AddUserRegistry(userRegistry); err != nil {
+				return nil, nil, errors.ErrNewServer.WithArgs("failed adding registry to portal", err)
+			}
+		}
+		srv.portals[cfg.Name] = portal
+	}
+	for name := range prev.portals {
+		if _, exists := srv.portals[name]; !exists {
+			portalsRebuilt = true
+		}
+	}
+
+	var authenticators []authproxy.Authenticator
+	for _, cfg := range config.AuthenticationPortals {
+		authenticators = append(authenticators, srv.portals[cfg.Name])
+	}
+
+	for _, cfg := range config.AuthorizationPolicies {
+		if len(cfg.AccessTokenCookieNames) == 0 {
+			// Authorization policy has no cookie names configured.
+			// The following code discovers the applicable cookie names from the portals.
+			for _, portal := range srv.getPortals() {
+				portalAccessTokenCookieName := portal.GetAccessTokenCookieName()
+				if portalAccessTokenCookieName == "" {
+					continue
+				}
+				if slices.Contains(cfg.AccessTokenCookieNames, portalAccessTokenCookieName) {
+					continue
+				}
+				cfg.AccessTokenCookieNames = append(cfg.AccessTokenCookieNames, portalAccessTokenCookieName)
+			}
+		}
+
+		if !isChanged(gatekeeperComponent, cfg.Name) {
+			if !portalsRebuilt {
+				srv.gatekeepers[cfg.Name] = prev.gatekeepers[cfg.Name]
+				continue
+			}
+			// The gatekeepers hold references to all portals.
+			setComponentChange(changes, gatekeeperComponent, cfg.Name, componentUpdated)
+		}
+
+		gatekeeper, err := authz.NewGatekeeper(cfg, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := gatekeeper.AddAuthenticators(authenticators); err != nil {
+			return nil, nil, err
+		}
+		if err := gatekeeper.AddRemoteAuthenticators(); err != nil {
+			return nil, nil, err
+		}
+		if err := gatekeeper.HasAuthProxies(); err != nil {
+			return nil, nil, err
+		}
+		srv.gatekeepers[cfg.Name] = gatekeeper
+	}
+
+	return srv, changes, nil
+}
+
+// addFingerprints fingerprints the components of the server config and
+// returns the changes relative to prev, sorted by component key.
+func (srv *server) addFingerprints(prev *server) ([]*serverChange, error) {
+	var changes []*serverChange
+	add := func(kind, name string, cfg interface{}) error {
+		key := getComponentKey(kind, name)
+		fp, err := getComponentFingerprint(cfg)
+		if err != nil {
+			return errors.ErrNewServer.WithArgs("failed fingerprinting "+key, err)
+		}
+		if _, exists := srv.fingerprints[key]; exists {
+			return errors.ErrNewServer.WithArgs("duplicate component name", key)
+		}
+		srv.fingerprints[key] = fp
+		prevFp, exists := prev.fingerprints[key]
+		switch {
+		case !exists:
+			changes = append(changes, &serverChange{Kind: kind, Name: name, Action: componentAdded})
+		case prevFp != fp:
+			changes = append(changes, &serverChange{Kind: kind, Name: name, Action: componentUpdated})
+		default:
+			changes = append(changes, &serverChange{Kind: kind, Name: name, Action: componentUnchanged})
+		}
+		return nil
+	}
+
+	config := srv.config
+	for _, cfg := range config.IdentityProviders {
+		if err := add(identityProviderComponent, cfg.Name, cfg); err != nil {
+			return nil, err
+		}
+	}
+	for _, cfg := range config.IdentityStores {
+		if err := add(identityStoreComponent, cfg.Name, cfg); err != nil {
+			return nil, err
+		}
+	}
+	for _, cfg := range config.SingleSignOnProviders {
+		if err := add(ssoProviderComponent, cfg.Name, cfg); err != nil {
+			return nil, err
+		}
+	}
+	if config.UserRegistration != nil {
+		for _, userRegistry := range config.UserRegistration.GetProviders() {
+			// The user registries depend on the shared credentials and messaging.
+			cfg := []interface{}{userRegistry.AsMap(), config.Credentials, config.Messaging}
+			if err := add(userRegistryComponent, userRegistry.GetName(), cfg); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, cfg := range config.AuthenticationPortals {
+		if err := add(portalComponent, cfg.Name, cfg); err != nil {
+			return nil, err
+		}
+	}
+	for _, cfg := range config.AuthorizationPolicies {
+		if err := add(gatekeeperComponent, cfg.Name, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	for key := range prev.fingerprints {
+		if _, exists := srv.fingerprints[key]; exists {
+			continue
+		}
+		kind, name := splitComponentKey(key)
+		changes = append(changes, &serverChange{Kind: kind, Name: name, Action: componentRemoved})
+	}
+
+	slices.SortFunc(changes, func(a, b *serverChange) int {
+		return strings.Compare(getComponentKey(a.Kind, a.Name), getComponentKey(b.Kind, b.Name))
+	})
+	return changes, nil
+}
+
+// hasChangedPortalDependencies returns true when any of the identity
+// stores, identity providers, sso providers, or user registries used by
+// a portal changed.
+func (srv *server) hasChangedPortalDependencies(cfg *authn.PortalConfig, isChanged func(string, string) bool) bool {
+	for _, name := range cfg.IdentityStores {
+		if isChanged(identityStoreComponent, name) {
+			return true
+		}
+		if srv.config.UserRegistration == nil {
+			continue
+		}
+		for _, userRegistry := range srv.config.UserRegistration.GetProviders() {
+			if userRegistry.GetIdentityStoreName() != name {
+				continue
+			}
+			if isChanged(userRegistryComponent, userRegistry.GetName()) {
+				return true
+			}
+		}
+	}
+	for _, name := range cfg.IdentityProviders {
+		if isChanged(identityProviderComponent, name) {
+			return true
+		}
+	}
+	for _, name := range cfg.SingleSignOnProviders {
+		if isChanged(ssoProviderComponent, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// provisionPolicies provisions the extensions of the authorization policies
+// with the config of the server. When prev is not nil, the runtime of the
+// policies whose gatekeeper is reused and whose extension is unchanged is
+// carried over, e.g. the cache of the exchanged tokens.
+func (srv *server) provisionPolicies(exts []*AuthorizationPolicyExtension, prev *server) error {
+	if prev != nil {
+		prev.mu.RLock()
+		defer prev.mu.RUnlock()
+	}
+	var provisioned []*AuthorizationPolicyExtension
+	for _, cfg := range srv.config.AuthorizationPolicies {
+		gatekeeper := srv.gatekeepers[cfg.Name]
+		ext := getAuthorizationPolicyExtension(exts, cfg.Name)
+		fp, err := getComponentFingerprint(ext)
+		if err != nil {
+			return fmt.Errorf("failed fingerprinting %q authorization policy extension: %v", cfg.Name, err)
+		}
+		if prev != nil {
+			if policy, exists := prev.policies[cfg.Name]; exists && policy.gatekeeper == gatekeeper && policy.fingerprint == fp {
+				srv.policies[cfg.Name] = policy
+				provisioned = append(provisioned, policy.ext)
+				continue
+			}
+		}
+		ext = ext.clone()
+		if err := ext.provision(srv.config.AuthorizationPolicies); err != nil {
+			return err
+		}
+		srv.policies[cfg.Name] = &authorizationPolicy{
+			config:           cfg,
+			gatekeeper:       gatekeeper,
+			ext:              ext,
+			untrustedHeaders: getUntrustedHeaders(cfg, ext),
+			fingerprint:      fp,
+		}
+		provisioned = append(provisioned, ext)
+	}
+	for _, ext := range provisioned {
+		if len(ext.getSigners()) == 0 {
+			continue
+		}
+		jwks, err := getAssertionJWKS(provisioned)
+		if err != nil {
+			return fmt.Errorf("failed encoding jwks: %v", err)
+		}
+		srv.jwks = jwks
+		break
+	}
+	return nil
+}
+
+// getPortalConfig returns the config of the portal of the server, or nil
+// when the server has no such portal.
+func (srv *server) getPortalConfig(s string) *authn.PortalConfig {
+	if srv.config == nil {
+		return nil
+	}
+	if _, exists := srv.portals[s]; !exists {
+		return nil
+	}
+	for _, cfg := range srv.config.AuthenticationPortals {
+		if cfg.Name == s {
+			return cfg
+		}
+	}
+	return nil
+}
+
+// getPortalRealms returns the realms of the identity stores and providers
+// enabled in a portal.
+func (srv *server) getPortalRealms(cfg *authn.PortalConfig) []string {
+	var realms []string
+	for _, name := range cfg.IdentityStores {
+		for _, store := range srv.config.IdentityStores {
+			if store.Name == name {
+				realms = append(realms, getConfigParam(store.Params, "realm"))
+			}
+		}
+	}
+	for _, name := range cfg.IdentityProviders {
+		for _, provider := range srv.config.IdentityProviders {
+			if provider.Name == name {
+				realms = append(realms, getConfigParam(provider.Params, "realm"))
+			}
+		}
+	}
+	return realms
+}
+
+// swap replaces the components of the server with the components of next,
+// e.g. after secrets rotation. The server keeps its identity, so that the
+// middlewares holding it pick up the new components.
+func (srv *server) swap(next *server) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.config = next.config
+	srv.portals = next.portals
+	srv.gatekeepers = next.gatekeepers
+	srv.identityStores = next.identityStores
+	srv.identityProviders = next.identityProviders
+	srv.ssoProviders = next.ssoProviders
+	srv.userRegistries = next.userRegistries
+	srv.policies = next.policies
+	srv.jwks = next.jwks
+	srv.realms = next.realms
+	srv.retainedKeys = next.retainedKeys
+	srv.fingerprints = next.fingerprints
+}
+
+// GetPortalByName returns an instance of authn.Portal based on its name.
+func (srv *server) GetPortalByName(s string) (*authn.Portal, error) {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	if portal, exists := srv.portals[s]; exists {
+		return portal, nil
+	}
+	return nil, fmt.Errorf("portal not found")
+}
+
+// GetGatekeeperByName returns an instance of authz.Gatekeeper based on its name.
+func (srv *server) GetGatekeeperByName(s string) (*authz.Gatekeeper, error) {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	if gatekeeper, exists := srv.gatekeepers[s]; exists {
+		return gatekeeper, nil
+	}
+	return nil, fmt.Errorf("gatekeeper not found")
+}
+
+// getAuthorizationPolicy returns the runtime of the authorization policy.
+// The gatekeeper and the extension are replaced together by secrets rotation.
+func (srv *server) getAuthorizationPolicy(s string) (*authorizationPolicy, error) {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	if policy, exists := srv.policies[s]; exists {
+		return policy, nil
+	}
+	return nil, fmt.Errorf("gatekeeper not found")
+}
+
+// getJWKS returns the keys verifying the tokens minted by the policies.
+func (srv *server) getJWKS() []byte {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	return srv.jwks
+}
+
+func (srv *server) getPortals() []*authn.Portal {
+	var entries []*authn.Portal
+	for _, cfg := range srv.config.AuthenticationPortals {
+		if portal, exists := srv.portals[cfg.Name]; exists {
+			entries = append(entries, portal)
+		}
+	}
+	return entries
+}
+
+func (srv *server) getIdentityStores() []ids.IdentityStore {
+	var entries []ids.IdentityStore
+	for _, cfg := range srv.config.IdentityStores {
+		entries = append(entries, srv.identityStores[cfg.Name])
+	}
+	return entries
+}
+
+func (srv *server) getIdentityProviders() []idp.IdentityProvider {
+	var entries []idp.IdentityProvider
+	for _, cfg := range srv.config.IdentityProviders {
+		entries = append(entries, srv.identityProviders[cfg.Name])
+	}
+	return entries
+}
+
+func (srv *server) getSingleSignOnProviders() []sso.SingleSignOnProvider {
+	var entries []sso.SingleSignOnProvider
+	for _, cfg := range srv.config.SingleSignOnProviders {
+		entries = append(entries, srv.ssoProviders[cfg.Name])
+	}
+	return entries
+}
+
+func (srv *server) getUserRegistries() []registry.Provider {
+	var entries []registry.Provider
+	if srv.config.UserRegistration == nil {
+		return entries
+	}
+	for _, userRegistry := range srv.config.UserRegistration.GetProviders() {
+		if entry, exists := srv.userRegistries[userRegistry.GetName()]; exists {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func setComponentChange(changes []*serverChange, kind, name, action string) {
+	for _, change := range changes {
+		if change.Kind == kind && change.Name == name {
+			change.Action = action
+		}
+	}
+}
+
+func getComponentKey(kind, name string) string {
+	return kind + "/" + name
+}
+
+func splitComponentKey(key string) (string, string) {
+	kind, name, _ := strings.Cut(key, "/")
+	return kind, name
+}
+
+func getComponentFingerprint(cfg interface{}) (string, error) {
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:]), nil
+}
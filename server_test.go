@@ -0,0 +1,213 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/google/go-cmp/cmp"
+	"github.com/greenpau/go-authcrunch"
+	logutil "github.com/greenpau/go-authcrunch/pkg/util/log"
+)
+
+const testServerCaddyfile = `
+security {
+  local identity store localdb {
+    realm %s
+    path %s
+  }
+  authentication portal myportal {
+    crypto key sign-verify 0e2fdcf8-6868-41a7-884b-7308795fc286
+    enable identity store localdb
+  }
+  authorization policy mypolicy {
+    crypto key verify 0e2fdcf8-6868-41a7-884b-7308795fc286
+    allow roles %s
+  }
+}`
+
+func newTestServerConfig(t *testing.T, s string) *authcrunch.Config {
+	t.Helper()
+	d := caddyfile.NewTestDispenser(s)
+	raw, err := parseCaddyfile(d, nil)
+	if err != nil {
+		t.Fatalf("failed parsing config: %v", err)
+	}
+	app := &App{}
+	if err := json.Unmarshal(raw.(httpcaddyfile.App).Value, app); err != nil {
+		t.Fatalf("failed unmarshaling config: %v", err)
+	}
+	if err := app.Config.Validate(); err != nil {
+		t.Fatalf("failed validating config: %v", err)
+	}
+	return app.Config
+}
+
+func TestNewServerReload(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "users.json")
+	logger := logutil.NewLogger()
+
+	prev, changes, err := newServer(newTestServerConfig(t, fmt.Sprintf(testServerCaddyfile, "local", dbPath, "authp/admin")), nil, nil, false, logger)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []*serverChange{
+		{Kind: gatekeeperComponent, Name: "mypolicy", Action: componentAdded},
+		{Kind: identityStoreComponent, Name: "localdb", Action: componentAdded},
+		{Kind: portalComponent, Name: "myportal", Action: componentAdded},
+	}
+	if diff := cmp.Diff(want, changes); diff != "" {
+		t.Fatalf("unexpected changes (-want +got):\n%s", diff)
+	}
+
+	testcases := []struct {
+		name             string
+		realm            string
+		roles            string
+		want             []*serverChange
+		reusedPortal     bool
+		reusedGatekeeper bool
+		reusedStore      bool
+	}{
+		{
+			name:             "reload with unchanged config",
+			realm:            "local",
+			roles:            "authp/admin",
+			reusedPortal:     true,
+			reusedGatekeeper: true,
+			reusedStore:      true,
+			want: []*serverChange{
+				{Kind: gatekeeperComponent, Name: "mypolicy", Action: componentUnchanged},
+				{Kind: identityStoreComponent, Name: "localdb", Action: componentUnchanged},
+				{Kind: portalComponent, Name: "myportal", Action: componentUnchanged},
+			},
+		},
+		{
+			name:         "reload with updated authorization policy",
+			realm:        "local",
+			roles:        "authp/user",
+			reusedPortal: true,
+			reusedStore:  true,
+			want: []*serverChange{
+				{Kind: gatekeeperComponent, Name: "mypolicy", Action: componentUpdated},
+				{Kind: identityStoreComponent, Name: "localdb", Action: componentUnchanged},
+				{Kind: portalComponent, Name: "myportal", Action: componentUnchanged},
+			},
+		},
+		{
+			name:  "reload with updated identity store",
+			realm: "contoso",
+			roles: "authp/admin",
+			want: []*serverChange{
+				{Kind: gatekeeperComponent, Name: "mypolicy", Action: componentUpdated},
+				{Kind: identityStoreComponent, Name: "localdb", Action: componentUpdated},
+				{Kind: portalComponent, Name: "myportal", Action: componentUpdated},
+			},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := newTestServerConfig(t, fmt.Sprintf(testServerCaddyfile, tc.realm, dbPath, tc.roles))
+			srv, changes, err := newServer(cfg, prev, nil, false, logger)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, changes); diff != "" {
+				t.Fatalf("unexpected changes (-want +got):\n%s", diff)
+			}
+			if got := srv.portals["myportal"] == prev.portals["myportal"]; got != tc.reusedPortal {
+				t.Errorf("unexpected portal reuse: got %t, want %t", got, tc.reusedPortal)
+			}
+			if got := srv.gatekeepers["mypolicy"] == prev.gatekeepers["mypolicy"]; got != tc.reusedGatekeeper {
+				t.Errorf("unexpected gatekeeper reuse: got %t, want %t", got, tc.reusedGatekeeper)
+			}
+			if got := srv.identityStores["localdb"] == prev.identityStores["localdb"]; got != tc.reusedStore {
+				t.Errorf("unexpected identity store reuse: got %t, want %t", got, tc.reusedStore)
+			}
+			if _, err := srv.GetPortalByName("myportal"); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if _, err := srv.GetGatekeeperByName("mypolicy"); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestProvisionPoliciesReload(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "users.json")
+	logger := logutil.NewLogger()
+
+	prev, _, err := newServer(newTestServerConfig(t, fmt.Sprintf(testServerCaddyfile, "local", dbPath, "authp/admin")), nil, nil, false, logger)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	exts := []*AuthorizationPolicyExtension{{Name: "mypolicy", StripHeaders: []string{"X-Tenant"}}}
+	if err := prev.provisionPolicies(exts, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	testcases := []struct {
+		name         string
+		roles        string
+		stripHeaders []string
+		reused       bool
+	}{
+		{
+			name:         "reload with unchanged policy",
+			roles:        "authp/admin",
+			stripHeaders: []string{"X-Tenant"},
+			reused:       true,
+		},
+		{
+			name:         "reload with updated extension",
+			roles:        "authp/admin",
+			stripHeaders: []string{"X-Tenant", "X-Org"},
+		},
+		{
+			name:         "reload with updated authorization policy",
+			roles:        "authp/user",
+			stripHeaders: []string{"X-Tenant"},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := newTestServerConfig(t, fmt.Sprintf(testServerCaddyfile, "local", dbPath, tc.roles))
+			srv, _, err := newServer(cfg, prev, nil, false, logger)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			exts := []*AuthorizationPolicyExtension{{Name: "mypolicy", StripHeaders: tc.stripHeaders}}
+			if err := srv.provisionPolicies(exts, prev); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := srv.policies["mypolicy"] == prev.policies["mypolicy"]; got != tc.reused {
+				t.Errorf("unexpected policy reuse: got %t, want %t", got, tc.reused)
+			}
+			policy, err := srv.getAuthorizationPolicy("mypolicy")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.stripHeaders, policy.ext.StripHeaders); diff != "" {
+				t.Errorf("unexpected strip headers (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	jwtlib "github.com/golang-jwt/jwt/v5"
+	"github.com/greenpau/go-authcrunch/pkg/authz"
+	"github.com/greenpau/go-authcrunch/pkg/kms"
+	"github.com/greenpau/go-authcrunch/pkg/requests"
+)
+
+const (
+	defaultSignedAssertionLifetime = 60
+	maxSignedAssertionLifetime     = 3600
+
+	// assertionJWKSPath is the path suffix of the portal endpoint publishing
+	// the keys verifying the signed assertions.
+	assertionJWKSPath = "/.well-known/jwks.json"
+)
+
+// signedAssertionClaims are the claims of the validated user copied to the
+// signed assertions.
+var signedAssertionClaims = []string{"sub", "email", "name", "roles", "realm", "origin", "iss"}
+
+// SignedAssertion injects a short-lived JWT token asserting the identity of
+// an authorized user to the upstream. The token is signed with the key of
+// the authorization policy having "sign" usage, e.g.
+//
+//	crypto key assertion sign from file /etc/caddy/assertion.key
+//
+// The upstreams verify the token with the keys published by the portals.
+type SignedAssertion struct {
+	Header   string `json:"header,omitempty" xml:"header,omitempty" yaml:"header,omitempty"`
+	KeyID    string `json:"key_id,omitempty" xml:"key_id,omitempty" yaml:"key_id,omitempty"`
+	Audience string `json:"audience,omitempty" xml:"audience,omitempty" yaml:"audience,omitempty"`
+	// Lifetime is the lifetime of the token in seconds.
+	Lifetime int `json:"lifetime,omitempty" xml:"lifetime,omitempty" yaml:"lifetime,omitempty"`
+	method   jwtlib.SigningMethod
+	key      crypto.Signer
+}
+
+// Validate validates SignedAssertion.
+func (a *SignedAssertion) Validate() error {
+	a.Header = strings.TrimSpace(a.Header)
+	if a.Header == "" {
+		return fmt.Errorf("signed assertion header name is empty")
+	}
+	if a.KeyID == "" {
+		return fmt.Errorf("signed assertion key id is empty")
+	}
+	if a.Audience == "" {
+		return fmt.Errorf("signed assertion audience is empty")
+	}
+	if a.Lifetime == 0 {
+		a.Lifetime = defaultSignedAssertionLifetime
+	}
+	if a.Lifetime < 0 || a.Lifetime > maxSignedAssertionLifetime {
+		return fmt.Errorf("signed assertion lifetime must be between 1 and %d seconds, got %d", maxSignedAssertionLifetime, a.Lifetime)
+	}
+	return nil
+}
+
+// loadKey loads the signing key from the crypto key store config of the
+// policy. The key must not verify the tokens of the policy, otherwise the
+// assertion would be a valid access token.
+func (a *SignedAssertion) loadKey(p *authz.PolicyConfig) error {
+	cfgs, err := kms.ParseCryptoKeyConfigs(p.GetRawCryptoKeyStoreConfig())
+	if err != nil {
+		return err
+	}
+	for _, cfg := range cfgs {
+		if cfg.ID != a.KeyID {
+			continue
+		}
+		if cfg.Usage != "sign" {
+			return fmt.Errorf("signed assertion key %q must have sign usage, got %s", a.KeyID, cfg.Usage)
+		}
+		keys, err := kms.GetKeysFromConfig(cfg)
+		if err != nil {
+			return fmt.Errorf("signed assertion key %q erred: %v", a.KeyID, err)
+		}
+		for _, k := range keys {
+			switch key := k.Sign.Secret.(type) {
+			case *rsa.PrivateKey:
+				a.method, a.key = jwtlib.SigningMethodRS256, key
+			case *ecdsa.PrivateKey:
+				switch key.Curve.Params().BitSize {
+				case 256:
+					a.method = jwtlib.SigningMethodES256
+				case 384:
+					a.method = jwtlib.SigningMethodES384
+				case 521:
+					a.method = jwtlib.SigningMethodES512
+				default:
+					return fmt.Errorf("signed assertion key %q has unsupported curve", a.KeyID)
+				}
+				a.key = key
+			default:
+				continue
+			}
+			return nil
+		}
+		return fmt.Errorf("signed assertion key %q must be RSA or ECDSA private key", a.KeyID)
+	}
+	return fmt.Errorf("signed assertion key %q not found", a.KeyID)
+}
+
+// mint returns the token asserting the identity of the authorized request.
+func (a *SignedAssertion) mint(ar *requests.AuthorizationRequest, now time.Time) (string, error) {
+	return a.sign(a.getClaims(ar, now))
+}
+
+// getClaims returns the claims of the token asserting the identity of the
+// authorized request.
+func (a *SignedAssertion) getClaims(ar *requests.AuthorizationRequest, now time.Time) jwtlib.MapClaims {
+	claims := jwtlib.MapClaims{}
+	tokenClaims := getTokenClaims(ar)
+	for _, k := range signedAssertionClaims {
+		if v, found := lookupClaimValue([]map[string]interface{}{tokenClaims, ar.Response.User}, k); found {
+			claims[k] = v
+		}
+	}
+	claims["aud"] = a.Audience
+	claims["iat"] = now.Unix()
+	claims["nbf"] = now.Unix()
+	claims["exp"] = now.Add(time.Duration(a.Lifetime) * time.Second).Unix()
+	return claims
+}
+
+func (a *SignedAssertion) sign(claims jwtlib.MapClaims) (string, error) {
+	if a.key == nil {
+		return "", fmt.Errorf("signed assertion key %q is not loaded", a.KeyID)
+	}
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	claims["jti"] = hex.EncodeToString(jti)
+	token := jwtlib.NewWithClaims(a.method, claims)
+	token.Header["kid"] = a.KeyID
+	return token.SignedString(a.key)
+}
+
+// jwk is a public key in JSON Web Key format.
+type jwk struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+func (a *SignedAssertion) getPublicKey() *jwk {
+	if a.key == nil {
+		return nil
+	}
+	k := &jwk{Use: "sig", Algorithm: a.method.Alg(), KeyID: a.KeyID}
+	switch pub := a.key.Public().(type) {
+	case *rsa.PublicKey:
+		k.KeyType = "RSA"
+		k.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		k.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		params := pub.Curve.Params()
+		size := (params.BitSize + 7) / 8
+		k.KeyType = "EC"
+		k.Curve = params.Name
+		k.X = base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, size)))
+		k.Y = base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, size)))
+	default:
+		return nil
+	}
+	return k
+}
+
+// getAssertionJWKS returns the JWKS document with the keys verifying the
+// signed assertions and the locally exchanged tokens of the policies.
+func getAssertionJWKS(exts []*AuthorizationPolicyExtension) ([]byte, error) {
+	doc := struct {
+		Keys []*jwk `json:"keys"`
+	}{
+		Keys: []*jwk{},
+	}
+	seen := make(map[string]bool)
+	for _, ext := range exts {
+		for _, signer := range ext.getSigners() {
+			k := signer.getPublicKey()
+			if k == nil {
+				continue
+			}
+			b, _ := json.Marshal(k)
+			if seen[string(b)] {
+				continue
+			}
+			seen[string(b)] = true
+			doc.Keys = append(doc.Keys, k)
+		}
+	}
+	return json.Marshal(doc)
+}
@@ -0,0 +1,208 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwtlib "github.com/golang-jwt/jwt/v5"
+	"github.com/google/go-cmp/cmp"
+	"github.com/greenpau/go-authcrunch/pkg/authz"
+	"github.com/greenpau/go-authcrunch/pkg/kms"
+	"github.com/greenpau/go-authcrunch/pkg/requests"
+	"go.uber.org/zap"
+)
+
+func TestSignedAssertion(t *testing.T) {
+	dir := t.TempDir()
+	writeTestKeyPair(t, dir)
+	if _, err := generateSigningKey(dir, "rsa1", "RS256"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	testcases := []struct {
+		name      string
+		keyID     string
+		config    []string
+		wantAlg   string
+		shouldErr bool
+		err       string
+	}{
+		{
+			name:  "test ecdsa key",
+			keyID: "assertion",
+			config: []string{
+				"crypto key verify 0e2fdcf8-6868-41a7-884b-7308795fc286",
+				"crypto key assertion sign from file " + filepath.Join(dir, "private.pem"),
+			},
+			wantAlg: "ES256",
+		},
+		{
+			name:  "test rsa key",
+			keyID: "rsa1",
+			config: []string{
+				"crypto key verify 0e2fdcf8-6868-41a7-884b-7308795fc286",
+				"crypto key rsa1 sign from file " + filepath.Join(dir, "rsa1.key"),
+			},
+			wantAlg: "RS256",
+		},
+		{
+			name:  "test key verifying access tokens",
+			keyID: "assertion",
+			config: []string{
+				"crypto key assertion sign-verify from file " + filepath.Join(dir, "private.pem"),
+			},
+			shouldErr: true,
+			err:       `signed assertion key "assertion" must have sign usage, got sign-verify`,
+		},
+		{
+			name:  "test shared key",
+			keyID: "assertion",
+			config: []string{
+				"crypto key verify 0e2fdcf8-6868-41a7-884b-7308795fc286",
+				"crypto key assertion sign 0e2fdcf8-6868-41a7-884b-7308795fc286",
+			},
+			shouldErr: true,
+			err:       `signed assertion key "assertion" must be RSA or ECDSA private key`,
+		},
+		{
+			name:  "test undefined key",
+			keyID: "foo",
+			config: []string{
+				"crypto key verify 0e2fdcf8-6868-41a7-884b-7308795fc286",
+			},
+			shouldErr: true,
+			err:       `signed assertion key "foo" not found`,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &SignedAssertion{Header: "X-Identity-Assertion", KeyID: tc.keyID, Audience: "orders.internal"}
+			if err := a.Validate(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			p := &authz.PolicyConfig{Name: "mypolicy", RawCryptoKeyStoreConfig: tc.config}
+			err := a.loadKey(p)
+			if err != nil {
+				if !tc.shouldErr {
+					t.Fatalf("expected success, got: %v", err)
+				}
+				if diff := cmp.Diff(tc.err, err.Error()); diff != "" {
+					t.Fatalf("unexpected error mismatch (-want +got):\n%s", diff)
+				}
+				return
+			}
+			if tc.shouldErr {
+				t.Fatalf("unexpected success, want: %v", tc.err)
+			}
+
+			// The policy keeps verifying the access tokens with the other keys.
+			ksCfg, err := kms.NewCryptoKeyStoreConfig(tc.config)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			ks, err := kms.NewCryptoKeyStore(ksCfg, zap.NewNop())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for _, k := range ks.GetVerifyKeys() {
+				if k.Config.ID == tc.keyID {
+					t.Fatalf("signed assertion key verifies access tokens")
+				}
+			}
+
+			ar := requests.NewAuthorizationRequest()
+			ar.Response.User = map[string]interface{}{
+				"sub":   "jsmith",
+				"email": "jsmith@example.com",
+				"roles": []interface{}{"authp/user"},
+				"realm": "local",
+				"addr":  "10.0.0.1",
+			}
+			now := time.Now()
+			s, err := a.mint(ar, now)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			b, err := getAssertionJWKS([]*AuthorizationPolicyExtension{{Name: "mypolicy", SignedAssertion: a}})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			keys := getTestJWKSKeys(t, b)
+
+			token, err := jwtlib.Parse(s, func(token *jwtlib.Token) (interface{}, error) {
+				return keys[token.Header["kid"].(string)], nil
+			}, jwtlib.WithAudience("orders.internal"), jwtlib.WithValidMethods([]string{tc.wantAlg}))
+			if err != nil {
+				t.Fatalf("failed verifying assertion with jwks: %v", err)
+			}
+			claims := token.Claims.(jwtlib.MapClaims)
+			delete(claims, "jti")
+			want := jwtlib.MapClaims{
+				"sub":   "jsmith",
+				"email": "jsmith@example.com",
+				"roles": []interface{}{"authp/user"},
+				"realm": "local",
+				"aud":   "orders.internal",
+				"iat":   float64(now.Unix()),
+				"nbf":   float64(now.Unix()),
+				"exp":   float64(now.Unix() + defaultSignedAssertionLifetime),
+			}
+			if diff := cmp.Diff(want, claims); diff != "" {
+				t.Errorf("signed assertion claims mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// getTestJWKSKeys returns the public keys of the JWKS document by key id.
+func getTestJWKSKeys(t *testing.T, b []byte) map[string]interface{} {
+	t.Helper()
+	var doc struct {
+		Keys []*jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatalf("malformed jwks: %v", err)
+	}
+	decode := func(s string) *big.Int {
+		v, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatalf("malformed jwks: %v", err)
+		}
+		return new(big.Int).SetBytes(v)
+	}
+	keys := make(map[string]interface{})
+	for _, k := range doc.Keys {
+		switch k.KeyType {
+		case "RSA":
+			keys[k.KeyID] = &rsa.PublicKey{N: decode(k.N), E: int(decode(k.E).Int64())}
+		case "EC":
+			curve := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}[k.Curve]
+			keys[k.KeyID] = &ecdsa.PublicKey{Curve: curve, X: decode(k.X), Y: decode(k.Y)}
+		default:
+			t.Fatalf("unexpected key type: %s", k.KeyType)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,391 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	jwtlib "github.com/golang-jwt/jwt/v5"
+	"github.com/greenpau/go-authcrunch/pkg/authz"
+	"github.com/greenpau/go-authcrunch/pkg/requests"
+)
+
+const (
+	tokenExchangeGrantType   = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeJWT             = "urn:ietf:params:oauth:token-type:jwt"
+	tokenTypeAccessToken     = "urn:ietf:params:oauth:token-type:access_token"
+	defaultTokenExchangeTTL  = 300
+	tokenExchangeTimeout     = 10 * time.Second
+	tokenExchangeExpirySkew  = 30 * time.Second
+	maxTokenExchangeCacheLen = 10000
+	maxTokenExchangeRespSize = 1 << 20
+)
+
+// TokenExchange replaces the token of an authorized request with the access
+// token issued for the upstream, see RFC 8693. The token is either minted
+// with the key of the authorization policy having "sign" usage, or
+// obtained from the token endpoint of an authorization server.
+type TokenExchange struct {
+	Audience string   `json:"audience,omitempty" xml:"audience,omitempty" yaml:"audience,omitempty"`
+	Scopes   []string `json:"scopes,omitempty" xml:"scopes,omitempty" yaml:"scopes,omitempty"`
+	// KeyID is the key minting the tokens locally.
+	KeyID string `json:"key_id,omitempty" xml:"key_id,omitempty" yaml:"key_id,omitempty"`
+	// Lifetime is the lifetime of the locally minted tokens in seconds.
+	Lifetime      int    `json:"lifetime,omitempty" xml:"lifetime,omitempty" yaml:"lifetime,omitempty"`
+	TokenEndpoint string `json:"token_endpoint,omitempty" xml:"token_endpoint,omitempty" yaml:"token_endpoint,omitempty"`
+	ClientID      string `json:"client_id,omitempty" xml:"client_id,omitempty" yaml:"client_id,omitempty"`
+	ClientSecret  string `json:"client_secret,omitempty" xml:"client_secret,omitempty" yaml:"client_secret,omitempty"`
+
+	signer       *SignedAssertion
+	client       *http.Client
+	clientSecret string
+	cache        *tokenExchangeCache
+	// tokenCookies and tokenQueryParams are the cookies and the query
+	// parameters the gatekeeper of the policy reads the token from.
+	tokenCookies     []string
+	tokenQueryParams []string
+}
+
+// Validate validates TokenExchange.
+func (e *TokenExchange) Validate() error {
+	if e.Audience == "" {
+		return fmt.Errorf("token exchange audience is empty")
+	}
+	for _, scope := range e.Scopes {
+		if scope == "" || strings.ContainsAny(scope, " \t\r\n") {
+			return fmt.Errorf("token exchange scope %q is invalid", scope)
+		}
+	}
+	switch {
+	case e.KeyID != "" && e.TokenEndpoint != "":
+		return fmt.Errorf("token exchange must have either key or token endpoint, not both")
+	case e.KeyID != "":
+		if e.ClientID != "" || e.ClientSecret != "" {
+			return fmt.Errorf("token exchange client credentials require token endpoint")
+		}
+		if e.Lifetime == 0 {
+			e.Lifetime = defaultTokenExchangeTTL
+		}
+		if e.Lifetime < 0 || e.Lifetime > maxSignedAssertionLifetime {
+			return fmt.Errorf("token exchange lifetime must be between 1 and %d seconds, got %d", maxSignedAssertionLifetime, e.Lifetime)
+		}
+	case e.TokenEndpoint != "":
+		u, err := url.Parse(e.TokenEndpoint)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("token exchange token endpoint %q is invalid", e.TokenEndpoint)
+		}
+		if e.Lifetime != 0 {
+			return fmt.Errorf("token exchange lifetime applies to locally minted tokens only")
+		}
+		if e.ClientSecret != "" && e.ClientID == "" {
+			return fmt.Errorf("token exchange client secret requires client id")
+		}
+	default:
+		return fmt.Errorf("token exchange must have either key or token endpoint")
+	}
+	return nil
+}
+
+// provision loads the signing key from the crypto key store config of the
+// policy, or resolves the client secret for the token endpoint.
+func (e *TokenExchange) provision(p *authz.PolicyConfig) error {
+	e.cache = newTokenExchangeCache()
+	e.tokenCookies, e.tokenQueryParams = getTokenSourceNames(p)
+	if e.KeyID != "" {
+		e.signer = &SignedAssertion{
+			Header:   "Authorization",
+			KeyID:    e.KeyID,
+			Audience: e.Audience,
+			Lifetime: e.Lifetime,
+		}
+		if err := e.signer.loadKey(p); err != nil {
+			return fmt.Errorf("token exchange %v", err)
+		}
+		return nil
+	}
+	if err := checkRedactedValue("token exchange client secret", e.ClientSecret); err != nil {
+		return err
+	}
+	e.clientSecret = caddy.NewReplacer().ReplaceKnown(e.ClientSecret, "")
+	if e.client == nil {
+		e.client = &http.Client{Timeout: tokenExchangeTimeout}
+	}
+	return nil
+}
+
+// getTokenSourceNames returns the cookies and the query parameters the
+// gatekeeper reads the token from. These are the defaults of the token
+// validator, unless the policy has the access token cookie names.
+func getTokenSourceNames(p *authz.PolicyConfig) ([]string, []string) {
+	cookies := []string{"access_token", "jwt_access_token"}
+	queryParams := []string{"access_token", "jwt_access_token"}
+	if p == nil || len(p.AccessTokenCookieNames) == 0 {
+		return cookies, queryParams
+	}
+	cookies = append([]string(nil), p.AccessTokenCookieNames...)
+	for _, name := range p.AccessTokenCookieNames {
+		queryParams = append(queryParams, strings.ToLower(name))
+	}
+	return cookies, queryParams
+}
+
+// stripSubjectToken removes the token sources of the policy from the
+// request, so that the exchanged token is the only token reaching the
+// upstream.
+func (e *TokenExchange) stripSubjectToken(r *http.Request) {
+	cookies := r.Cookies()
+	var stripped bool
+	for _, c := range cookies {
+		if slices.Contains(e.tokenCookies, c.Name) {
+			stripped = true
+		}
+	}
+	if stripped {
+		r.Header.Del("Cookie")
+		for _, c := range cookies {
+			if !slices.Contains(e.tokenCookies, c.Name) {
+				r.AddCookie(c)
+			}
+		}
+	}
+
+	query := r.URL.Query()
+	stripped = false
+	for _, k := range e.tokenQueryParams {
+		if query.Has(k) {
+			query.Del(k)
+			stripped = true
+		}
+	}
+	if stripped {
+		r.URL.RawQuery = query.Encode()
+		r.RequestURI = r.URL.RequestURI()
+	}
+}
+
+// exchange returns the access token for the upstream. The tokens are cached
+// per user and audience until shortly before they expire.
+func (e *TokenExchange) exchange(ctx context.Context, ar *requests.AuthorizationRequest, now time.Time) (string, error) {
+	subject := getTokenExchangeSubject(ar)
+	key := e.getCacheKey(ar)
+	if key != "" {
+		if token, found := e.cache.get(key, subject, now); found {
+			return token, nil
+		}
+	}
+
+	var token string
+	var expiresAt time.Time
+	var err error
+	if e.signer != nil {
+		token, expiresAt, err = e.mint(ar, now)
+	} else {
+		token, expiresAt, err = e.fetch(ctx, ar, now)
+	}
+	if err != nil {
+		return "", err
+	}
+	if key != "" && !expiresAt.IsZero() {
+		e.cache.set(key, &tokenExchangeCacheEntry{
+			subject:   subject,
+			token:     token,
+			expiresAt: expiresAt.Add(-tokenExchangeExpirySkew),
+		}, now)
+	}
+	return token, nil
+}
+
+func (e *TokenExchange) mint(ar *requests.AuthorizationRequest, now time.Time) (string, time.Time, error) {
+	claims := e.signer.getClaims(ar, now)
+	if len(e.Scopes) > 0 {
+		claims["scope"] = strings.Join(e.Scopes, " ")
+	}
+	token, err := e.signer.sign(claims)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("token exchange failed minting token: %v", err)
+	}
+	return token, now.Add(time.Duration(e.Lifetime) * time.Second), nil
+}
+
+// tokenExchangeResponse is the response of the token endpoint, see
+// RFC 8693, Section 2.2.
+type tokenExchangeResponse struct {
+	AccessToken      string `json:"access_token"`
+	IssuedTokenType  string `json:"issued_token_type"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (e *TokenExchange) fetch(ctx context.Context, ar *requests.AuthorizationRequest, now time.Time) (string, time.Time, error) {
+	if !ar.Token.Found || ar.Token.IsPlainPayload || ar.Token.Payload == "" {
+		return "", time.Time{}, fmt.Errorf("token exchange has no subject token")
+	}
+	params := url.Values{}
+	params.Set("grant_type", tokenExchangeGrantType)
+	params.Set("subject_token", ar.Token.Payload)
+	params.Set("subject_token_type", tokenTypeJWT)
+	params.Set("requested_token_type", tokenTypeAccessToken)
+	params.Set("audience", e.Audience)
+	if len(e.Scopes) > 0 {
+		params.Set("scope", strings.Join(e.Scopes, " "))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.TokenEndpoint, strings.NewReader(params.Encode()))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("token exchange failed creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if e.ClientID != "" {
+		// The client credentials are form-encoded before being used as the
+		// basic auth credentials, see RFC 6749, Section 2.3.1.
+		req.SetBasicAuth(url.QueryEscape(e.ClientID), url.QueryEscape(e.clientSecret))
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("token exchange request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxTokenExchangeRespSize))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("token exchange failed reading response: %v", err)
+	}
+	var data tokenExchangeResponse
+	if err := json.Unmarshal(b, &data); err != nil {
+		return "", time.Time{}, fmt.Errorf("token exchange response is malformed, status code %d", resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if data.Error != "" {
+			return "", time.Time{}, fmt.Errorf("token exchange failed with status code %d: %s", resp.StatusCode, strings.TrimSpace(data.Error+" "+data.ErrorDescription))
+		}
+		return "", time.Time{}, fmt.Errorf("token exchange failed with status code %d", resp.StatusCode)
+	}
+	if data.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("token exchange response has no access token")
+	}
+	if data.TokenType != "" && !strings.EqualFold(data.TokenType, "bearer") && data.TokenType != "N_A" {
+		return "", time.Time{}, fmt.Errorf("token exchange response has unsupported token type: %s", data.TokenType)
+	}
+
+	var expiresAt time.Time
+	if data.ExpiresIn > 0 {
+		expiresAt = now.Add(time.Duration(data.ExpiresIn) * time.Second)
+	} else {
+		expiresAt = getUnverifiedTokenExpiry(data.AccessToken)
+	}
+	return data.AccessToken, expiresAt, nil
+}
+
+// getCacheKey returns the cache key of the user of the request. The tokens
+// of the requests without a user identifier are not cached.
+func (e *TokenExchange) getCacheKey(ar *requests.AuthorizationRequest) string {
+	for _, k := range []string{"sub", "email"} {
+		v, found := lookupClaimValue([]map[string]interface{}{getTokenClaims(ar), ar.Response.User}, k)
+		if !found {
+			continue
+		}
+		if s, ok := v.(string); ok && s != "" {
+			return e.Audience + "\x00" + s
+		}
+	}
+	return ""
+}
+
+// getTokenExchangeSubject returns the digest of the token of the request.
+// The cached token is reused only for the same subject token, so that it
+// does not outlive the session of the user.
+func getTokenExchangeSubject(ar *requests.AuthorizationRequest) string {
+	h := sha256.New()
+	if ar.Token.Found {
+		h.Write([]byte(ar.Token.Payload))
+	} else {
+		b, _ := json.Marshal(ar.Response.User)
+		h.Write(b)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// getUnverifiedTokenExpiry returns the expiry of the issued JWT token. The
+// token is verified by the upstream, the expiry only limits the caching.
+func getUnverifiedTokenExpiry(s string) time.Time {
+	claims := jwtlib.MapClaims{}
+	if _, _, err := jwtlib.NewParser().ParseUnverified(s, claims); err != nil {
+		return time.Time{}
+	}
+	exp, err := claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		return time.Time{}
+	}
+	return exp.Time
+}
+
+type tokenExchangeCacheEntry struct {
+	subject   string
+	token     string
+	expiresAt time.Time
+}
+
+type tokenExchangeCache struct {
+	mu      sync.Mutex
+	entries map[string]*tokenExchangeCacheEntry
+}
+
+func newTokenExchangeCache() *tokenExchangeCache {
+	return &tokenExchangeCache{entries: make(map[string]*tokenExchangeCacheEntry)}
+}
+
+func (c *tokenExchangeCache) get(key, subject string, now time.Time) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, found := c.entries[key]
+	if !found || entry.subject != subject || !now.Before(entry.expiresAt) {
+		return "", false
+	}
+	return entry.token, true
+}
+
+func (c *tokenExchangeCache) set(key string, entry *tokenExchangeCacheEntry, now time.Time) {
+	if !now.Before(entry.expiresAt) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, found := c.entries[key]; !found && len(c.entries) >= maxTokenExchangeCacheLen {
+		for k, v := range c.entries {
+			if !now.Before(v.expiresAt) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxTokenExchangeCacheLen {
+			return
+		}
+	}
+	c.entries[key] = entry
+}
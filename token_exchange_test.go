@@ -0,0 +1,351 @@
+// Copyright 2022 Paul Greenberg greenpau@outlook.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package security
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwtlib "github.com/golang-jwt/jwt/v5"
+	"github.com/google/go-cmp/cmp"
+	"github.com/greenpau/go-authcrunch/pkg/authz"
+	"github.com/greenpau/go-authcrunch/pkg/requests"
+)
+
+func TestTokenExchange(t *testing.T) {
+	var calls int
+	var gotForm map[string]string
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		id, secret, _ := r.BasicAuth()
+		secret, _ = url.QueryUnescape(secret)
+		if id != "caddy" || secret != "s3cr%t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"invalid_client"}`))
+			return
+		}
+		r.ParseForm()
+		gotForm = make(map[string]string)
+		for k := range r.PostForm {
+			gotForm[k] = r.PostForm.Get(k)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"upstream-token-%d","issued_token_type":%q,"token_type":"Bearer","expires_in":120}`, calls, tokenTypeAccessToken)
+	}))
+	defer idp.Close()
+
+	t.Setenv("TOKEN_EXCHANGE_SECRET", "s3cr%t")
+	e := &TokenExchange{
+		Audience:      "orders.internal",
+		Scopes:        []string{"orders:read"},
+		TokenEndpoint: idp.URL,
+		ClientID:      "caddy",
+		ClientSecret:  "{env.TOKEN_EXCHANGE_SECRET}",
+	}
+	if err := e.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := e.provision(&authz.PolicyConfig{Name: "mypolicy"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	now := time.Now()
+	subjectToken := newTestSubjectToken(map[string]interface{}{"sub": "jsmith"})
+	testcases := []struct {
+		name      string
+		token     string
+		user      string
+		now       time.Time
+		want      string
+		wantCalls int
+	}{
+		{
+			name:      "test token exchange",
+			token:     subjectToken,
+			user:      "jsmith",
+			now:       now,
+			want:      "upstream-token-1",
+			wantCalls: 1,
+		},
+		{
+			name:      "test cached token",
+			token:     subjectToken,
+			user:      "jsmith",
+			now:       now.Add(60 * time.Second),
+			want:      "upstream-token-1",
+			wantCalls: 1,
+		},
+		{
+			name:      "test cached token about to expire",
+			token:     subjectToken,
+			user:      "jsmith",
+			now:       now.Add(100 * time.Second),
+			want:      "upstream-token-2",
+			wantCalls: 2,
+		},
+		{
+			name:      "test new subject token of same user",
+			token:     newTestSubjectToken(map[string]interface{}{"sub": "jsmith", "jti": "2"}),
+			user:      "jsmith",
+			now:       now.Add(100 * time.Second),
+			want:      "upstream-token-3",
+			wantCalls: 3,
+		},
+		{
+			name:      "test another user",
+			token:     newTestSubjectToken(map[string]interface{}{"sub": "jdoe"}),
+			user:      "jdoe",
+			now:       now.Add(100 * time.Second),
+			want:      "upstream-token-4",
+			wantCalls: 4,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ar := newTestTokenExchangeRequest(tc.token, tc.user)
+			got, err := e.exchange(context.Background(), ar, tc.now)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("exchange() mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.wantCalls, calls); diff != "" {
+				t.Errorf("token endpoint calls mismatch (-want +got):\n%s", diff)
+			}
+			want := map[string]string{
+				"grant_type":           tokenExchangeGrantType,
+				"subject_token":        tc.token,
+				"subject_token_type":   tokenTypeJWT,
+				"requested_token_type": tokenTypeAccessToken,
+				"audience":             "orders.internal",
+				"scope":                "orders:read",
+			}
+			if diff := cmp.Diff(want, gotForm); diff != "" {
+				t.Errorf("token exchange request mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTokenExchangeErrors(t *testing.T) {
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_target","error_description":"unknown audience"}`))
+	}))
+	defer idp.Close()
+
+	testcases := []struct {
+		name   string
+		config *TokenExchange
+		token  string
+		err    string
+	}{
+		{
+			name:   "test token endpoint error",
+			config: &TokenExchange{Audience: "foo", TokenEndpoint: idp.URL},
+			token:  newTestSubjectToken(map[string]interface{}{"sub": "jsmith"}),
+			err:    "token exchange failed with status code 400: invalid_target unknown audience",
+		},
+		{
+			name:   "test request without subject token",
+			config: &TokenExchange{Audience: "foo", TokenEndpoint: idp.URL},
+			err:    "token exchange has no subject token",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.config.Validate(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := tc.config.provision(&authz.PolicyConfig{Name: "mypolicy"}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			_, err := tc.config.exchange(context.Background(), newTestTokenExchangeRequest(tc.token, "jsmith"), time.Now())
+			if err == nil {
+				t.Fatalf("unexpected success, want: %v", tc.err)
+			}
+			if diff := cmp.Diff(tc.err, err.Error()); diff != "" {
+				t.Fatalf("unexpected error mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestStripSubjectToken(t *testing.T) {
+	testcases := []struct {
+		name        string
+		policy      *authz.PolicyConfig
+		url         string
+		cookies     []*http.Cookie
+		wantURL     string
+		wantCookies []string
+	}{
+		{
+			name:   "test default token sources",
+			policy: &authz.PolicyConfig{Name: "mypolicy"},
+			url:    "/orders?access_token=foo&jwt_access_token=foo&page=2",
+			cookies: []*http.Cookie{
+				{Name: "access_token", Value: "foo"},
+				{Name: "SESSION_ID", Value: "bar"},
+			},
+			wantURL:     "/orders?page=2",
+			wantCookies: []string{"SESSION_ID=bar"},
+		},
+		{
+			name:   "test portal cookie token sources",
+			policy: &authz.PolicyConfig{Name: "mypolicy", AccessTokenCookieNames: []string{"AUTHP_ACCESS_TOKEN"}},
+			url:    "/orders?authp_access_token=foo&access_token=foo",
+			cookies: []*http.Cookie{
+				{Name: "AUTHP_ACCESS_TOKEN", Value: "foo"},
+				{Name: "access_token", Value: "bar"},
+			},
+			wantURL:     "/orders",
+			wantCookies: []string{"access_token=bar"},
+		},
+		{
+			name:        "test request without token",
+			policy:      &authz.PolicyConfig{Name: "mypolicy"},
+			url:         "/orders?page=2",
+			cookies:     []*http.Cookie{{Name: "SESSION_ID", Value: "bar"}},
+			wantURL:     "/orders?page=2",
+			wantCookies: []string{"SESSION_ID=bar"},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := &TokenExchange{Audience: "foo", TokenEndpoint: "https://localhost/token"}
+			if err := e.provision(tc.policy); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			r := httptest.NewRequest(http.MethodGet, tc.url, nil)
+			for _, c := range tc.cookies {
+				r.AddCookie(c)
+			}
+			e.stripSubjectToken(r)
+			var cookies []string
+			for _, c := range r.Cookies() {
+				cookies = append(cookies, c.String())
+			}
+			got := map[string]interface{}{
+				"url":         r.URL.String(),
+				"request_uri": r.RequestURI,
+				"cookies":     cookies,
+			}
+			want := map[string]interface{}{
+				"url":         tc.wantURL,
+				"request_uri": tc.wantURL,
+				"cookies":     tc.wantCookies,
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("stripSubjectToken() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTokenExchangeLocal(t *testing.T) {
+	dir := t.TempDir()
+	writeTestKeyPair(t, dir)
+	p := &authz.PolicyConfig{
+		Name: "mypolicy",
+		RawCryptoKeyStoreConfig: []string{
+			"crypto key verify 0e2fdcf8-6868-41a7-884b-7308795fc286",
+			"crypto key exchange sign from file " + filepath.Join(dir, "private.pem"),
+		},
+	}
+	ext := &AuthorizationPolicyExtension{
+		Name: "mypolicy",
+		TokenExchange: &TokenExchange{
+			Audience: "orders.internal",
+			Scopes:   []string{"orders:read", "orders:write"},
+			KeyID:    "exchange",
+		},
+	}
+	if err := ext.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ext.provision([]*authz.PolicyConfig{p}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	now := time.Now()
+	ar := newTestTokenExchangeRequest(newTestSubjectToken(map[string]interface{}{"sub": "jsmith"}), "jsmith")
+	s, err := ext.TokenExchange.exchange(context.Background(), ar, now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cached, err := ext.TokenExchange.exchange(context.Background(), ar, now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(s, cached); diff != "" {
+		t.Errorf("cached token mismatch (-want +got):\n%s", diff)
+	}
+
+	b, err := getAssertionJWKS([]*AuthorizationPolicyExtension{ext})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keys := getTestJWKSKeys(t, b)
+	token, err := jwtlib.Parse(s, func(token *jwtlib.Token) (interface{}, error) {
+		return keys[token.Header["kid"].(string)], nil
+	}, jwtlib.WithAudience("orders.internal"), jwtlib.WithValidMethods([]string{"ES256"}))
+	if err != nil {
+		t.Fatalf("failed verifying exchanged token with jwks: %v", err)
+	}
+	claims := token.Claims.(jwtlib.MapClaims)
+	delete(claims, "jti")
+	want := jwtlib.MapClaims{
+		"sub":   "jsmith",
+		"email": "jsmith@example.com",
+		"scope": "orders:read orders:write",
+		"aud":   "orders.internal",
+		"iat":   float64(now.Unix()),
+		"nbf":   float64(now.Unix()),
+		"exp":   float64(now.Unix() + defaultTokenExchangeTTL),
+	}
+	if diff := cmp.Diff(want, claims); diff != "" {
+		t.Errorf("exchanged token claims mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// newTestSubjectToken returns the unsigned token with the claims. The
+// token exchange does not verify the token validated by the gatekeeper.
+func newTestSubjectToken(claims map[string]interface{}) string {
+	b, _ := json.Marshal(claims)
+	return "eyJhbGciOiJFUzI1NiJ9." + base64.RawURLEncoding.EncodeToString(b) + ".c2ln"
+}
+
+func newTestTokenExchangeRequest(token, user string) *requests.AuthorizationRequest {
+	ar := requests.NewAuthorizationRequest()
+	if token != "" {
+		ar.Token.Found = true
+		ar.Token.Payload = token
+	}
+	ar.Response.User = map[string]interface{}{
+		"sub":   user,
+		"email": user + "@example.com",
+	}
+	return ar
+}